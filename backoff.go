@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	jitterFull         = "full"
+	jitterEqual        = "equal"
+	jitterDecorrelated = "decorrelated"
+)
+
+// backoff computes exponentially growing delays between put retries,
+// randomized with one of the jitter strategies described in
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+type backoff struct {
+	base   time.Duration
+	max    time.Duration
+	jitter string
+
+	// random returns a number in [0, 1). It is rand.Float64 unless
+	// overridden in tests.
+	random func() float64
+
+	// prev is the last delay handed out, used by decorrelated jitter.
+	prev time.Duration
+
+	// retries and unlogged count the retries logRetry was called for, and
+	// how many of them it didn't log.
+	retries  int
+	unlogged int
+}
+
+// newBackoff returns a backoff using the configured delays and jitter.
+func newBackoff() *backoff {
+	return &backoff{
+		base:   config.RetryBaseDelay,
+		max:    config.RetryMaxDelay,
+		jitter: config.RetryJitter,
+		random: rand.Float64,
+	}
+}
+
+// capped returns base * 2^attempt, limited to max.
+func (b *backoff) capped(attempt int) time.Duration {
+	d := b.base
+	for i := 0; i < attempt; i++ {
+		d *= 2
+		if d >= b.max || d <= 0 {
+			return b.max
+		}
+	}
+	if d > b.max {
+		return b.max
+	}
+	return d
+}
+
+// next returns how long to wait before retry number attempt (zero based).
+func (b *backoff) next(attempt int) time.Duration {
+	var d time.Duration
+
+	switch b.jitter {
+	case jitterEqual:
+		c := b.capped(attempt)
+		d = c/2 + time.Duration(b.random()*float64(c/2))
+	case jitterDecorrelated:
+		prev := b.prev
+		if prev < b.base {
+			prev = b.base
+		}
+		d = b.base + time.Duration(b.random()*float64(prev*3-b.base))
+		if d > b.max {
+			d = b.max
+		}
+	default:
+		d = time.Duration(b.random() * float64(b.capped(attempt)))
+	}
+
+	b.prev = d
+	return d
+}
+
+// logRetry logs retry number attempt (zero based), as long as it is among
+// the first config.RetryLogFirst or every config.RetryLogEvery after, so
+// sustained throttling doesn't flood the logs.
+func (b *backoff) logRetry(attempt int, format string, v ...interface{}) {
+	b.retries++
+
+	n := attempt - config.RetryLogFirst + 1
+	if attempt < config.RetryLogFirst || (config.RetryLogEvery > 0 && n%config.RetryLogEvery == 0) {
+		warnf(format, v...)
+		return
+	}
+
+	b.unlogged++
+}
+
+// logUnlogged logs how many retries logRetry left out, if any.
+func (b *backoff) logUnlogged() {
+	if b.unlogged > 0 {
+		logf("Retried %d times, %d of the retries were not logged\n", b.retries, b.unlogged)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffCapped(t *testing.T) {
+	b := &backoff{base: 100 * time.Millisecond, max: time.Second}
+
+	require.Equal(t, 100*time.Millisecond, b.capped(0))
+	require.Equal(t, 200*time.Millisecond, b.capped(1))
+	require.Equal(t, 800*time.Millisecond, b.capped(3))
+	require.Equal(t, time.Second, b.capped(4))
+	require.Equal(t, time.Second, b.capped(100))
+}
+
+func TestBackoffNext(t *testing.T) {
+	for _, tc := range []struct {
+		jitter string
+		random float64
+		// expected delays for attempts 0 through 4
+		expected []time.Duration
+	}{
+		{
+			jitter:   jitterFull,
+			random:   0,
+			expected: []time.Duration{0, 0, 0, 0, 0},
+		},
+		{
+			jitter: jitterFull,
+			random: 0.5,
+			expected: []time.Duration{
+				50 * time.Millisecond,
+				100 * time.Millisecond,
+				200 * time.Millisecond,
+				400 * time.Millisecond,
+				500 * time.Millisecond,
+			},
+		},
+		{
+			jitter: jitterEqual,
+			random: 0,
+			expected: []time.Duration{
+				50 * time.Millisecond,
+				100 * time.Millisecond,
+				200 * time.Millisecond,
+				400 * time.Millisecond,
+				500 * time.Millisecond,
+			},
+		},
+		{
+			jitter: jitterEqual,
+			random: 0.999,
+			expected: []time.Duration{
+				99950 * time.Microsecond,
+				199900 * time.Microsecond,
+				399800 * time.Microsecond,
+				799600 * time.Microsecond,
+				999500 * time.Microsecond,
+			},
+		},
+		{
+			jitter: jitterDecorrelated,
+			random: 0,
+			expected: []time.Duration{
+				100 * time.Millisecond,
+				100 * time.Millisecond,
+				100 * time.Millisecond,
+				100 * time.Millisecond,
+				100 * time.Millisecond,
+			},
+		},
+		{
+			jitter: jitterDecorrelated,
+			random: 0.5,
+			expected: []time.Duration{
+				200 * time.Millisecond,
+				350 * time.Millisecond,
+				575 * time.Millisecond,
+				912500 * time.Microsecond,
+				time.Second,
+			},
+		},
+	} {
+		t.Run(fmt.Sprintf("%s-%v", tc.jitter, tc.random), func(t *testing.T) {
+			b := &backoff{
+				base:   100 * time.Millisecond,
+				max:    time.Second,
+				jitter: tc.jitter,
+				random: func() float64 { return tc.random },
+			}
+
+			for attempt, expected := range tc.expected {
+				d := b.next(attempt)
+				require.Equal(t, expected, d, "attempt %d", attempt)
+				require.True(t, d >= 0 && d <= b.max)
+			}
+		})
+	}
+}
+
+func TestNewBackoff(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.RetryBaseDelay = 10 * time.Millisecond
+		c.RetryMaxDelay = time.Second
+		c.RetryJitter = jitterEqual
+	})
+
+	b := newBackoff()
+	require.Equal(t, 10*time.Millisecond, b.base)
+	require.Equal(t, time.Second, b.max)
+	require.Equal(t, jitterEqual, b.jitter)
+}
+
+func TestBackoffLogRetry(t *testing.T) {
+	logs := captureLogs(t)
+	withConfig(t, func(c *Config) {
+		c.RetryLogFirst = 2
+		c.RetryLogEvery = 3
+	})
+
+	b := newBackoff()
+	for attempt := 0; attempt < 10; attempt++ {
+		b.logRetry(attempt, "retry %d\n", attempt)
+	}
+	b.logUnlogged()
+
+	require.Equal(t, "WARN retry 0\nWARN retry 1\nWARN retry 4\nWARN retry 7\nRetried 10 times, 6 of the retries were not logged\n", logs.String())
+}
+
+func TestBackoffLogRetryBounded(t *testing.T) {
+	logs := captureLogs(t)
+	fh, _ := withFakeAPIs(t)
+	for i := 0; i < 19; i++ {
+		fh.errs = append(fh.errs, awserr.New("ThrottlingException", "slow down", nil))
+	}
+
+	records := []*firehose.Record{{Data: []byte("a")}}
+	delivered, err := putRecordsToFirehoseStream(context.Background(), fh, "DataLog", records, newBackoff(), 20)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true}, delivered)
+	require.Len(t, fh.inputs, 20)
+
+	// The first 3, then the 8th, 13th and 18th of the 19 retries.
+	require.Equal(t, 6, strings.Count(logs.String(), "retrying"))
+	require.Contains(t, logs.String(), "Retried 19 times, 13 of the retries were not logged\n")
+}
+
+func TestBackoffLogRetryNothingUnlogged(t *testing.T) {
+	logs := captureLogs(t)
+
+	b := newBackoff()
+	b.logRetry(0, "retry\n")
+	b.logUnlogged()
+
+	require.Equal(t, "WARN retry\n", logs.String())
+}
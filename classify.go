@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	errorRetryable = "retryable"
+	errorTerminal  = "terminal"
+)
+
+// retryableErrorCodes are the AWS error codes, for whole requests or single
+// records, that are worth retrying. Anything else is terminal.
+var retryableErrorCodes = map[string]bool{
+	// Throttling
+	"ProvisionedThroughputExceededException": true,
+	"ThrottlingException":                    true,
+	"Throttling":                             true,
+	"LimitExceededException":                 true,
+	"KMSThrottlingException":                 true,
+	"SlowDown":                               true,
+
+	// Server side failures
+	"ServiceUnavailableException": true,
+	"ServiceUnavailable":          true,
+	"InternalFailure":             true,
+	"InternalServerError":         true,
+	"InternalError":               true,
+
+	// Transport failures reported by the SDK
+	request.ErrCodeRequestError:    true,
+	request.ErrCodeResponseTimeout: true,
+	"RequestTimeout":               true,
+	"RequestTimeoutException":      true,
+}
+
+// classifyErrorCode classifies an AWS error code as retryable or terminal.
+func classifyErrorCode(code string) string {
+	if retryableErrorCodes[code] {
+		return errorRetryable
+	}
+	return errorTerminal
+}
+
+// classifyError classifies an error returned by a put as retryable or
+// terminal, and emits a metric for the category.
+func classifyError(err error) string {
+	category := errorTerminal
+
+	var aerr awserr.Error
+	var nerr net.Error
+	if errors.As(err, &aerr) {
+		category = classifyErrorCode(aerr.Code())
+	} else if errors.As(err, &nerr) {
+		category = errorRetryable
+	}
+
+	emitErrorMetric(category)
+	return category
+}
+
+// classifyErrorCodes classifies the per record error codes of a partially
+// failed put. It is retryable if any of the codes is, or if there are none,
+// as a failed count without codes says nothing about why the records failed.
+func classifyErrorCodes(codes []string) string {
+	category := errorTerminal
+	if len(codes) == 0 {
+		category = errorRetryable
+	}
+	for _, code := range codes {
+		if classifyErrorCode(code) == errorRetryable {
+			category = errorRetryable
+			break
+		}
+	}
+
+	emitErrorMetric(category)
+	return category
+}
+
+func emitErrorMetric(category string) {
+	if category == errorRetryable {
+		countMetric("RetryableErrors", 1, "Count")
+	} else {
+		countMetric("TerminalErrors", 1, "Count")
+	}
+}
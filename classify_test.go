@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyErrorCode(t *testing.T) {
+	for code, expected := range map[string]string{
+		"ProvisionedThroughputExceededException": errorRetryable,
+		"ServiceUnavailableException":            errorRetryable,
+		"InternalFailure":                        errorRetryable,
+		"ThrottlingException":                    errorRetryable,
+		"RequestError":                           errorRetryable,
+		"ResourceNotFoundException":              errorTerminal,
+		"InvalidArgumentException":               errorTerminal,
+		"AccessDeniedException":                  errorTerminal,
+		"KMSAccessDeniedException":               errorTerminal,
+		"":                                       errorTerminal,
+	} {
+		require.Equal(t, expected, classifyErrorCode(code), code)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	b := captureLogs(t)
+
+	for _, tc := range []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{
+			name:     "throttled",
+			err:      awserr.New("ProvisionedThroughputExceededException", "slow down", nil),
+			expected: errorRetryable,
+		},
+		{
+			name:     "missing stream",
+			err:      awserr.New("ResourceNotFoundException", "no such stream", nil),
+			expected: errorTerminal,
+		},
+		{
+			name:     "transport",
+			err:      awserr.New("RequestError", "send request failed", errors.New("connection reset")),
+			expected: errorRetryable,
+		},
+		{
+			name:     "network",
+			err:      fmt.Errorf("put failed: %w", &net.OpError{Op: "dial", Err: errors.New("timeout")}),
+			expected: errorRetryable,
+		},
+		{
+			name:     "unknown",
+			err:      errors.New("something else"),
+			expected: errorTerminal,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, classifyError(tc.err))
+		})
+	}
+
+	metrics.flush(emitMetric)
+	require.Contains(t, b.String(), "metric RetryableErrors=3 unit=Count")
+	require.Contains(t, b.String(), "metric TerminalErrors=2 unit=Count")
+}
+
+func TestClassifyErrorCodes(t *testing.T) {
+	captureLogs(t)
+
+	require.Equal(t, errorRetryable, classifyErrorCodes([]string{"InvalidArgumentException", "InternalFailure"}))
+	require.Equal(t, errorTerminal, classifyErrorCodes([]string{"KMSAccessDeniedException"}))
+	require.Equal(t, errorRetryable, classifyErrorCodes(nil))
+}
+
+func TestPutRecordsToFirehoseStreamRetriesRetryableErrors(t *testing.T) {
+	captureLogs(t)
+	fh, _ := withFakeAPIs(t)
+	fh.errs = []error{
+		awserr.New("ServiceUnavailableException", "busy", nil),
+	}
+
+	records := []*firehose.Record{{Data: []byte("a")}}
+	_, err := putRecordsToFirehoseStream(context.Background(), fh, "DataLog", records, newBackoff(), 3)
+	require.NoError(t, err)
+	require.Len(t, fh.inputs, 2)
+}
+
+func TestPutRecordsToFirehoseStreamStopsOnTerminalErrors(t *testing.T) {
+	captureLogs(t)
+	fh, _ := withFakeAPIs(t)
+	fh.errs = []error{
+		awserr.New("ResourceNotFoundException", "no such stream", nil),
+	}
+
+	records := []*firehose.Record{{Data: []byte("a")}}
+	_, err := putRecordsToFirehoseStream(context.Background(), fh, "DataLog", records, newBackoff(), 3)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not retryable")
+	require.Len(t, fh.inputs, 1)
+}
+
+func TestPutRecordsToKinesisStreamStopsOnTerminalRecordErrors(t *testing.T) {
+	captureLogs(t)
+	_, ks := withFakeAPIs(t)
+	ks.outputs = []*kinesis.PutRecordsOutput{
+		{
+			FailedRecordCount: aws.Int64(1),
+			Records: []*kinesis.PutRecordsResultEntry{
+				{SequenceNumber: aws.String("1")},
+				{ErrorCode: aws.String("KMSAccessDeniedException")},
+			},
+		},
+	}
+
+	records := []*kinesis.PutRecordsRequestEntry{
+		{Data: []byte("a"), PartitionKey: aws.String("k")},
+		{Data: []byte("b"), PartitionKey: aws.String("k")},
+	}
+	_, err := putRecordsToKinesisStream(context.Background(), ks, "DataLog", records, newBackoff(), 3)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "KMSAccessDeniedException")
+	require.Len(t, ks.inputs, 1)
+}
+
+func TestPutRecordsToKinesisStreamRetriesThrottledRecords(t *testing.T) {
+	captureLogs(t)
+	_, ks := withFakeAPIs(t)
+	ks.outputs = []*kinesis.PutRecordsOutput{
+		{
+			FailedRecordCount: aws.Int64(1),
+			Records: []*kinesis.PutRecordsResultEntry{
+				{ErrorCode: aws.String("ProvisionedThroughputExceededException")},
+			},
+		},
+	}
+
+	records := []*kinesis.PutRecordsRequestEntry{
+		{Data: []byte("a"), PartitionKey: aws.String("k")},
+	}
+	_, err := putRecordsToKinesisStream(context.Background(), ks, "DataLog", records, newBackoff(), 3)
+	require.NoError(t, err)
+	require.Len(t, ks.inputs, 2)
+}
+
+func TestPutRecordsToKinesisStreamOversizeRecords(t *testing.T) {
+	b := captureLogs(t)
+	_, ks := withFakeAPIs(t)
+
+	records := []*kinesis.PutRecordsRequestEntry{
+		{Data: []byte("a"), PartitionKey: aws.String("k")},
+		{Data: make([]byte, maxKinesisRecordSize), PartitionKey: aws.String("k")},
+	}
+	_, err := putRecordsToKinesisStream(context.Background(), ks, "DataLog", records, newBackoff(), 3)
+	require.EqualError(t, err, "Could not put records, 1 of them are over the 1048576 bytes Kinesis record size limit")
+	require.Empty(t, ks.inputs)
+	metrics.flush(emitMetric)
+	require.Contains(t, b.String(), "metric OversizeRecords=1 unit=Count")
+
+	// Exactly at the limit is fine.
+	records[1].Data = make([]byte, maxKinesisRecordSize-1)
+	_, err = putRecordsToKinesisStream(context.Background(), ks, "DataLog", records, newBackoff(), 3)
+	require.NoError(t, err)
+	require.Len(t, ks.inputs, 1)
+}
+
+func TestPutRecordsToFirehoseStreamOversizeRecords(t *testing.T) {
+	b := captureLogs(t)
+	fh, _ := withFakeAPIs(t)
+
+	records := []*firehose.Record{
+		{Data: []byte("a")},
+		{Data: make([]byte, maxFirehoseRecordSize+1)},
+	}
+	delivered, err := putRecordsToFirehoseStream(context.Background(), fh, "DataLog", records, newBackoff(), 3)
+	require.EqualError(t, err, "Could not put records, 1 of them are over the 1024000 bytes Firehose record size limit")
+	require.Equal(t, []bool{false, false}, delivered)
+	require.Empty(t, fh.inputs)
+	metrics.flush(emitMetric)
+	require.Contains(t, b.String(), "metric OversizeRecords=1 unit=Count")
+
+	records[1].Data = make([]byte, maxFirehoseRecordSize)
+	_, err = putRecordsToFirehoseStream(context.Background(), fh, "DataLog", records, newBackoff(), 3)
+	require.NoError(t, err)
+	require.Len(t, fh.inputs, 1)
+}
+
+func TestHandleRequestOversizeKinesisRecord(t *testing.T) {
+	captureLogs(t)
+	_, ks := withFakeAPIs(t)
+	withConfig(t, func(c *Config) {
+		c.PutFailure = putFailureMarkFailed
+	})
+
+	orig := BeforePut
+	t.Cleanup(func() {
+		BeforePut = orig
+	})
+	BeforePut = func(ctx context.Context, records []ReingestionRecord) ([]ReingestionRecord, error) {
+		for i := range records {
+			records[i].Data = append(records[i].Data, make([]byte, maxKinesisRecordSize)...)
+		}
+		return records, nil
+	}
+
+	e := Event{
+		SourceKinesisStreamArn: "arn:aws:kinesis:us-east-1:1234567890:stream/DataLog",
+		Records: []EventRecord{
+			{
+				RecordId: "1",
+				Data: encodeMessage(t, Message{
+					MessageType: dataMessage,
+					LogEvents:   []LogEvent{{Id: "a", Message: "first"}, {Id: "b", Message: "second"}},
+				}),
+				KinesisMetadata: KinesisRecordMetadata{PartitionKey: "k"},
+			},
+		},
+	}
+	withConfig(t, func(c *Config) {
+		c.RecordPerLogEvent = true
+	})
+
+	r, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	require.Equal(t, ResultRecord{RecordId: "1", Result: resultStatusFailed}, r.Records[0])
+	require.Empty(t, ks.inputs)
+}
+
+func TestPutRecordsToFirehoseStreamErrorCodesWithoutFailedPutCount(t *testing.T) {
+	captureLogs(t)
+	fh, _ := withFakeAPIs(t)
+	fh.outputs = []*firehose.PutRecordBatchOutput{
+		{
+			FailedPutCount: aws.Int64(0),
+			RequestResponses: []*firehose.PutRecordBatchResponseEntry{
+				{RecordId: aws.String("1")},
+				{ErrorCode: aws.String("ServiceUnavailableException")},
+			},
+		},
+	}
+
+	records := []*firehose.Record{{Data: []byte("a")}, {Data: []byte("b")}}
+	_, err := putRecordsToFirehoseStream(context.Background(), fh, "DataLog", records, newBackoff(), 3)
+	require.NoError(t, err)
+	require.Len(t, fh.inputs, 2)
+}
+
+func TestPutRecordsToKinesisStreamErrorCodesWithoutFailedRecordCount(t *testing.T) {
+	captureLogs(t)
+	_, ks := withFakeAPIs(t)
+	ks.outputs = []*kinesis.PutRecordsOutput{
+		{
+			FailedRecordCount: aws.Int64(0),
+			Records: []*kinesis.PutRecordsResultEntry{
+				{ErrorCode: aws.String("AccessDeniedException")},
+			},
+		},
+	}
+
+	records := []*kinesis.PutRecordsRequestEntry{{Data: []byte("a"), PartitionKey: aws.String("k")}}
+	_, err := putRecordsToKinesisStream(context.Background(), ks, "DataLog", records, newBackoff(), 3)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "AccessDeniedException")
+	require.Len(t, ks.inputs, 1)
+}
+
+func TestPutRecordsErrorsIncludeRequestId(t *testing.T) {
+	captureLogs(t)
+
+	t.Run("firehose partial failure", func(t *testing.T) {
+		fh, _ := withFakeAPIs(t)
+		fh.requestId = "0c5d1a6b-firehose"
+		fh.outputs = []*firehose.PutRecordBatchOutput{
+			{
+				FailedPutCount: aws.Int64(1),
+				RequestResponses: []*firehose.PutRecordBatchResponseEntry{
+					{ErrorCode: aws.String("AccessDeniedException")},
+				},
+			},
+		}
+
+		records := []*firehose.Record{{Data: []byte("a")}}
+		_, err := putRecordsToFirehoseStream(context.Background(), fh, "DataLog", records, newBackoff(), 3)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "request id: 0c5d1a6b-firehose")
+	})
+
+	t.Run("kinesis partial failure", func(t *testing.T) {
+		_, ks := withFakeAPIs(t)
+		ks.requestId = "0c5d1a6b-kinesis"
+		ks.outputs = []*kinesis.PutRecordsOutput{
+			{
+				FailedRecordCount: aws.Int64(1),
+				Records: []*kinesis.PutRecordsResultEntry{
+					{ErrorCode: aws.String("AccessDeniedException")},
+				},
+			},
+		}
+
+		records := []*kinesis.PutRecordsRequestEntry{{Data: []byte("a"), PartitionKey: aws.String("k")}}
+		_, err := putRecordsToKinesisStream(context.Background(), ks, "DataLog", records, newBackoff(), 3)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "request id: 0c5d1a6b-kinesis")
+	})
+
+	t.Run("whole request failure", func(t *testing.T) {
+		fh, _ := withFakeAPIs(t)
+		fh.errs = []error{
+			awserr.NewRequestFailure(awserr.New("ResourceNotFoundException", "no such stream", nil), 400, "0c5d1a6b-request"),
+		}
+
+		records := []*firehose.Record{{Data: []byte("a")}}
+		_, err := putRecordsToFirehoseStream(context.Background(), fh, "DataLog", records, newBackoff(), 3)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "request id: 0c5d1a6b-request")
+	})
+}
+
+func TestPutRecordsToKinesisStreamRetriesOnlyFailedRecords(t *testing.T) {
+	captureLogs(t)
+	_, ks := withFakeAPIs(t)
+	ks.outputs = []*kinesis.PutRecordsOutput{
+		{
+			FailedRecordCount: aws.Int64(1),
+			Records: []*kinesis.PutRecordsResultEntry{
+				{ErrorCode: aws.String("ProvisionedThroughputExceededException")},
+				{SequenceNumber: aws.String("2")},
+			},
+		},
+	}
+
+	records := []*kinesis.PutRecordsRequestEntry{
+		{Data: []byte("a"), PartitionKey: aws.String("k")},
+		{Data: []byte("b"), PartitionKey: aws.String("k")},
+	}
+	delivered, err := putRecordsToKinesisStream(context.Background(), ks, "DataLog", records, newBackoff(), 3)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true}, delivered)
+	require.Len(t, ks.inputs, 2)
+	require.Equal(t, records[:1], ks.inputs[1].Records)
+}
+
+func TestPutRecordsToFirehoseStreamFailedPutCountWithoutErrorCodes(t *testing.T) {
+	captureLogs(t)
+	withFakeClock(t)
+	fh, _ := withFakeAPIs(t)
+	fh.outputs = []*firehose.PutRecordBatchOutput{
+		{
+			FailedPutCount: aws.Int64(1),
+			RequestResponses: []*firehose.PutRecordBatchResponseEntry{
+				{}, {},
+			},
+		},
+	}
+
+	records := []*firehose.Record{{Data: []byte("a")}, {Data: []byte("b")}}
+	delivered, err := putRecordsToFirehoseStream(context.Background(), fh, "DataLog", records, newBackoff(), 3)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true}, delivered)
+	// There is no telling which of the records failed, so both are resent.
+	require.Len(t, fh.inputs, 2)
+	require.Equal(t, records, fh.inputs[1].Records)
+}
+
+func TestPutRecordsToKinesisStreamFailedRecordCountWithoutErrorCodes(t *testing.T) {
+	logs := captureLogs(t)
+	withFakeClock(t)
+	_, ks := withFakeAPIs(t)
+	ks.outputs = []*kinesis.PutRecordsOutput{
+		{
+			FailedRecordCount: aws.Int64(1),
+			Records:           []*kinesis.PutRecordsResultEntry{{}, {}},
+		},
+	}
+
+	records := []*kinesis.PutRecordsRequestEntry{
+		{Data: []byte("a"), PartitionKey: aws.String("k")},
+		{Data: []byte("b"), PartitionKey: aws.String("k")},
+	}
+	delivered, err := putRecordsToKinesisStream(context.Background(), ks, "DataLog", records, newBackoff(), 3)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true}, delivered)
+	require.Len(t, ks.inputs, 2)
+	require.Equal(t, records, ks.inputs[1].Records)
+	require.Contains(t, logs.String(), "1 records failed without error codes")
+}
+
+func TestPutRecordsResponseCountMismatch(t *testing.T) {
+	t.Run("firehose", func(t *testing.T) {
+		logs := captureLogs(t)
+		fh, _ := withFakeAPIs(t)
+		fh.outputs = []*firehose.PutRecordBatchOutput{
+			{
+				FailedPutCount:   aws.Int64(0),
+				RequestResponses: []*firehose.PutRecordBatchResponseEntry{{}},
+			},
+		}
+
+		records := []*firehose.Record{{Data: []byte("a")}, {Data: []byte("b")}}
+		delivered, err := putRecordsToFirehoseStream(context.Background(), fh, "DataLog", records, newBackoff(), 3)
+		require.NoError(t, err)
+		require.Equal(t, []bool{true, true}, delivered)
+		require.Len(t, fh.inputs, 2)
+		require.Equal(t, records, fh.inputs[1].Records)
+		require.Contains(t, logs.String(), "PutRecordBatch returned 1 responses for 2 records")
+	})
+
+	t.Run("kinesis", func(t *testing.T) {
+		logs := captureLogs(t)
+		_, ks := withFakeAPIs(t)
+		ks.outputs = []*kinesis.PutRecordsOutput{
+			{
+				FailedRecordCount: aws.Int64(0),
+				Records:           []*kinesis.PutRecordsResultEntry{{}, {}, {}},
+			},
+		}
+
+		records := []*kinesis.PutRecordsRequestEntry{
+			{Data: []byte("a"), PartitionKey: aws.String("k")},
+			{Data: []byte("b"), PartitionKey: aws.String("k")},
+		}
+		delivered, err := putRecordsToKinesisStream(context.Background(), ks, "DataLog", records, newBackoff(), 3)
+		require.NoError(t, err)
+		require.Equal(t, []bool{true, true}, delivered)
+		require.Len(t, ks.inputs, 2)
+		require.Equal(t, records, ks.inputs[1].Records)
+		require.Contains(t, logs.String(), "PutRecords returned 3 responses for 2 records")
+	})
+}
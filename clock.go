@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is what the current time is read from and waited on with, so that
+// time dependent behaviour can be tested deterministically with a fake.
+type Clock interface {
+	Now() time.Time
+
+	// Sleep waits for d, or until ctx is done if that comes first, in which
+	// case it returns the context's error.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// clock is the Clock in use. It is swapped out in tests.
+var clock Clock = realClock{}
+
+// realClock is the Clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a Clock whose time only moves when it is advanced or slept
+// on, which it does instantly, or by step every time it is read.
+type fakeClock struct {
+	mu   sync.Mutex
+	now  time.Time
+	step time.Duration
+
+	// slept is every duration slept for, in order.
+	slept []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now
+	c.now = c.now.Add(c.step)
+	return now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	c.slept = append(c.slept, d)
+	return nil
+}
+
+// advance moves the time of the clock on by d.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// withFakeClock replaces the clock with a fake one, set to 2021-05-17
+// 04:01:28 UTC, for the duration of a test.
+func withFakeClock(t *testing.T) *fakeClock {
+	c := &fakeClock{now: time.Unix(1621224088, 0).UTC()}
+
+	orig := clock
+	t.Cleanup(func() {
+		clock = orig
+	})
+	clock = c
+
+	return c
+}
+
+func TestRealClockSleep(t *testing.T) {
+	c := realClock{}
+
+	start := c.Now()
+	require.NoError(t, c.Sleep(context.Background(), time.Millisecond))
+	require.True(t, c.Now().Sub(start) >= time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, c.Sleep(ctx, time.Hour))
+}
+
+func TestFakeClockRetryDelays(t *testing.T) {
+	captureLogs(t)
+	withConfig(t, func(c *Config) {
+		c.RetryBaseDelay = 100 * time.Millisecond
+		c.RetryMaxDelay = time.Second
+		c.RetryJitter = jitterEqual
+	})
+	fh, _ := withFakeAPIs(t)
+	c := withFakeClock(t)
+	for i := 0; i < 5; i++ {
+		fh.errs = append(fh.errs, awserr.New("ThrottlingException", "slow down", nil))
+	}
+
+	b := newBackoff()
+	b.random = func() float64 { return 0 }
+	start := c.Now()
+
+	records := []*firehose.Record{{Data: []byte("a")}}
+	_, err := putRecordsToFirehoseStream(context.Background(), fh, "DataLog", records, b, 10)
+	require.NoError(t, err)
+
+	require.Equal(t, []time.Duration{
+		50 * time.Millisecond,
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		500 * time.Millisecond,
+	}, c.slept)
+	require.Equal(t, 1250*time.Millisecond, c.Now().Sub(start))
+}
+
+func TestFakeClockDlqReplayEvent(t *testing.T) {
+	withFakeClock(t)
+
+	e, err := dlqReplayEvent("arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog", []byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, 1621224088000, e.Records[0].ApproximateArrivalTimestamp)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// cloudTrailDelivery is a CloudTrail log file, as delivered to S3 and from
+// there on to a stream: its events are in a Records array.
+type cloudTrailDelivery struct {
+	Records []json.RawMessage `json:"Records"`
+}
+
+// cloudTrailEvents returns the events of m as log events, when
+// config.SplitCloudTrail is set and m is a CloudTrail log file rather than a
+// CWL message, or false otherwise. Their messages are the events as compact
+// JSON, and their timestamps the events' eventTime, if they have one.
+func cloudTrailEvents(m *Message) ([]LogEvent, bool) {
+	if !config.SplitCloudTrail || m.MessageType != "" {
+		return nil, false
+	}
+
+	d := cloudTrailDelivery{}
+	if err := json.Unmarshal(m.raw, &d); err != nil || d.Records == nil {
+		return nil, false
+	}
+
+	events := make([]LogEvent, 0, len(d.Records))
+	for _, r := range d.Records {
+		b := &bytes.Buffer{}
+		if err := json.Compact(b, r); err != nil {
+			return nil, false
+		}
+		events = append(events, LogEvent{Message: b.String(), Timestamp: cloudTrailEventTime(r)})
+	}
+
+	return events, true
+}
+
+// cloudTrailEventTime returns the eventTime of a CloudTrail event in
+// milliseconds, or 0 if it has none.
+func cloudTrailEventTime(event json.RawMessage) int {
+	e := struct {
+		EventTime string `json:"eventTime"`
+	}{}
+	if err := json.Unmarshal(event, &e); err != nil {
+		return 0
+	}
+
+	t, err := time.Parse(time.RFC3339, e.EventTime)
+	if err != nil {
+		return 0
+	}
+
+	return timeToMilliseconds(t)
+}
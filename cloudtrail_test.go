@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloudTrailEvents(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		raw             string
+		splitCloudTrail bool
+		expected        []LogEvent
+		expectedOk      bool
+	}{
+		{
+			name: "log file",
+			raw: `{"Records": [
+				{"eventTime": "2021-05-17T04:00:44Z", "eventName": "ConsoleLogin", "eventSource": "signin.amazonaws.com"},
+				{"eventName": "PutObject", "eventSource": "s3.amazonaws.com"}
+			]}`,
+			splitCloudTrail: true,
+			expected: []LogEvent{
+				{Message: `{"eventTime":"2021-05-17T04:00:44Z","eventName":"ConsoleLogin","eventSource":"signin.amazonaws.com"}`, Timestamp: 1621224044000},
+				{Message: `{"eventName":"PutObject","eventSource":"s3.amazonaws.com"}`},
+			},
+			expectedOk: true,
+		},
+		{
+			name:            "no records",
+			raw:             `{"Records": []}`,
+			splitCloudTrail: true,
+			expected:        []LogEvent{},
+			expectedOk:      true,
+		},
+		{
+			name:            "not a log file",
+			raw:             `{"level": "info"}`,
+			splitCloudTrail: true,
+		},
+		{
+			name: "disabled",
+			raw:  `{"Records": [{"eventName": "ConsoleLogin"}]}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.SplitCloudTrail = tc.splitCloudTrail
+			})
+
+			events, ok := cloudTrailEvents(&Message{raw: []byte(tc.raw)})
+			require.Equal(t, tc.expectedOk, ok)
+			require.Equal(t, tc.expected, events)
+		})
+	}
+}
+
+func TestTransformRecordsSplitCloudTrail(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.SplitCloudTrail = true
+	})
+
+	gzipped := func(data string) string {
+		b := &bytes.Buffer{}
+		require.NoError(t, gzipCompress(b, []byte(data)))
+		return base64.StdEncoding.EncodeToString(b.Bytes())
+	}
+
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: gzipped(`{"Records":[{"eventName":"ConsoleLogin"},{"eventName":"PutObject"}]}`)},
+			{RecordId: "2", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "a", Message: "from cwl"}},
+			})},
+			{RecordId: "3", Data: gzipped(`{"level":"info"}`)},
+		},
+	}
+
+	resultRecords, _ := transformRecords(e, &Stats{})
+	require.Equal(t, ResultRecordList{
+		{RecordId: "1", Result: resultStatusOk, Data: base64.StdEncoding.EncodeToString([]byte("{\"eventName\":\"ConsoleLogin\"}\n{\"eventName\":\"PutObject\"}\n"))},
+		{RecordId: "2", Result: resultStatusOk, Data: base64.StdEncoding.EncodeToString([]byte("from cwl\n"))},
+		{RecordId: "3", Result: resultStatusFailed},
+	}, resultRecords)
+}
+
+func TestTransformRecordsSplitCloudTrailOutputFormat(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.SplitCloudTrail = true
+		c.OutputFormat = outputFormatHec
+		c.HecSourcetype = "aws:cloudtrail"
+		c.EnrichTags = map[string]string{"env": "prod"}
+	})
+
+	b := &bytes.Buffer{}
+	require.NoError(t, gzipCompress(b, []byte(`{"Records":[{"eventTime":"2021-05-17T04:00:44Z","eventName":"ConsoleLogin"},{"eventName":"PutObject"}]}`)))
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", ApproximateArrivalTimestamp: 1621224132233, Data: base64.StdEncoding.EncodeToString(b.Bytes())},
+		},
+	}
+
+	resultRecords, _ := transformRecords(e, &Stats{})
+	require.Equal(t, resultStatusOk, resultRecords[0].Result)
+	data, err := base64.StdEncoding.DecodeString(resultRecords[0].Data)
+	require.NoError(t, err)
+	require.Equal(t,
+		`{"time":1621224044,"sourcetype":"aws:cloudtrail","event":"{\"eventTime\":\"2021-05-17T04:00:44Z\",\"eventName\":\"ConsoleLogin\"}","fields":{"env":"prod"}}`+"\n"+
+			`{"time":1621224132.233,"sourcetype":"aws:cloudtrail","event":"{\"eventName\":\"PutObject\"}","fields":{"env":"prod"}}`+"\n",
+		string(data),
+	)
+}
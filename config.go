@@ -0,0 +1,789 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings that can be tuned through the Lambda's
+// environment variables. Fields holding secrets must be tagged
+// `secret:"true"` to keep them out of diagnostics, see describeConfig.
+type Config struct {
+	// DecompressionOrder lists the compression formats record data is
+	// tried with, in order, until one of them yields valid JSON: "gzip",
+	// "zlib" or "none". Set with DECOMPRESSION_ORDER, e.g. "gzip,none".
+	DecompressionOrder []string
+
+	// RecordPerLogEvent emits each log event of a DATA_MESSAGE as its own
+	// record instead of joining them into one. Set with RECORD_PER_LOG_EVENT.
+	RecordPerLogEvent bool
+
+	// OutputFormat is the format log events are emitted in: "raw" (the
+	// message as is), "hec" (a Splunk HEC event) or "cwl" (the whole CWL
+	// message re-encoded as compact JSON, one per record). Set with
+	// OUTPUT_FORMAT.
+	OutputFormat string
+
+	// LogGroupFormats overrides OutputFormat for particular log groups. It
+	// maps log group names, or prefixes ending in "*", to output formats.
+	// Besides the OutputFormat formats it supports "json-field" (a single
+	// field of JSON messages, see JsonField), "kv" (the message and its
+	// metadata as key=value pairs), "flow-log" (VPC flow log records as
+	// JSON), "raw-parsed" (a JSON object of the message and its fields as
+	// parsed from JSON, flow log or key=value form, for checking parsing
+	// before relying on it) and "template" (see MessageTemplate). Set with
+	// LOG_GROUP_FORMATS, e.g.
+	// "/aws/lambda/*=json-field,vpc-flow-logs=flow-log".
+	LogGroupFormats map[string]string
+
+	// JsonField is the field the "json-field" format emits. Set with
+	// JSON_FIELD.
+	JsonField string
+
+	// MessageTemplate is the Go text/template the "template" format renders
+	// each log event with. It has the message as .Message, its fields as
+	// .Fields if it is a JSON object, and the log event's metadata, see
+	// templateData. Messages the template fails to render for are emitted
+	// as is. Set with MESSAGE_TEMPLATE, e.g.
+	// "{{.LogGroup}} {{.Fields.level}} {{.Fields.msg}}".
+	MessageTemplate *messageTemplate
+
+	// FlowLogFormat is the custom format of VPC flow log records, as given
+	// when creating the flow log, for the "flow-log" format and transform
+	// step to key their fields by. Without it records are parsed in the
+	// default (version 2) format. Set with FLOW_LOG_FORMAT, e.g.
+	// "${version} ${vpc-id} ${srcaddr} ${dstaddr} ${action}".
+	FlowLogFormat []string
+
+	// HecIncludeAccountId adds the AWS account id that owns the log group to
+	// HEC events as fields.aws_account_id. Set with HEC_INCLUDE_ACCOUNT_ID.
+	HecIncludeAccountId bool
+
+	// HecSourcetype is the sourcetype of HEC events. Set with HEC_SOURCETYPE.
+	HecSourcetype string
+
+	// HecTimePrecision is how precise the time of HEC events, taken from the
+	// timestamp of their log event, is: "milliseconds", as fractional
+	// seconds, or "seconds". Set with HEC_TIME_PRECISION.
+	HecTimePrecision string
+
+	// LogGroupSourcetypes overrides HecSourcetype for particular log groups,
+	// matched like LogGroupFormats. Set with LOG_GROUP_SOURCETYPES, e.g.
+	// "/aws/lambda/*=aws:lambda,vpc-flow-logs=aws:cloudwatchlogs:vpcflow".
+	LogGroupSourcetypes map[string]string
+
+	// LogGroupIndexes routes the HEC events of particular log groups, matched
+	// like LogGroupFormats, to Splunk indexes. Events of other log groups go
+	// to the HEC token's default index. Set with LOG_GROUP_INDEXES, e.g.
+	// "/aws/lambda/*=lambda,/aws/rds/*=database".
+	LogGroupIndexes map[string]string
+
+	// HecRecordFields lists the metadata of the record a log event came in
+	// that is added to its HEC event's fields, for tracing it back: any of
+	// "record_id", "arrival_timestamp" and "partition_key". Set with
+	// HEC_RECORD_FIELDS, e.g. "record_id,arrival_timestamp".
+	HecRecordFields []string
+
+	// EnrichTags are static tags added to every log event emitted, such as
+	// the environment or team, as fields of HEC events and appended as
+	// key=value pairs in other formats. Set with ENRICH_TAGS, e.g.
+	// "env=prod,team=platform".
+	EnrichTags map[string]string
+
+	// RetryJitter is the jitter strategy applied to the backoff between put
+	// retries: "full", "equal" or "decorrelated". Set with RETRY_JITTER.
+	RetryJitter string
+
+	// RetryBaseDelay and RetryMaxDelay bound the backoff between put
+	// retries. Set with RETRY_BASE_DELAY_MS and RETRY_MAX_DELAY_MS.
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// SdkMaxRetries is how many times the AWS SDK itself retries a failed
+	// request to Firehose or Kinesis before the put's own retries take over.
+	// Negative keeps the SDK's default. Set with SDK_MAX_RETRIES.
+	SdkMaxRetries int
+
+	// RetryLogFirst and RetryLogEvery bound the logging of put retries: the
+	// first RetryLogFirst retries of a put are logged, then only every
+	// RetryLogEveryth, with a count of those left out once the put is done.
+	// Set with RETRY_LOG_FIRST and RETRY_LOG_EVERY.
+	RetryLogFirst int
+	RetryLogEvery int
+
+	// DropEmptyRecords marks records without any data, including those whose
+	// data decodes to nothing, as Dropped rather than ProcessingFailed. Set
+	// with DROP_EMPTY_RECORDS.
+	DropEmptyRecords bool
+
+	// MissingData is what to do with records without a data field at all,
+	// as opposed to an empty one: "drop" marks them Dropped, "fail"
+	// ProcessingFailed. Set with MISSING_DATA.
+	MissingData string
+
+	// CombineRecords combines records reingested into Firehose into as few
+	// records as the Firehose record size limit allows, cutting down on the
+	// number of records put. Set with COMBINE_RECORDS.
+	CombineRecords bool
+
+	// ReingestCompress gzips the data of records reingested into either
+	// Firehose or Kinesis that isn't gzipped already, such as JSON passed
+	// through with FORWARD_NON_CWL_JSON. Set with REINGEST_COMPRESS.
+	ReingestCompress bool
+
+	// QuotaRecords and QuotaBytes are the throughput quotas of the stream
+	// records are reingested into, over QuotaWindow. A warning is logged once
+	// QuotaWarnRatio of either is used. Zero quotas are not tracked. Set with
+	// QUOTA_RECORDS, QUOTA_BYTES, QUOTA_WINDOW_MS and QUOTA_WARN_RATIO.
+	QuotaRecords   int
+	QuotaBytes     int
+	QuotaWindow    time.Duration
+	QuotaWarnRatio float64
+
+	// StripAnsi removes ANSI escape sequences, such as terminal colors, from
+	// log event messages. Set with STRIP_ANSI.
+	StripAnsi bool
+
+	// TransformPipeline is the ordered list of steps log event messages are
+	// transformed with: "filter-patterns" (see IncludePattern), "min-level"
+	// (see MinMessageLevel), "drop-substrings", "mask-fields", "redact" (see
+	// RedactPatterns), "strip-ansi", "collapse-whitespace", "json-field"
+	// (see JsonField, failing for messages without it) and "flow-log" (VPC
+	// flow log records as JSON, see FlowLogFormat, e.g. for HEC events of
+	// them). When set, it replaces the steps otherwise enabled by
+	// IncludePattern, ExcludePattern, MinMessageLevel, RedactPatterns,
+	// RedactRules, StripAnsi and CollapseWhitespace, but for "redact", which
+	// is run last if it is left out while redaction is configured. A failing
+	// step fails the log event's record. Set with TRANSFORM_PIPELINE, e.g.
+	// "strip-ansi,mask-fields,json-field".
+	TransformPipeline []string
+
+	// TransformChain is the chain of the steps of the transform pipeline,
+	// see TransformPipeline, built once as config loads.
+	TransformChain *transformChain
+
+	// DropSubstrings drops log events whose message contains any of them,
+	// to keep synthetic lines such as health checks out of Splunk. Set with
+	// DROP_SUBSTRINGS, e.g. "ELB-HealthChecker/2.0,GET /healthz".
+	DropSubstrings []string
+
+	// IncludePattern and ExcludePattern drop log events whose message
+	// doesn't match IncludePattern, or does match ExcludePattern, before any
+	// other transformation, e.g. to keep load balancer probes out of Splunk.
+	// Set with INCLUDE_PATTERN and EXCLUDE_PATTERN.
+	IncludePattern *regexp.Regexp
+	ExcludePattern *regexp.Regexp
+
+	// MinMessageLevel drops log events that are JSON with a
+	// MessageLevelField level below it: one of "trace", "debug", "info",
+	// "warn", "error" or "fatal", or a synonym such as "warning" or
+	// "critical", in any case. Log events that aren't JSON, have no level or
+	// an unknown one are kept. Set with MIN_MESSAGE_LEVEL and
+	// MESSAGE_LEVEL_FIELD, e.g. "severity".
+	MinMessageLevel   string
+	MessageLevelField string
+
+	// SampleRate is the share of log events kept, between 0 and 1, to get
+	// representative data of log groups too chatty to index in full.
+	// LogGroupSampleRates overrides it for particular log groups, matched
+	// like LogGroupFormats. Set with SAMPLE_RATE and LOG_GROUP_SAMPLE_RATES,
+	// e.g. "/aws/lambda/chatty-*=0.1".
+	SampleRate          float64
+	LogGroupSampleRates map[string]float64
+
+	// LogGroupSamplePatterns are the log group patterns of
+	// LogGroupSampleRates, keyed by themselves for matchLogGroup, built once
+	// as config loads.
+	LogGroupSamplePatterns map[string]string
+
+	// MaskFields lists the fields of JSON messages whose values are replaced
+	// with MaskToken, as dot separated paths such as "user.email". Set with
+	// MASK_FIELDS and MASK_TOKEN.
+	MaskFields []string
+	MaskToken  string
+
+	// RedactPatterns are the built-in patterns whose matches anywhere in log
+	// event messages are replaced with MaskToken: "email", "credit-card"
+	// (numbers passing the Luhn check), "ssn", "ipv4", "ipv6" and
+	// "aws-access-key". RedactRules are patterns of your own, applied after
+	// them in order, as a JSON array of {"pattern": ..., "replacement": ...}
+	// objects. Set with REDACT_PATTERNS and REDACT_RULES.
+	RedactPatterns []string
+	RedactRules    []redactRule
+
+	// CollapseWhitespace replaces runs of spaces and tabs in log event
+	// messages with a single space, preserving line breaks. Set with
+	// COLLAPSE_WHITESPACE.
+	CollapseWhitespace bool
+
+	// TransformDlqStream is the name of a Firehose delivery stream that the
+	// original data of records failing transformation or reingestion is
+	// forwarded to, to reprocess them with dlqReplayEvent. Set with
+	// TRANSFORM_DLQ_STREAM.
+	TransformDlqStream string
+
+	// TransformDlqEnvelope wraps each record forwarded to the transform DLQ
+	// in a JSON envelope with why it failed, rather than forwarding its
+	// original data as is. Set with TRANSFORM_DLQ_ENVELOPE.
+	TransformDlqEnvelope bool
+
+	// DedupLogEvents is how many of the log event ids last returned to
+	// Firehose are remembered, so log events of retried or replayed records
+	// are dropped rather than sent on twice. 0 turns deduplication off. Set
+	// with DEDUP_LOG_EVENTS.
+	DedupLogEvents int
+
+	// PutFailure is what to do when records can't be reingested: "error"
+	// fails the invocation, so Firehose retries transforming the whole
+	// event, and "mark-failed" marks just the records they came from
+	// ProcessingFailed. Firehose only writes those to its processing-failed
+	// output, so "mark-failed" should be paired with TransformDlqStream to
+	// reprocess them. Set with PUT_FAILURE.
+	PutFailure string
+
+	// CircuitBreakerThreshold is the number of batches in a row that may fail
+	// to be reingested before the rest are given up on without trying. Set
+	// with CIRCUIT_BREAKER_THRESHOLD.
+	CircuitBreakerThreshold int
+
+	// StreamBatchSizes and StreamMaxAttempts override, for the streams they
+	// name, the number of records put at a time (500 otherwise, which is
+	// also the most allowed) and the number of attempts a put gets (20
+	// otherwise), for streams with less capacity than others. Set with
+	// STREAM_BATCH_SIZES and STREAM_MAX_ATTEMPTS, e.g. "DataLog=100".
+	StreamBatchSizes  map[string]int
+	StreamMaxAttempts map[string]int
+
+	// ReingestDelay is how long to wait before putting the first batch of
+	// records to be reingested, so as not to add to the load of a stream
+	// that has just been throttled. Set in milliseconds with
+	// REINGEST_DELAY_MS.
+	ReingestDelay time.Duration
+
+	// DeadlineMargin is how long before the Lambda's deadline transforming
+	// and reingesting records is given up on, to leave time to return what
+	// was done. Records not transformed by then are marked ProcessingFailed.
+	// It is at most half of the time the invocation has left when it starts,
+	// so short timeouts still leave time to work in. Zero runs right up to
+	// the deadline. Set in milliseconds with DEADLINE_MARGIN_MS.
+	DeadlineMargin time.Duration
+
+	// ReingestData is what is reingested for records taken out of a response
+	// that is too large for Firehose: "original" reingests their original
+	// data, to be transformed again when it comes back, and "transformed"
+	// the data they were transformed into, to be passed through but for
+	// redaction. Transformed data is only accepted with "transformed", so
+	// producers can't use it to skip the transform pipeline otherwise.
+	// Records split off, or over MaxResultBytes, are always reingested
+	// untransformed. Set with REINGEST_DATA.
+	ReingestData string
+
+	// OversizeRecord is what to do with a record whose transformed data is
+	// too large for a response even on its own: "reingest" splits it into
+	// records that aren't and reingests those, "fail" marks it
+	// ProcessingFailed. Set with OVERSIZE_RECORD.
+	OversizeRecord string
+
+	// Sink is where records go: "aws" reingests them into the source stream
+	// as usual, while "stdout" prints them, along with the records returned
+	// to Firehose, for debugging locally. Set with SINK.
+	Sink string
+
+	// IncludeOrderingIndex tags each emitted log event with the index of the
+	// record it came in and its index within that record, to help track
+	// down ordering problems and lost events. HEC events get them as
+	// fields; other formats are prefixed with them. Set with
+	// INCLUDE_ORDERING_INDEX.
+	IncludeOrderingIndex bool
+
+	// SortLogEvents sorts the log events of each record by their timestamp
+	// before they are transformed, for sources that rely on the order of
+	// their lines in Splunk. The ordering index is then that of the sorted
+	// log events. Set with SORT_LOG_EVENTS.
+	SortLogEvents bool
+
+	// MultilineStartPattern matches the first line of a multi-line log
+	// event. Log events it doesn't match are joined on to the one before
+	// them within a record, so stack traces and the like reach Splunk as one
+	// event. It is applied after SortLogEvents. Set with
+	// MULTILINE_START_PATTERN, e.g. "^\d{4}-\d{2}-\d{2}" for lines
+	// starting with a date.
+	MultilineStartPattern *regexp.Regexp
+
+	// MaxLastSeenStreams caps the number of log streams the latest log event
+	// timestamp is logged for per invocation, for staleness alerts. 0, the
+	// default, doesn't log any. Set with MAX_LAST_SEEN_STREAMS.
+	MaxLastSeenStreams int
+
+	// CountUniqueSources emits the number of distinct log groups and log
+	// streams seen per invocation, counting up to MaxUniqueSources of each.
+	// Set with COUNT_UNIQUE_SOURCES and MAX_UNIQUE_SOURCES.
+	CountUniqueSources bool
+	MaxUniqueSources   int
+
+	// EmitMemoryMetrics emits the heap in use at the end of every
+	// invocation, to catch memory creeping up in warm containers. It is
+	// meant for debugging, as reading it briefly stops everything else.
+	// Set with EMIT_MEMORY_METRICS.
+	EmitMemoryMetrics bool
+
+	// EmitRecordLatency emits a histogram of how long records took to
+	// transform, to spot pathological ones. Set with EMIT_RECORD_LATENCY.
+	EmitRecordLatency bool
+
+	// ControlMessageHeartbeat logs and counts the CONTROL_MESSAGEs CloudWatch
+	// Logs sends to check subscriptions, which are dropped either way, as
+	// proof that the subscription is alive. Set with
+	// CONTROL_MESSAGE_HEARTBEAT.
+	ControlMessageHeartbeat bool
+
+	// MetricsFormat is how the metrics of every invocation are emitted:
+	// "log" as a log line each, "emf" as a single CloudWatch Embedded Metric
+	// Format line, which CloudWatch turns into metrics by itself, in the
+	// EmfNamespace namespace with the EmfDimensions dimensions. Set with
+	// METRICS_FORMAT, EMF_NAMESPACE and EMF_DIMENSIONS, e.g. "env=prod".
+	MetricsFormat string
+	EmfNamespace  string
+	EmfDimensions map[string]string
+
+	// LogLevel is the least severe level logged: "debug", "info", "warn" or
+	// "error". Metrics are logged whatever the level. Set with LOG_LEVEL.
+	LogLevel string
+
+	// LogFormat is the format of log lines: "text", or "json" for objects
+	// with the level, correlation id, delivery stream and record count of the
+	// invocation along with the message. Set with LOG_FORMAT.
+	LogFormat string
+
+	// TimestampPrefix prefixes each log event emitted in a format other than
+	// "hec" with its timestamp in UTC, formatted with the Go layout
+	// TimestampLayout, which defaults to ISO-8601 with milliseconds. Set
+	// with TIMESTAMP_PREFIX and TIMESTAMP_LAYOUT.
+	TimestampPrefix bool
+	TimestampLayout string
+
+	// ForwardNonCwlJson passes JSON without a messageType on as an event of
+	// its own, compacted to a line and formatted like log events, see
+	// OutputFormat, rather than marking its record ProcessingFailed, for
+	// streams that mix CWL messages with JSON written to them directly. Set
+	// with FORWARD_NON_CWL_JSON.
+	ForwardNonCwlJson bool
+
+	// SplitCloudTrail turns JSON without a messageType that is a CloudTrail
+	// log file, with its events in a Records array, into one event per line,
+	// formatted like log events, see OutputFormat, at their eventTime,
+	// rather than marking its record ProcessingFailed or, with
+	// ForwardNonCwlJson, passing the whole file on as a single line. Set
+	// with SPLIT_CLOUDTRAIL.
+	SplitCloudTrail bool
+
+	// MaxLogEventsPerRecord caps the number of log events processed per
+	// record, so a record with a huge number of them can't hog an
+	// invocation. LogEventsOverCap says what becomes of the rest: "drop"
+	// drops them, logging how many, and "reingest" reingests them as a
+	// message of their own to be processed later. Zero means no cap. Set
+	// with MAX_LOG_EVENTS_PER_RECORD and LOG_EVENTS_OVER_CAP.
+	MaxLogEventsPerRecord int
+	LogEventsOverCap      string
+
+	// JsonArrayMessages accepts records holding a JSON array of messages,
+	// as some producers send, and processes each element as a message of
+	// its own. Set with JSON_ARRAY_MESSAGES.
+	JsonArrayMessages bool
+
+	// MaxDecompressedBytes bounds the memory used by an invocation. Once the
+	// records of an event decompress to more than this many bytes, the rest
+	// of its records are reingested untransformed, to be transformed by a
+	// later invocation, and marked Dropped. Zero means no limit. Set with
+	// MAX_DECOMPRESSED_BYTES.
+	MaxDecompressedBytes int
+
+	// MaxInputBytes bounds the size of the events processed. Only the
+	// records of an event that fit within this many bytes of (base64
+	// encoded) data, from the start, are processed; the rest are reingested
+	// untransformed, to be transformed by a later invocation, and marked
+	// Dropped. Zero means no limit. Set with MAX_INPUT_BYTES.
+	MaxInputBytes int
+
+	// MaxResultBytes bounds the transformed data an invocation holds in
+	// memory. Once its results grow past this many bytes, the rest of its
+	// records are reingested untransformed, to be transformed by a later
+	// invocation, and marked Dropped. Zero means no limit. Set with
+	// MAX_RESULT_BYTES.
+	MaxResultBytes int
+
+	// MaxResponseBytes is the most a response may be, 6291456 bytes for
+	// synchronous Lambda invocations. Records are reingested rather than
+	// returned to keep their size within it less HeadroomBytes, which is
+	// left for the JSON around them. Set with MAX_RESPONSE_BYTES and
+	// HEADROOM_BYTES.
+	MaxResponseBytes int
+	HeadroomBytes    int
+
+	// PartitionKeyField and PartitionKeyPattern derive the partition key of
+	// log events split off for reingestion into Kinesis from their message,
+	// rather than reusing the key of the record they came in. The field is
+	// looked up in JSON messages; otherwise the first capture group of the
+	// pattern, or its whole match, is used. Messages yielding neither keep
+	// the original key. Set with PARTITION_KEY_FIELD and
+	// PARTITION_KEY_PATTERN.
+	PartitionKeyField   string
+	PartitionKeyPattern *regexp.Regexp
+
+	// MissingPartitionKey is what to do with records of a Kinesis stream
+	// event that lack kinesisRecordMetadata: "fail" marks them
+	// ProcessingFailed, "record-id" uses their record id as partition key
+	// instead. Set with MISSING_PARTITION_KEY.
+	MissingPartitionKey string
+
+	// LongPartitionKey is what to do with partition keys over the 256
+	// characters Kinesis accepts before putting records on to a Kinesis
+	// stream: "hash" replaces them with their hex encoded SHA-256, keeping
+	// distinct keys distinct, "truncate" cuts them down to 256 characters.
+	// Set with LONG_PARTITION_KEY.
+	LongPartitionKey string
+
+	// CostPerGb and CostPerRecord are the Firehose prices used to estimate
+	// the cost of ingesting each invocation's records, which is emitted as
+	// the EstimatedCost metric. Set with COST_PER_GB and COST_PER_RECORD.
+	CostPerGb     float64
+	CostPerRecord float64
+
+	// GzipResponse gzips the data of transformed records in the response,
+	// shrinking very large responses, and marks them with a
+	// "contentEncoding" partition key of "gzip". Only for destinations that
+	// accept gzipped data. Set with GZIP_RESPONSE.
+	GzipResponse bool
+
+	// RecordHeader is prepended to the data of every record returned to
+	// Firehose, on a line of its own, for setups that pass metadata such as
+	// a HEC token or index marker along that way. Set with RECORD_HEADER.
+	RecordHeader string `secret:"true"`
+
+	// TrailingNewline ends the data of every record returned to Firehose
+	// with a newline, whatever the output format. Without it the log events
+	// of a record are still separated by newlines, but there is none after
+	// the last of them. Set with TRAILING_NEWLINE.
+	TrailingNewline bool
+
+	// MetricMessagePattern picks out log event messages that are metrics,
+	// which are sent as Splunk statsd metric lines rather than in the output
+	// format. It must have "name" and "value" named groups, and is matched
+	// against the whole message. Set with METRIC_MESSAGE_PATTERN.
+	MetricMessagePattern *regexp.Regexp
+}
+
+var config Config
+
+// config is loaded in init rather than where it is declared, as loading it
+// logs, and logging depends on it.
+func init() {
+	config = loadConfig()
+}
+
+// loadConfig reads the Config from the environment, falling back to the
+// defaults for anything unset or unparsable.
+func loadConfig() Config {
+	c := Config{
+		DecompressionOrder:      envListDefault("DECOMPRESSION_ORDER", []string{compressionGzip}),
+		RecordPerLogEvent:       envBool("RECORD_PER_LOG_EVENT", false),
+		OutputFormat:            envString("OUTPUT_FORMAT", outputFormatRaw),
+		LogGroupFormats:         envMap("LOG_GROUP_FORMATS"),
+		JsonField:               envString("JSON_FIELD", "message"),
+		MessageTemplate:         envTemplate("MESSAGE_TEMPLATE"),
+		FlowLogFormat:           envFlowLogFormat("FLOW_LOG_FORMAT"),
+		HecIncludeAccountId:     envBool("HEC_INCLUDE_ACCOUNT_ID", false),
+		HecSourcetype:           envString("HEC_SOURCETYPE", "aws:cloudwatchlogs"),
+		HecTimePrecision:        envString("HEC_TIME_PRECISION", hecTimePrecisionMilliseconds),
+		LogGroupSourcetypes:     envMap("LOG_GROUP_SOURCETYPES"),
+		LogGroupIndexes:         envMap("LOG_GROUP_INDEXES"),
+		HecRecordFields:         envList("HEC_RECORD_FIELDS"),
+		EnrichTags:              envMap("ENRICH_TAGS"),
+		RetryJitter:             envString("RETRY_JITTER", jitterFull),
+		RetryBaseDelay:          envMilliseconds("RETRY_BASE_DELAY_MS", 100*time.Millisecond),
+		RetryMaxDelay:           envMilliseconds("RETRY_MAX_DELAY_MS", 5*time.Second),
+		SdkMaxRetries:           envInt("SDK_MAX_RETRIES", -1),
+		RetryLogFirst:           envInt("RETRY_LOG_FIRST", 3),
+		RetryLogEvery:           envInt("RETRY_LOG_EVERY", 5),
+		DropEmptyRecords:        envBool("DROP_EMPTY_RECORDS", true),
+		MissingData:             envString("MISSING_DATA", missingDataDrop),
+		CombineRecords:          envBool("COMBINE_RECORDS", false),
+		ReingestCompress:        envBool("REINGEST_COMPRESS", false),
+		QuotaRecords:            envInt("QUOTA_RECORDS", 0),
+		QuotaBytes:              envInt("QUOTA_BYTES", 0),
+		QuotaWindow:             envMilliseconds("QUOTA_WINDOW_MS", time.Second),
+		QuotaWarnRatio:          envFloat("QUOTA_WARN_RATIO", 0.8),
+		StripAnsi:               envBool("STRIP_ANSI", false),
+		TransformPipeline:       envList("TRANSFORM_PIPELINE"),
+		DropSubstrings:          envList("DROP_SUBSTRINGS"),
+		IncludePattern:          envRegexp("INCLUDE_PATTERN"),
+		ExcludePattern:          envRegexp("EXCLUDE_PATTERN"),
+		MinMessageLevel:         envString("MIN_MESSAGE_LEVEL", ""),
+		MessageLevelField:       envString("MESSAGE_LEVEL_FIELD", "level"),
+		SampleRate:              envFloat("SAMPLE_RATE", 1),
+		LogGroupSampleRates:     envFloatMap("LOG_GROUP_SAMPLE_RATES"),
+		MaskFields:              envList("MASK_FIELDS"),
+		MaskToken:               envString("MASK_TOKEN", "****"),
+		RedactPatterns:          envRedactPatterns("REDACT_PATTERNS"),
+		RedactRules:             envRedactRules("REDACT_RULES"),
+		CollapseWhitespace:      envBool("COLLAPSE_WHITESPACE", false),
+		TransformDlqStream:      envString("TRANSFORM_DLQ_STREAM", ""),
+		TransformDlqEnvelope:    envBool("TRANSFORM_DLQ_ENVELOPE", false),
+		DedupLogEvents:          envInt("DEDUP_LOG_EVENTS", 0),
+		PutFailure:              envString("PUT_FAILURE", putFailureError),
+		CircuitBreakerThreshold: envInt("CIRCUIT_BREAKER_THRESHOLD", 1),
+		StreamBatchSizes:        envIntMap("STREAM_BATCH_SIZES"),
+		StreamMaxAttempts:       envIntMap("STREAM_MAX_ATTEMPTS"),
+		ReingestDelay:           envMilliseconds("REINGEST_DELAY_MS", 0),
+		DeadlineMargin:          envMilliseconds("DEADLINE_MARGIN_MS", 300*time.Millisecond),
+		ReingestData:            envString("REINGEST_DATA", reingestDataOriginal),
+		OversizeRecord:          envString("OVERSIZE_RECORD", oversizeRecordReingest),
+		Sink:                    envString("SINK", sinkAws),
+		IncludeOrderingIndex:    envBool("INCLUDE_ORDERING_INDEX", false),
+		SortLogEvents:           envBool("SORT_LOG_EVENTS", false),
+		MultilineStartPattern:   envRegexp("MULTILINE_START_PATTERN"),
+		MaxLastSeenStreams:      envInt("MAX_LAST_SEEN_STREAMS", 0),
+		CountUniqueSources:      envBool("COUNT_UNIQUE_SOURCES", false),
+		MaxUniqueSources:        envInt("MAX_UNIQUE_SOURCES", 1000),
+		EmitMemoryMetrics:       envBool("EMIT_MEMORY_METRICS", false),
+		EmitRecordLatency:       envBool("EMIT_RECORD_LATENCY", false),
+		ControlMessageHeartbeat: envBool("CONTROL_MESSAGE_HEARTBEAT", false),
+		MetricsFormat:           envString("METRICS_FORMAT", metricsFormatLog),
+		LogLevel:                envString("LOG_LEVEL", logLevelInfo),
+		LogFormat:               envString("LOG_FORMAT", logFormatText),
+		EmfNamespace:            envString("EMF_NAMESPACE", "FirehoseSplunkLambda"),
+		EmfDimensions:           envMap("EMF_DIMENSIONS"),
+		TimestampPrefix:         envBool("TIMESTAMP_PREFIX", false),
+		TimestampLayout:         envString("TIMESTAMP_LAYOUT", iso8601Milliseconds),
+		ForwardNonCwlJson:       envBool("FORWARD_NON_CWL_JSON", false),
+		SplitCloudTrail:         envBool("SPLIT_CLOUDTRAIL", false),
+		MaxLogEventsPerRecord:   envInt("MAX_LOG_EVENTS_PER_RECORD", 0),
+		LogEventsOverCap:        envString("LOG_EVENTS_OVER_CAP", logEventsOverCapDrop),
+		JsonArrayMessages:       envBool("JSON_ARRAY_MESSAGES", false),
+		MaxDecompressedBytes:    envInt("MAX_DECOMPRESSED_BYTES", 0),
+		MaxInputBytes:           envInt("MAX_INPUT_BYTES", 0),
+		MaxResultBytes:          envInt("MAX_RESULT_BYTES", 0),
+		MaxResponseBytes:        envInt("MAX_RESPONSE_BYTES", 6291456),
+		HeadroomBytes:           envInt("HEADROOM_BYTES", 291456),
+		PartitionKeyField:       envString("PARTITION_KEY_FIELD", ""),
+		PartitionKeyPattern:     envRegexp("PARTITION_KEY_PATTERN"),
+		MissingPartitionKey:     envString("MISSING_PARTITION_KEY", missingPartitionKeyFail),
+		LongPartitionKey:        envString("LONG_PARTITION_KEY", longPartitionKeyHash),
+		CostPerGb:               envFloat("COST_PER_GB", 0.029),
+		CostPerRecord:           envFloat("COST_PER_RECORD", 0),
+		GzipResponse:            envBool("GZIP_RESPONSE", false),
+		RecordHeader:            envString("RECORD_HEADER", ""),
+		TrailingNewline:         envBool("TRAILING_NEWLINE", true),
+		MetricMessagePattern:    envRegexp("METRIC_MESSAGE_PATTERN"),
+	}
+
+	if (len(c.RedactPatterns) > 0 || len(c.RedactRules) > 0) &&
+		len(c.TransformPipeline) > 0 && !hasStep(c.TransformPipeline, transformStepRedact) {
+		warnf("TRANSFORM_PIPELINE has no %s step, running it last as redaction is configured\n", transformStepRedact)
+	}
+	c.loadDerived()
+
+	return c
+}
+
+// loadDerived sets the fields of c that are built from its other fields once,
+// rather than for every log event.
+func (c *Config) loadDerived() {
+	c.TransformChain = loadTransformChain(c)
+	c.LogGroupSamplePatterns = samplePatterns(c.LogGroupSampleRates)
+}
+
+func envString(key string, defaultValue string) string {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return defaultValue
+	}
+
+	return v
+}
+
+// envMap parses a comma separated list of key=value pairs.
+func envMap(key string) map[string]string {
+	m := map[string]string{}
+
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return m
+	}
+
+	for _, pair := range strings.Split(v, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			warnf("Invalid pair %q in %s, ignoring it\n", pair, key)
+			continue
+		}
+
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return m
+}
+
+// envIntMap parses a comma separated list of key=value pairs with integer
+// values.
+func envIntMap(key string) map[string]int {
+	m := map[string]int{}
+	for k, v := range envMap(key) {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			warnf("Invalid value %q for %s in %s, ignoring it\n", v, k, key)
+			continue
+		}
+
+		m[k] = i
+	}
+
+	return m
+}
+
+// envFloatMap parses a comma separated list of key=value pairs with float
+// values.
+func envFloatMap(key string) map[string]float64 {
+	m := map[string]float64{}
+	for k, v := range envMap(key) {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			warnf("Invalid value %q for %s in %s, ignoring it\n", v, k, key)
+			continue
+		}
+
+		m[k] = f
+	}
+
+	return m
+}
+
+// envRedactPatterns parses a comma separated list of built-in redaction
+// pattern names, leaving out unknown ones.
+func envRedactPatterns(key string) []string {
+	names := []string{}
+	for _, name := range envList(key) {
+		if _, ok := redactPatterns[name]; !ok {
+			warnf("Unknown redaction pattern %q in %s, ignoring it\n", name, key)
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// envRedactRules parses a JSON array of redaction rules. If any of them is
+// invalid, none of them are used.
+func envRedactRules(key string) []redactRule {
+	rules := []redactRule{}
+
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return rules
+	}
+
+	if err := json.Unmarshal([]byte(v), &rules); err != nil {
+		errorf("Invalid value for %s, ignoring it. %s\n", key, err)
+		return []redactRule{}
+	}
+
+	return rules
+}
+
+// envList parses a comma separated list.
+func envList(key string) []string {
+	return envListDefault(key, []string{})
+}
+
+// envListDefault parses a comma separated list, falling back to defaultValue
+// if it is unset or empty.
+func envListDefault(key string, defaultValue []string) []string {
+	l := []string{}
+
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return defaultValue
+	}
+
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			l = append(l, item)
+		}
+	}
+	if len(l) == 0 {
+		return defaultValue
+	}
+
+	return l
+}
+
+func envInt(key string, defaultValue int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		warnf("Invalid value %q for %s, using default %d\n", v, key, defaultValue)
+		return defaultValue
+	}
+
+	return i
+}
+
+func envFloat(key string, defaultValue float64) float64 {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return defaultValue
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		warnf("Invalid value %q for %s, using default %g\n", v, key, defaultValue)
+		return defaultValue
+	}
+
+	return f
+}
+
+// envRegexp compiles a regular expression, returning nil if there is none
+// or it is invalid.
+func envRegexp(key string) *regexp.Regexp {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(v)
+	if err != nil {
+		warnf("Invalid value %q for %s, ignoring it. %s\n", v, key, err)
+		return nil
+	}
+
+	return re
+}
+
+func envMilliseconds(key string, defaultValue time.Duration) time.Duration {
+	return time.Duration(envInt(key, int(defaultValue/time.Millisecond))) * time.Millisecond
+}
+
+func envBool(key string, defaultValue bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		warnf("Invalid value %q for %s, using default %t\n", v, key, defaultValue)
+		return defaultValue
+	}
+
+	return b
+}
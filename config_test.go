@@ -0,0 +1,460 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// withConfig overrides the package config for the duration of a test.
+func withConfig(t *testing.T, f func(c *Config)) {
+	orig := config
+	t.Cleanup(func() {
+		config = orig
+	})
+	f(&config)
+	// Tests change the settings derived fields are built from as they see
+	// fit.
+	config.loadDerived()
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("DECOMPRESSION_ORDER", "zlib, gzip,none")
+	t.Setenv("RECORD_PER_LOG_EVENT", "true")
+	t.Setenv("OUTPUT_FORMAT", "hec")
+	t.Setenv("LOG_GROUP_FORMATS", "/aws/lambda/*=json-field, DataLog=flow-log")
+	t.Setenv("JSON_FIELD", "msg")
+	t.Setenv("MESSAGE_TEMPLATE", "{{.LogGroup}} {{.Message}}")
+	t.Setenv("FLOW_LOG_FORMAT", "${version} ${vpc-id} ${srcaddr}")
+	t.Setenv("HEC_INCLUDE_ACCOUNT_ID", "true")
+	t.Setenv("HEC_SOURCETYPE", "aws:lambda")
+	t.Setenv("HEC_TIME_PRECISION", "seconds")
+	t.Setenv("LOG_GROUP_SOURCETYPES", "/aws/lambda/*=aws:lambda, DataLog=aws:vpcflow")
+	t.Setenv("LOG_GROUP_INDEXES", "/aws/rds/*=database")
+	t.Setenv("HEC_RECORD_FIELDS", "record_id,partition_key")
+	t.Setenv("ENRICH_TAGS", "env=prod,team=platform")
+	t.Setenv("RETRY_JITTER", "decorrelated")
+	t.Setenv("RETRY_BASE_DELAY_MS", "50")
+	t.Setenv("RETRY_MAX_DELAY_MS", "2000")
+	t.Setenv("SDK_MAX_RETRIES", "0")
+	t.Setenv("RETRY_LOG_FIRST", "1")
+	t.Setenv("RETRY_LOG_EVERY", "100")
+	t.Setenv("DROP_EMPTY_RECORDS", "false")
+	t.Setenv("MISSING_DATA", "fail")
+	t.Setenv("COMBINE_RECORDS", "true")
+	t.Setenv("REINGEST_COMPRESS", "true")
+	t.Setenv("QUOTA_RECORDS", "5000")
+	t.Setenv("QUOTA_BYTES", "5242880")
+	t.Setenv("QUOTA_WINDOW_MS", "2000")
+	t.Setenv("QUOTA_WARN_RATIO", "0.9")
+	t.Setenv("STRIP_ANSI", "true")
+	t.Setenv("TRANSFORM_PIPELINE", "strip-ansi,json-field")
+	t.Setenv("DROP_SUBSTRINGS", "ELB-HealthChecker/2.0, GET /healthz")
+	t.Setenv("INCLUDE_PATTERN", `^\{`)
+	t.Setenv("EXCLUDE_PATTERN", `ELB-HealthChecker|GET /healthz`)
+	t.Setenv("MIN_MESSAGE_LEVEL", "info")
+	t.Setenv("MULTILINE_START_PATTERN", `^\d{4}-\d{2}-\d{2}`)
+	t.Setenv("REDACT_PATTERNS", "email, ssn")
+	t.Setenv("REDACT_RULES", `[{"pattern": "acct-(\\d+)", "replacement": "acct-****"}]`)
+	t.Setenv("MESSAGE_LEVEL_FIELD", "severity")
+	t.Setenv("SAMPLE_RATE", "0.5")
+	t.Setenv("LOG_GROUP_SAMPLE_RATES", "/aws/lambda/chatty-*=0.1")
+	t.Setenv("MASK_FIELDS", "user.email,password")
+	t.Setenv("MASK_TOKEN", "[masked]")
+	t.Setenv("COLLAPSE_WHITESPACE", "true")
+	t.Setenv("TRANSFORM_DLQ_STREAM", "TransformDLQ")
+	t.Setenv("TRANSFORM_DLQ_ENVELOPE", "true")
+	t.Setenv("DEDUP_LOG_EVENTS", "10000")
+	t.Setenv("PUT_FAILURE", "mark-failed")
+	t.Setenv("CIRCUIT_BREAKER_THRESHOLD", "3")
+	t.Setenv("STREAM_BATCH_SIZES", "DataLog=100")
+	t.Setenv("STREAM_MAX_ATTEMPTS", "DataLog=5,Other=10")
+	t.Setenv("REINGEST_DELAY_MS", "250")
+	t.Setenv("DEADLINE_MARGIN_MS", "1000")
+	t.Setenv("REINGEST_DATA", "transformed")
+	t.Setenv("OVERSIZE_RECORD", "fail")
+	t.Setenv("SINK", "stdout")
+	t.Setenv("INCLUDE_ORDERING_INDEX", "true")
+	t.Setenv("SORT_LOG_EVENTS", "true")
+	t.Setenv("MAX_LAST_SEEN_STREAMS", "10")
+	t.Setenv("COUNT_UNIQUE_SOURCES", "true")
+	t.Setenv("MAX_UNIQUE_SOURCES", "50")
+	t.Setenv("EMIT_MEMORY_METRICS", "true")
+	t.Setenv("EMIT_RECORD_LATENCY", "true")
+	t.Setenv("CONTROL_MESSAGE_HEARTBEAT", "true")
+	t.Setenv("METRICS_FORMAT", "emf")
+	t.Setenv("LOG_LEVEL", "warn")
+	t.Setenv("LOG_FORMAT", "json")
+	t.Setenv("EMF_NAMESPACE", "Logs")
+	t.Setenv("EMF_DIMENSIONS", "env=prod")
+	t.Setenv("TIMESTAMP_PREFIX", "true")
+	t.Setenv("TIMESTAMP_LAYOUT", time.RFC1123)
+	t.Setenv("FORWARD_NON_CWL_JSON", "true")
+	t.Setenv("SPLIT_CLOUDTRAIL", "true")
+	t.Setenv("MAX_LOG_EVENTS_PER_RECORD", "1000")
+	t.Setenv("LOG_EVENTS_OVER_CAP", "reingest")
+	t.Setenv("JSON_ARRAY_MESSAGES", "true")
+	t.Setenv("MAX_DECOMPRESSED_BYTES", "268435456")
+	t.Setenv("MAX_INPUT_BYTES", "4194304")
+	t.Setenv("MAX_RESULT_BYTES", "4194304")
+	t.Setenv("MAX_RESPONSE_BYTES", "5000000")
+	t.Setenv("HEADROOM_BYTES", "100000")
+	t.Setenv("PARTITION_KEY_FIELD", "user_id")
+	t.Setenv("PARTITION_KEY_PATTERN", `user=(\w+)`)
+	t.Setenv("MISSING_PARTITION_KEY", "record-id")
+	t.Setenv("LONG_PARTITION_KEY", "truncate")
+	t.Setenv("COST_PER_GB", "0.035")
+	t.Setenv("COST_PER_RECORD", "0.0001")
+	t.Setenv("GZIP_RESPONSE", "true")
+	t.Setenv("RECORD_HEADER", "index=main")
+	t.Setenv("TRAILING_NEWLINE", "false")
+	t.Setenv("METRIC_MESSAGE_PATTERN", `(?P<name>\w+)=(?P<value>\d+)`)
+
+	c := loadConfig()
+	require.Equal(t, []string{compressionZlib, compressionGzip, compressionNone}, c.DecompressionOrder)
+	require.True(t, c.RecordPerLogEvent)
+	require.Equal(t, outputFormatHec, c.OutputFormat)
+	require.Equal(t, map[string]string{
+		"/aws/lambda/*": outputFormatJsonField,
+		"DataLog":       outputFormatFlowLog,
+	}, c.LogGroupFormats)
+	require.Equal(t, "msg", c.JsonField)
+	require.Equal(t, "{{.LogGroup}} {{.Message}}", c.MessageTemplate.String())
+	require.Equal(t, []string{"version", "vpc-id", "srcaddr"}, c.FlowLogFormat)
+	require.True(t, c.HecIncludeAccountId)
+	require.Equal(t, "aws:lambda", c.HecSourcetype)
+	require.Equal(t, hecTimePrecisionSeconds, c.HecTimePrecision)
+	require.Equal(t, map[string]string{"/aws/lambda/*": "aws:lambda", "DataLog": "aws:vpcflow"}, c.LogGroupSourcetypes)
+	require.Equal(t, map[string]string{"/aws/rds/*": "database"}, c.LogGroupIndexes)
+	require.Equal(t, []string{"record_id", "partition_key"}, c.HecRecordFields)
+	require.Equal(t, map[string]string{"env": "prod", "team": "platform"}, c.EnrichTags)
+	require.Equal(t, jitterDecorrelated, c.RetryJitter)
+	require.Equal(t, 50*time.Millisecond, c.RetryBaseDelay)
+	require.Equal(t, 2*time.Second, c.RetryMaxDelay)
+	require.Equal(t, 0, c.SdkMaxRetries)
+	require.Equal(t, 1, c.RetryLogFirst)
+	require.Equal(t, 100, c.RetryLogEvery)
+	require.False(t, c.DropEmptyRecords)
+	require.Equal(t, missingDataFail, c.MissingData)
+	require.True(t, c.CombineRecords)
+	require.True(t, c.ReingestCompress)
+	require.Equal(t, 5000, c.QuotaRecords)
+	require.Equal(t, 5242880, c.QuotaBytes)
+	require.Equal(t, 2*time.Second, c.QuotaWindow)
+	require.Equal(t, 0.9, c.QuotaWarnRatio)
+	require.True(t, c.StripAnsi)
+	require.Equal(t, []string{transformStepStripAnsi, transformStepJsonField}, c.TransformPipeline)
+	require.Equal(t, "strip-ansi,json-field,redact", c.TransformChain.String())
+	require.Equal(t, []string{"ELB-HealthChecker/2.0", "GET /healthz"}, c.DropSubstrings)
+	require.Equal(t, `^\{`, c.IncludePattern.String())
+	require.Equal(t, `ELB-HealthChecker|GET /healthz`, c.ExcludePattern.String())
+	require.Equal(t, "info", c.MinMessageLevel)
+	require.Equal(t, `^\d{4}-\d{2}-\d{2}`, c.MultilineStartPattern.String())
+	require.Equal(t, []string{redactEmail, redactSsn}, c.RedactPatterns)
+	require.Len(t, c.RedactRules, 1)
+	require.Equal(t, `acct-(\d+)`, c.RedactRules[0].Pattern.String())
+	require.Equal(t, "acct-****", c.RedactRules[0].Replacement)
+	require.Equal(t, "severity", c.MessageLevelField)
+	require.Equal(t, 0.5, c.SampleRate)
+	require.Equal(t, map[string]float64{"/aws/lambda/chatty-*": 0.1}, c.LogGroupSampleRates)
+	require.Equal(t, map[string]string{"/aws/lambda/chatty-*": "/aws/lambda/chatty-*"}, c.LogGroupSamplePatterns)
+	require.Equal(t, []string{"user.email", "password"}, c.MaskFields)
+	require.Equal(t, "[masked]", c.MaskToken)
+	require.True(t, c.CollapseWhitespace)
+	require.Equal(t, "TransformDLQ", c.TransformDlqStream)
+	require.True(t, c.TransformDlqEnvelope)
+	require.Equal(t, 10000, c.DedupLogEvents)
+	require.Equal(t, putFailureMarkFailed, c.PutFailure)
+	require.Equal(t, 3, c.CircuitBreakerThreshold)
+	require.Equal(t, map[string]int{"DataLog": 100}, c.StreamBatchSizes)
+	require.Equal(t, map[string]int{"DataLog": 5, "Other": 10}, c.StreamMaxAttempts)
+	require.Equal(t, 250*time.Millisecond, c.ReingestDelay)
+	require.Equal(t, time.Second, c.DeadlineMargin)
+	require.Equal(t, reingestDataTransformed, c.ReingestData)
+	require.Equal(t, oversizeRecordFail, c.OversizeRecord)
+	require.Equal(t, sinkStdout, c.Sink)
+	require.True(t, c.IncludeOrderingIndex)
+	require.True(t, c.SortLogEvents)
+	require.Equal(t, 10, c.MaxLastSeenStreams)
+	require.True(t, c.CountUniqueSources)
+	require.Equal(t, 50, c.MaxUniqueSources)
+	require.True(t, c.EmitMemoryMetrics)
+	require.True(t, c.EmitRecordLatency)
+	require.True(t, c.ControlMessageHeartbeat)
+	require.Equal(t, metricsFormatEmf, c.MetricsFormat)
+	require.Equal(t, logLevelWarn, c.LogLevel)
+	require.Equal(t, logFormatJson, c.LogFormat)
+	require.Equal(t, "Logs", c.EmfNamespace)
+	require.Equal(t, map[string]string{"env": "prod"}, c.EmfDimensions)
+	require.True(t, c.TimestampPrefix)
+	require.Equal(t, time.RFC1123, c.TimestampLayout)
+	require.True(t, c.ForwardNonCwlJson)
+	require.True(t, c.SplitCloudTrail)
+	require.Equal(t, 1000, c.MaxLogEventsPerRecord)
+	require.Equal(t, logEventsOverCapReingest, c.LogEventsOverCap)
+	require.True(t, c.JsonArrayMessages)
+	require.Equal(t, 268435456, c.MaxDecompressedBytes)
+	require.Equal(t, 4194304, c.MaxInputBytes)
+	require.Equal(t, 4194304, c.MaxResultBytes)
+	require.Equal(t, 5000000, c.MaxResponseBytes)
+	require.Equal(t, 100000, c.HeadroomBytes)
+	require.Equal(t, "user_id", c.PartitionKeyField)
+	require.Equal(t, `user=(\w+)`, c.PartitionKeyPattern.String())
+	require.Equal(t, missingPartitionKeyRecordId, c.MissingPartitionKey)
+	require.Equal(t, longPartitionKeyTruncate, c.LongPartitionKey)
+	require.Equal(t, 0.035, c.CostPerGb)
+	require.Equal(t, 0.0001, c.CostPerRecord)
+	require.True(t, c.GzipResponse)
+	require.Equal(t, "index=main", c.RecordHeader)
+	require.False(t, c.TrailingNewline)
+	require.Equal(t, `(?P<name>\w+)=(?P<value>\d+)`, c.MetricMessagePattern.String())
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	for _, key := range []string{
+		"DECOMPRESSION_ORDER",
+		"RECORD_PER_LOG_EVENT",
+		"OUTPUT_FORMAT",
+		"LOG_GROUP_FORMATS",
+		"JSON_FIELD",
+		"MESSAGE_TEMPLATE",
+		"FLOW_LOG_FORMAT",
+		"HEC_INCLUDE_ACCOUNT_ID",
+		"HEC_SOURCETYPE",
+		"HEC_TIME_PRECISION",
+		"LOG_GROUP_SOURCETYPES",
+		"LOG_GROUP_INDEXES",
+		"HEC_RECORD_FIELDS",
+		"ENRICH_TAGS",
+		"RETRY_JITTER",
+		"RETRY_BASE_DELAY_MS",
+		"RETRY_MAX_DELAY_MS",
+		"SDK_MAX_RETRIES",
+		"RETRY_LOG_FIRST",
+		"RETRY_LOG_EVERY",
+		"DROP_EMPTY_RECORDS",
+		"MISSING_DATA",
+		"COMBINE_RECORDS",
+		"REINGEST_COMPRESS",
+		"QUOTA_RECORDS",
+		"QUOTA_BYTES",
+		"QUOTA_WINDOW_MS",
+		"QUOTA_WARN_RATIO",
+		"STRIP_ANSI",
+		"TRANSFORM_PIPELINE",
+		"DROP_SUBSTRINGS",
+		"INCLUDE_PATTERN",
+		"EXCLUDE_PATTERN",
+		"MIN_MESSAGE_LEVEL",
+		"MULTILINE_START_PATTERN",
+		"REDACT_PATTERNS",
+		"REDACT_RULES",
+		"MESSAGE_LEVEL_FIELD",
+		"SAMPLE_RATE",
+		"LOG_GROUP_SAMPLE_RATES",
+		"MASK_FIELDS",
+		"MASK_TOKEN",
+		"COLLAPSE_WHITESPACE",
+		"TRANSFORM_DLQ_STREAM",
+		"TRANSFORM_DLQ_ENVELOPE",
+		"DEDUP_LOG_EVENTS",
+		"PUT_FAILURE",
+		"CIRCUIT_BREAKER_THRESHOLD",
+		"STREAM_BATCH_SIZES",
+		"STREAM_MAX_ATTEMPTS",
+		"REINGEST_DELAY_MS",
+		"DEADLINE_MARGIN_MS",
+		"REINGEST_DATA",
+		"OVERSIZE_RECORD",
+		"SINK",
+		"INCLUDE_ORDERING_INDEX",
+		"SORT_LOG_EVENTS",
+		"MAX_LAST_SEEN_STREAMS",
+		"COUNT_UNIQUE_SOURCES",
+		"MAX_UNIQUE_SOURCES",
+		"EMIT_MEMORY_METRICS",
+		"EMIT_RECORD_LATENCY",
+		"CONTROL_MESSAGE_HEARTBEAT",
+		"METRICS_FORMAT",
+		"LOG_LEVEL",
+		"LOG_FORMAT",
+		"EMF_NAMESPACE",
+		"EMF_DIMENSIONS",
+		"TIMESTAMP_PREFIX",
+		"TIMESTAMP_LAYOUT",
+		"FORWARD_NON_CWL_JSON",
+		"SPLIT_CLOUDTRAIL",
+		"MAX_LOG_EVENTS_PER_RECORD",
+		"LOG_EVENTS_OVER_CAP",
+		"JSON_ARRAY_MESSAGES",
+		"MAX_DECOMPRESSED_BYTES",
+		"MAX_INPUT_BYTES",
+		"MAX_RESULT_BYTES",
+		"MAX_RESPONSE_BYTES",
+		"HEADROOM_BYTES",
+		"PARTITION_KEY_FIELD",
+		"PARTITION_KEY_PATTERN",
+		"MISSING_PARTITION_KEY",
+		"LONG_PARTITION_KEY",
+		"COST_PER_GB",
+		"COST_PER_RECORD",
+		"GZIP_RESPONSE",
+		"RECORD_HEADER",
+		"TRAILING_NEWLINE",
+		"METRIC_MESSAGE_PATTERN",
+	} {
+		t.Setenv(key, "")
+	}
+
+	c := loadConfig()
+	require.Equal(t, "drop-substrings,mask-fields", c.TransformChain.String())
+	c.TransformChain = nil
+	require.Equal(t, Config{
+		DecompressionOrder:      []string{compressionGzip},
+		OutputFormat:            outputFormatRaw,
+		LogGroupFormats:         map[string]string{},
+		JsonField:               "message",
+		HecSourcetype:           "aws:cloudwatchlogs",
+		HecTimePrecision:        hecTimePrecisionMilliseconds,
+		LogGroupSourcetypes:     map[string]string{},
+		LogGroupIndexes:         map[string]string{},
+		HecRecordFields:         []string{},
+		EnrichTags:              map[string]string{},
+		TransformPipeline:       []string{},
+		DropSubstrings:          []string{},
+		MessageLevelField:       "level",
+		SampleRate:              1,
+		LogGroupSampleRates:     map[string]float64{},
+		LogGroupSamplePatterns:  map[string]string{},
+		MaskFields:              []string{},
+		MaskToken:               "****",
+		RedactPatterns:          []string{},
+		RedactRules:             []redactRule{},
+		RetryJitter:             jitterFull,
+		RetryBaseDelay:          100 * time.Millisecond,
+		RetryMaxDelay:           5 * time.Second,
+		SdkMaxRetries:           -1,
+		RetryLogFirst:           3,
+		RetryLogEvery:           5,
+		DropEmptyRecords:        true,
+		MissingData:             missingDataDrop,
+		QuotaWindow:             time.Second,
+		QuotaWarnRatio:          0.8,
+		PutFailure:              putFailureError,
+		TimestampLayout:         iso8601Milliseconds,
+		MaxUniqueSources:        1000,
+		MaxResponseBytes:        6291456,
+		DeadlineMargin:          300 * time.Millisecond,
+		HeadroomBytes:           291456,
+		MetricsFormat:           metricsFormatLog,
+		LogLevel:                logLevelInfo,
+		LogFormat:               logFormatText,
+		EmfNamespace:            "FirehoseSplunkLambda",
+		EmfDimensions:           map[string]string{},
+		CircuitBreakerThreshold: 1,
+		StreamBatchSizes:        map[string]int{},
+		StreamMaxAttempts:       map[string]int{},
+		MissingPartitionKey:     missingPartitionKeyFail,
+		LongPartitionKey:        longPartitionKeyHash,
+		CostPerGb:               0.029,
+		Sink:                    sinkAws,
+		ReingestData:            reingestDataOriginal,
+		OversizeRecord:          oversizeRecordReingest,
+		TrailingNewline:         true,
+		LogEventsOverCap:        logEventsOverCapDrop,
+	}, c)
+}
+
+func TestEnvBool(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected bool
+	}{
+		{value: "", expected: true},
+		{value: "false", expected: false},
+		{value: "0", expected: false},
+		{value: "TRUE", expected: true},
+		{value: "not-a-bool", expected: true},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			t.Setenv("TEST_ENV_BOOL", tc.value)
+			require.Equal(t, tc.expected, envBool("TEST_ENV_BOOL", true))
+		})
+	}
+}
+
+func TestEnvFloat(t *testing.T) {
+	t.Setenv("TEST_ENV_FLOAT", "0.25")
+	require.Equal(t, 0.25, envFloat("TEST_ENV_FLOAT", 1))
+
+	t.Setenv("TEST_ENV_FLOAT", "a quarter")
+	require.Equal(t, 1.0, envFloat("TEST_ENV_FLOAT", 1))
+}
+
+func TestEnvMap(t *testing.T) {
+	t.Setenv("TEST_ENV_MAP", "a=1, b = 2 ,invalid,c=x=y")
+	require.Equal(t, map[string]string{
+		"a": "1",
+		"b": "2",
+		"c": "x=y",
+	}, envMap("TEST_ENV_MAP"))
+
+	t.Setenv("TEST_ENV_MAP", "")
+	require.Equal(t, map[string]string{}, envMap("TEST_ENV_MAP"))
+}
+
+func TestEnvIntMap(t *testing.T) {
+	captureLogs(t)
+	t.Setenv("TEST_ENV_INT_MAP", "a=1, b = 2 ,c=x")
+	require.Equal(t, map[string]int{
+		"a": 1,
+		"b": 2,
+	}, envIntMap("TEST_ENV_INT_MAP"))
+
+	t.Setenv("TEST_ENV_INT_MAP", "")
+	require.Equal(t, map[string]int{}, envIntMap("TEST_ENV_INT_MAP"))
+}
+
+func TestEnvFloatMap(t *testing.T) {
+	captureLogs(t)
+	t.Setenv("TEST_ENV_FLOAT_MAP", "a=0.1, b = 1 ,c=x")
+	require.Equal(t, map[string]float64{
+		"a": 0.1,
+		"b": 1,
+	}, envFloatMap("TEST_ENV_FLOAT_MAP"))
+
+	t.Setenv("TEST_ENV_FLOAT_MAP", "")
+	require.Equal(t, map[string]float64{}, envFloatMap("TEST_ENV_FLOAT_MAP"))
+}
+
+func TestEnvRegexp(t *testing.T) {
+	t.Setenv("TEST_ENV_REGEXP", "^a+$")
+	require.True(t, envRegexp("TEST_ENV_REGEXP").MatchString("aaa"))
+
+	captureLogs(t)
+	t.Setenv("TEST_ENV_REGEXP", "(unclosed")
+	require.Nil(t, envRegexp("TEST_ENV_REGEXP"))
+
+	t.Setenv("TEST_ENV_REGEXP", "")
+	require.Nil(t, envRegexp("TEST_ENV_REGEXP"))
+}
+
+func TestEnvList(t *testing.T) {
+	t.Setenv("TEST_ENV_LIST", "a, b ,,c")
+	require.Equal(t, []string{"a", "b", "c"}, envList("TEST_ENV_LIST"))
+
+	t.Setenv("TEST_ENV_LIST", "")
+	require.Equal(t, []string{}, envList("TEST_ENV_LIST"))
+
+	t.Setenv("TEST_ENV_LIST", " , ")
+	require.Equal(t, []string{"d"}, envListDefault("TEST_ENV_LIST", []string{"d"}))
+}
+
+func TestEnvInt(t *testing.T) {
+	t.Setenv("TEST_ENV_INT", "42")
+	require.Equal(t, 42, envInt("TEST_ENV_INT", 7))
+
+	t.Setenv("TEST_ENV_INT", "forty-two")
+	require.Equal(t, 7, envInt("TEST_ENV_INT", 7))
+}
@@ -0,0 +1,22 @@
+package main
+
+// firehoseBillingIncrement is the size Firehose rounds each ingested record
+// up to for billing.
+const firehoseBillingIncrement = 5 * 1024
+
+const bytesPerGb = 1024 * 1024 * 1024
+
+// billedSize returns the size Firehose bills a record of size bytes as.
+func billedSize(size int) int {
+	if size%firehoseBillingIncrement == 0 {
+		return size
+	}
+	return (size/firehoseBillingIncrement + 1) * firehoseBillingIncrement
+}
+
+// estimateCost estimates what ingesting the invocation's records into
+// Firehose cost, at config.CostPerGb and config.CostPerRecord.
+func estimateCost(s Stats) float64 {
+	return float64(s.BilledBytes)/bytesPerGb*config.CostPerGb +
+		float64(s.Records)*config.CostPerRecord
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBilledSize(t *testing.T) {
+	require.Equal(t, 0, billedSize(0))
+	require.Equal(t, 5120, billedSize(1))
+	require.Equal(t, 5120, billedSize(5120))
+	require.Equal(t, 10240, billedSize(5121))
+}
+
+func TestEstimateCost(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		costPerGb     float64
+		costPerRecord float64
+		stats         Stats
+		expected      float64
+	}{
+		{
+			name:      "nothing",
+			costPerGb: 0.029,
+			expected:  0,
+		},
+		{
+			name:      "a GB",
+			costPerGb: 0.029,
+			stats:     Stats{Records: 1, BilledBytes: bytesPerGb},
+			expected:  0.029,
+		},
+		{
+			name:          "per record",
+			costPerGb:     0.029,
+			costPerRecord: 0.001,
+			stats:         Stats{Records: 500, BilledBytes: bytesPerGb / 2},
+			expected:      0.0145 + 0.5,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.CostPerGb = tc.costPerGb
+				c.CostPerRecord = tc.costPerRecord
+			})
+
+			require.InDelta(t, tc.expected, estimateCost(tc.stats), 1e-12)
+		})
+	}
+}
+
+func TestTransformRecordsBilledBytes(t *testing.T) {
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{MessageType: controlMessage})},
+			{RecordId: "2", Data: strings.Repeat("A", 8000)},
+		},
+	}
+
+	stats := &Stats{}
+	transformRecords(e, stats)
+	require.Equal(t, 5120+10240, stats.BilledBytes)
+}
+
+func TestHandleRequestEmitsEstimatedCost(t *testing.T) {
+	b := captureLogs(t)
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{MessageType: controlMessage})},
+		},
+	}
+
+	_, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "metric EstimatedCost=")
+}
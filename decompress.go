@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	compressionGzip = "gzip"
+	compressionZlib = "zlib"
+	compressionNone = "none"
+)
+
+// decompressors decompress record data into b, by compression format.
+var decompressors = map[string]func(b *bytes.Buffer, data []byte) error{
+	compressionGzip: gunzip,
+	compressionZlib: inflate,
+	compressionNone: func(b *bytes.Buffer, data []byte) error {
+		_, err := b.Write(data)
+		return err
+	},
+}
+
+func inflate(b *bytes.Buffer, data []byte) error {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	inflated, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.Write(inflated)
+	return err
+}
+
+// messageDecodeError is the error of data that decompressed fine but isn't
+// JSON messages.
+type messageDecodeError struct {
+	err error
+}
+
+func (e *messageDecodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *messageDecodeError) Unwrap() error {
+	return e.err
+}
+
+// decompressMessages decompresses record data with each of the formats of
+// config.DecompressionOrder in turn, until one yields messages. It returns
+// the decompressed data along with its messages. Gzipped data that fails to
+// decompress isn't tried with the formats after gzip.
+func decompressMessages(data []byte) ([]byte, []*Message, error) {
+	err := fmt.Errorf("No decompression formats configured")
+
+	for _, format := range config.DecompressionOrder {
+		decompress, ok := decompressors[format]
+		if !ok {
+			err = fmt.Errorf("Unknown decompression format %q", format)
+			continue
+		}
+
+		b := &bytes.Buffer{}
+		if err = decompress(b, data); err != nil {
+			if format == compressionGzip && isGzipped(data) {
+				// The data is gzipped, only corrupt, so it failed to
+				// decompress, whatever the formats after gzip make of it.
+				return nil, nil, err
+			}
+			continue
+		}
+
+		var messages []*Message
+		if messages, err = decodeMessages(b.Bytes()); err != nil {
+			err = &messageDecodeError{err: err}
+			continue
+		}
+
+		return b.Bytes(), messages, nil
+	}
+
+	return nil, nil, err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func zlibCompress(t *testing.T, data []byte) []byte {
+	b := &bytes.Buffer{}
+	zw := zlib.NewWriter(b)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	return b.Bytes()
+}
+
+func TestDecompressMessages(t *testing.T) {
+	m := Message{
+		MessageType: dataMessage,
+		LogEvents:   []LogEvent{{Id: "a", Message: "hello"}},
+	}
+	plain := messageJson(t, m)
+
+	for _, tc := range []struct {
+		name      string
+		order     []string
+		data      []byte
+		expectErr bool
+	}{
+		{name: "gzip", order: []string{"gzip"}, data: gzipMessage(t, m)},
+		{name: "zlib", order: []string{"zlib"}, data: zlibCompress(t, plain)},
+		{name: "none", order: []string{"none"}, data: plain},
+		{name: "gzip falls back to none", order: []string{"gzip", "none"}, data: plain},
+		{name: "zlib falls back to gzip", order: []string{"zlib", "gzip"}, data: gzipMessage(t, m)},
+		{name: "none is not JSON", order: []string{"none", "gzip"}, data: gzipMessage(t, m)},
+		{name: "not in order", order: []string{"gzip"}, data: plain, expectErr: true},
+		{name: "unknown format", order: []string{"zstd", "gzip"}, data: gzipMessage(t, m)},
+		{name: "only unknown formats", order: []string{"zstd"}, data: gzipMessage(t, m), expectErr: true},
+		{name: "no formats", order: []string{}, data: gzipMessage(t, m), expectErr: true},
+		{name: "corrupt gzip", order: []string{"gzip", "none"}, data: gzipMessage(t, m)[:20], expectErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.DecompressionOrder = tc.order
+			})
+
+			decompressed, messages, err := decompressMessages(tc.data)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, plain, decompressed)
+			require.Len(t, messages, 1)
+			require.Equal(t, m.LogEvents, messages[0].LogEvents)
+		})
+	}
+}
+
+func TestTransformRecordsDecompressionOrder(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.DecompressionOrder = []string{compressionGzip, compressionZlib, compressionNone}
+	})
+
+	m := Message{
+		MessageType: dataMessage,
+		LogEvents:   []LogEvent{{Id: "a", Message: "hello"}},
+	}
+	plain := messageJson(t, m)
+
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "gzip", Data: encodeMessage(t, m)},
+			{RecordId: "zlib", Data: base64.StdEncoding.EncodeToString(zlibCompress(t, plain))},
+			{RecordId: "none", Data: base64.StdEncoding.EncodeToString(plain)},
+			{RecordId: "garbage", Data: base64.StdEncoding.EncodeToString([]byte("garbage"))},
+			{RecordId: "corrupt", Data: base64.StdEncoding.EncodeToString(gzipMessage(t, m)[:20])},
+		},
+	}
+
+	stats := &Stats{}
+	resultRecords, _ := transformRecords(e, stats)
+
+	expected := base64.StdEncoding.EncodeToString([]byte("hello\n"))
+	require.Equal(t, ResultRecordList{
+		{RecordId: "gzip", Result: resultStatusOk, Data: expected},
+		{RecordId: "zlib", Result: resultStatusOk, Data: expected},
+		{RecordId: "none", Result: resultStatusOk, Data: expected},
+		{RecordId: "garbage", Result: resultStatusFailed},
+		{RecordId: "corrupt", Result: resultStatusFailed},
+	}, resultRecords)
+	require.Equal(t, failReasonJsonUnmarshal, stats.Failures["garbage"].Reason)
+	require.Equal(t, failReasonDecompress, stats.Failures["corrupt"].Reason)
+	require.Equal(t, 3, stats.DecompressedRecords)
+	require.Equal(t, 3*len(plain), stats.DecompressedBytes)
+}
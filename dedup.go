@@ -0,0 +1,133 @@
+package main
+
+import (
+	"container/list"
+)
+
+// logEventDedup remembers the ids of the last config.DedupLogEvents log
+// events returned to Firehose, so log events of records Firehose retries, or
+// that are replayed, aren't sent on twice. It lives as long as the Lambda
+// container does, so it only catches duplicates handled by the same
+// container.
+//
+// Log events are only held while their record is transformed, and
+// remembered once the invocation has returned a response Firehose will
+// take, with the record Ok. Log events of records that fail, or are
+// reingested rather than returned, and of invocations that fail, aren't
+// remembered, so they aren't dropped when they come back.
+type logEventDedup struct {
+	order   *list.List
+	seen    map[string]*list.Element
+	pending map[string][]string
+	held    map[string]bool
+}
+
+// dedup is the log event dedup of the Lambda container.
+var dedup = newLogEventDedup()
+
+func newLogEventDedup() *logEventDedup {
+	d := &logEventDedup{
+		order: list.New(),
+		seen:  map[string]*list.Element{},
+	}
+	d.begin()
+
+	return d
+}
+
+// begin starts a new invocation, letting go of anything held by the last
+// one that wasn't committed.
+func (d *logEventDedup) begin() {
+	d.pending = map[string][]string{}
+	d.held = map[string]bool{}
+}
+
+// clone returns a copy of d that remembers the same log events in the same
+// order, with nothing held, e.g. to try records against without touching d.
+func (d *logEventDedup) clone() *logEventDedup {
+	c := newLogEventDedup()
+	for el := d.order.Back(); el != nil; el = el.Prev() {
+		id := el.Value.(string)
+		c.seen[id] = c.order.PushFront(id)
+	}
+
+	return c
+}
+
+// isDuplicate returns whether the log event with the given id was returned
+// already, by an earlier invocation or a record earlier in this one. A hit
+// counts as use, so often retried log events are remembered the longest.
+func (d *logEventDedup) isDuplicate(id string) bool {
+	if config.DedupLogEvents <= 0 || id == "" {
+		return false
+	}
+	if d.held[id] {
+		return true
+	}
+
+	el, ok := d.seen[id]
+	if ok {
+		d.order.MoveToFront(el)
+	}
+
+	return ok
+}
+
+// hold holds the ids of the log events of the record with the given id
+// until commit.
+func (d *logEventDedup) hold(recordId string, ids []string) {
+	if config.DedupLogEvents <= 0 {
+		return
+	}
+
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		d.pending[recordId] = append(d.pending[recordId], id)
+		d.held[id] = true
+	}
+}
+
+// commitResponse commits the records of r, a successful response of size
+// bytes, unless it is too large for Lambda to return, in which case Firehose
+// retries the whole batch.
+func (d *logEventDedup) commitResponse(r ResultResponse, size int) {
+	if config.DedupLogEvents <= 0 {
+		d.begin()
+		return
+	}
+
+	if size > config.MaxResponseBytes {
+		warnf("Not remembering the log events of a response Lambda can't return\n")
+		d.begin()
+		return
+	}
+
+	d.commit(r.Records)
+}
+
+// commit remembers the held log events of the records returned Ok, forgetting
+// the least recently seen ones beyond config.DedupLogEvents, and starts over.
+func (d *logEventDedup) commit(resultRecords ResultRecordList) {
+	for _, r := range resultRecords {
+		if r.Result != resultStatusOk {
+			continue
+		}
+		for _, id := range d.pending[r.RecordId] {
+			if el, ok := d.seen[id]; ok {
+				d.order.MoveToFront(el)
+				continue
+			}
+			d.seen[id] = d.order.PushFront(id)
+		}
+	}
+
+	for d.order.Len() > config.DedupLogEvents {
+		el := d.order.Back()
+		d.order.Remove(el)
+		delete(d.seen, el.Value.(string))
+	}
+
+	d.begin()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/require"
+)
+
+func withDedup(t *testing.T, size int) {
+	orig := dedup
+	t.Cleanup(func() {
+		dedup = orig
+	})
+	dedup = newLogEventDedup()
+
+	withConfig(t, func(c *Config) {
+		c.DedupLogEvents = size
+	})
+}
+
+func TestLogEventDedup(t *testing.T) {
+	withDedup(t, 2)
+
+	dedup.hold("1", []string{"a", "b"})
+	dedup.hold("2", []string{"c"})
+	require.True(t, dedup.isDuplicate("a"))
+	require.False(t, dedup.isDuplicate("d"))
+	require.False(t, dedup.isDuplicate(""))
+
+	// Record 2 failed, so c isn't remembered.
+	dedup.commit(ResultRecordList{
+		{RecordId: "1", Result: resultStatusOk},
+		{RecordId: "2", Result: resultStatusFailed},
+	})
+	require.True(t, dedup.isDuplicate("a"))
+	require.True(t, dedup.isDuplicate("b"))
+	require.False(t, dedup.isDuplicate("c"))
+
+	// b was seen last, so a is the one forgotten.
+	dedup.hold("3", []string{"d"})
+	dedup.commit(ResultRecordList{{RecordId: "3", Result: resultStatusOk}})
+	require.False(t, dedup.isDuplicate("a"))
+	require.True(t, dedup.isDuplicate("b"))
+	require.True(t, dedup.isDuplicate("d"))
+
+	// Anything held but not committed is let go of by the next invocation.
+	dedup.hold("4", []string{"e"})
+	dedup.begin()
+	require.False(t, dedup.isDuplicate("e"))
+}
+
+func TestLogEventDedupDisabled(t *testing.T) {
+	withDedup(t, 0)
+
+	dedup.hold("1", []string{"a"})
+	dedup.commit(ResultRecordList{{RecordId: "1", Result: resultStatusOk}})
+	require.False(t, dedup.isDuplicate("a"))
+}
+
+func TestHandleRequestDedupLogEvents(t *testing.T) {
+	withDedup(t, 100)
+	withFakeAPIs(t)
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents: []LogEvent{
+					{Id: "a", Message: "first"},
+					{Id: "a", Message: "first"},
+					{Id: "b", Message: "second"},
+				},
+			})},
+		},
+	}
+
+	b := captureLogs(t)
+	r, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	require.Equal(t, resultStatusOk, r.Records[0].Result)
+	data, err := base64.StdEncoding.DecodeString(r.Records[0].Data)
+	require.NoError(t, err)
+	require.Equal(t, "first\nsecond\n", string(data))
+	require.Contains(t, b.String(), "metric DuplicateLogEvents=1 unit=Count")
+
+	// Firehose retrying the record doesn't send its log events on again.
+	b.Reset()
+	r, err = HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	require.Equal(t, resultStatusDropped, r.Records[0].Result)
+	require.Contains(t, b.String(), "metric DuplicateLogEvents=3 unit=Count")
+}
+
+func TestHandleRequestDedupOnlyCommitsReturnedResponses(t *testing.T) {
+	captureLogs(t)
+	withDedup(t, 100)
+	fh, _ := withFakeAPIs(t)
+
+	twoEvents := encodeMessage(t, Message{
+		MessageType: dataMessage,
+		LogEvents: []LogEvent{
+			{Id: "a", Message: "first"},
+			{Id: "b", Message: "second"},
+		},
+	})
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records:           []EventRecord{{RecordId: "1", Data: twoEvents}},
+	}
+
+	// Splitting the record off fails to reingest, so the invocation fails
+	// and Firehose retries the batch.
+	withConfig(t, func(c *Config) {
+		c.RecordPerLogEvent = true
+		c.PutFailure = putFailureError
+	})
+	fh.errs = []error{awserr.New("ResourceNotFoundException", "no such stream", nil)}
+	_, err := HandleRequest(context.Background(), e)
+	require.Error(t, err)
+	require.False(t, dedup.isDuplicate("a"))
+
+	// Too large a response for Lambda to return.
+	withConfig(t, func(c *Config) {
+		c.RecordPerLogEvent = false
+		c.MaxResponseBytes = 10
+		c.HeadroomBytes = -1 << 20
+	})
+	r, stats, err := HandleRequestWithStats(context.Background(), e)
+	require.NoError(t, err)
+	require.Equal(t, resultStatusOk, r.Records[0].Result)
+	require.Equal(t, len(r.Records[0].RecordId)+len(r.Records[0].Data), stats.ResponseBytes)
+	require.False(t, dedup.isDuplicate("a"))
+
+	withConfig(t, func(c *Config) {
+		c.MaxResponseBytes = 6291456
+		c.HeadroomBytes = 0
+	})
+	r, err = HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	data, err := base64.StdEncoding.DecodeString(r.Records[0].Data)
+	require.NoError(t, err)
+	require.Equal(t, "first\nsecond\n", string(data))
+	require.True(t, dedup.isDuplicate("a"))
+	require.True(t, dedup.isDuplicate("b"))
+}
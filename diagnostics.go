@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// diagnosticInvocationId is the invocation id of an event asking for the
+// effective configuration rather than carrying records to transform.
+const diagnosticInvocationId = "config"
+
+// redactedValue replaces the values of secret settings in diagnostics.
+const redactedValue = "REDACTED"
+
+// describeConfig returns the fields of the config struct c keyed by name, for
+// operators to check how the environment was parsed. Fields tagged
+// `secret:"true"` are redacted, and values that describe themselves, such as
+// durations and regular expressions, are given as strings.
+func describeConfig(c interface{}) map[string]interface{} {
+	described := map[string]interface{}{}
+
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		value := v.Field(i)
+
+		switch {
+		case field.Tag.Get("secret") == "true":
+			if value.IsZero() {
+				described[field.Name] = ""
+			} else {
+				described[field.Name] = redactedValue
+			}
+		case value.Kind() == reflect.Ptr && value.IsNil():
+			described[field.Name] = nil
+		default:
+			if s, ok := value.Interface().(fmt.Stringer); ok {
+				described[field.Name] = s.String()
+			} else {
+				described[field.Name] = value.Interface()
+			}
+		}
+	}
+
+	return described
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescribeConfig(t *testing.T) {
+	type testConfig struct {
+		Name    string
+		Token   string `secret:"true"`
+		Unset   string `secret:"true"`
+		Delay   time.Duration
+		Pattern *regexp.Regexp
+		NoMatch *regexp.Regexp
+		Enabled bool
+	}
+
+	require.Equal(t, map[string]interface{}{
+		"Name":    "splunk",
+		"Token":   redactedValue,
+		"Unset":   "",
+		"Delay":   "1.5s",
+		"Pattern": `user=(\w+)`,
+		"NoMatch": nil,
+		"Enabled": true,
+	}, describeConfig(testConfig{
+		Name:    "splunk",
+		Token:   "00000000-0000-0000-0000-000000000000",
+		Delay:   1500 * time.Millisecond,
+		Pattern: regexp.MustCompile(`user=(\w+)`),
+		Enabled: true,
+	}))
+}
+
+func TestHandleRequestDiagnosticInvocation(t *testing.T) {
+	t.Setenv("OUTPUT_FORMAT", "hec")
+	t.Setenv("RETRY_BASE_DELAY_MS", "250")
+	t.Setenv("PARTITION_KEY_PATTERN", `user=(\w+)`)
+	t.Setenv("RECORD_HEADER", "token=secret")
+	withConfig(t, func(c *Config) {
+		*c = loadConfig()
+	})
+	_, ks := withFakeAPIs(t)
+
+	r, err := HandleRequest(context.Background(), Event{InvocationId: diagnosticInvocationId})
+	require.NoError(t, err)
+	require.Empty(t, r.Records)
+	require.Empty(t, ks.inputs)
+
+	require.Equal(t, outputFormatHec, r.Config["OutputFormat"])
+	require.Equal(t, "250ms", r.Config["RetryBaseDelay"])
+	require.Equal(t, `user=(\w+)`, r.Config["PartitionKeyPattern"])
+	require.Equal(t, true, r.Config["DropEmptyRecords"])
+	require.Equal(t, redactedValue, r.Config["RecordHeader"])
+	require.Len(t, r.Config, reflect.TypeOf(Config{}).NumField())
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/firehose"
+)
+
+// dlqEnvelope is what a record forwarded to the transform DLQ is wrapped in
+// when config.TransformDlqEnvelope is set. Data is the record's original
+// data, base64 encoded in the JSON.
+type dlqEnvelope struct {
+	RecordId          string `json:"recordId"`
+	DeliveryStreamArn string `json:"deliveryStreamArn"`
+	Reason            string `json:"reason,omitempty"`
+	Error             string `json:"error,omitempty"`
+	FailedAt          int64  `json:"failedAt"`
+	Data              []byte `json:"data"`
+}
+
+// forwardToTransformDlq puts the original data of the records that failed,
+// whether transforming or reingesting them, on to the transform DLQ
+// delivery stream, so they can be reprocessed later. Firehose doesn't retry
+// records reported ProcessingFailed, it only writes them to its
+// processing-failed output, so this is the way to recover them whatever
+// they failed for. This is separate from reingestion, which puts records
+// that were transformed fine back on to the source stream.
+//
+// The records are still reported as ProcessingFailed to Firehose.
+func forwardToTransformDlq(ctx context.Context, e Event, resultRecords ResultRecordList, inputDataByRecId map[string]ReingestionRecord, stats *Stats) error {
+	if config.TransformDlqStream == "" {
+		return nil
+	}
+
+	rawData := make(map[string]string, len(e.Records))
+	for _, r := range e.Records {
+		rawData[r.RecordId] = r.Data
+	}
+
+	failedAt := clock.Now().UnixNano() / int64(time.Millisecond)
+	failed := []*firehose.Record{}
+	for _, r := range resultRecords {
+		if r.Result != resultStatusFailed {
+			continue
+		}
+
+		var data []byte
+		if input, ok := inputDataByRecId[r.RecordId]; ok {
+			data = input.Data
+		} else {
+			// Data that isn't even valid base64 is forwarded as it came.
+			data = []byte(rawData[r.RecordId])
+		}
+		if config.TransformDlqEnvelope {
+			f := stats.Failures[r.RecordId]
+			b, err := json.Marshal(dlqEnvelope{
+				RecordId:          r.RecordId,
+				DeliveryStreamArn: e.DeliveryStreamArn,
+				Reason:            f.Reason,
+				Error:             f.Error,
+				FailedAt:          failedAt,
+				Data:              data,
+			})
+			if err != nil {
+				return err
+			}
+			data = b
+		}
+		failed = append(failed, &firehose.Record{Data: data})
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+
+	svc := newFirehoseAPI(e.Region)
+	batchSize := batchSizeFor(config.TransformDlqStream)
+	for start := 0; start < len(failed); start += batchSize {
+		end := start + batchSize
+		if end > len(failed) {
+			end = len(failed)
+		}
+
+		if _, err := putRecordsToFirehoseStream(ctx, svc, config.TransformDlqStream, failed[start:end], newBackoff(), maxAttemptsFor(config.TransformDlqStream)); err != nil {
+			return err
+		}
+	}
+
+	logf("Forwarded %d failed records to %s stream\n", len(failed), config.TransformDlqStream)
+
+	return nil
+}
+
+// dlqReplayEvent builds an event to run records forwarded to the transform
+// DLQ through HandleRequest again, once whatever made them fail is fixed.
+// data is each record as it was read off the DLQ, either its original data
+// or, with config.TransformDlqEnvelope set, its envelope, and
+// deliveryStreamArn is the stream the records were first bound for, which
+// any reingested records are put back on to.
+func dlqReplayEvent(deliveryStreamArn string, data ...[]byte) (Event, error) {
+	e := Event{
+		DeliveryStreamArn: deliveryStreamArn,
+		Records:           make([]EventRecord, 0, len(data)),
+	}
+
+	now := int(clock.Now().UnixNano() / int64(time.Millisecond))
+	for i, d := range data {
+		if config.TransformDlqEnvelope {
+			env := dlqEnvelope{}
+			if err := json.Unmarshal(d, &env); err != nil {
+				return Event{}, fmt.Errorf("Failed to unwrap DLQ record %d. %s", i, err)
+			}
+			d = env.Data
+		}
+
+		e.Records = append(e.Records, EventRecord{
+			RecordId:                    fmt.Sprintf("replay-%d", i),
+			ApproximateArrivalTimestamp: now,
+			Data:                        base64.StdEncoding.EncodeToString(d),
+		})
+	}
+
+	return e, nil
+}
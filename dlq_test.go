@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardToTransformDlq(t *testing.T) {
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			// Not gzipped, so it fails transformation.
+			{RecordId: "1", Data: "dGVzdAo="},
+			{RecordId: "2", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "a", Message: "ok"}},
+			})},
+			{RecordId: "3", Data: encodeMessage(t, Message{MessageType: "UNKNOWN"})},
+		},
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		withConfig(t, func(c *Config) {
+			c.TransformDlqStream = "TransformDLQ"
+		})
+		fh, _ := withFakeAPIs(t)
+
+		r, err := HandleRequest(context.Background(), e)
+		require.NoError(t, err)
+		require.Equal(t, resultStatusFailed, r.Records[0].Result)
+		require.Equal(t, resultStatusOk, r.Records[1].Result)
+		require.Equal(t, resultStatusFailed, r.Records[2].Result)
+
+		require.Len(t, fh.inputs, 1)
+		require.Equal(t, "TransformDLQ", *fh.inputs[0].DeliveryStreamName)
+		require.Len(t, fh.inputs[0].Records, 2)
+		require.Equal(t, []byte("test\n"), fh.inputs[0].Records[0].Data)
+		require.Equal(t, gzipMessage(t, Message{MessageType: "UNKNOWN"}), fh.inputs[0].Records[1].Data)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		fh, _ := withFakeAPIs(t)
+
+		_, err := HandleRequest(context.Background(), e)
+		require.NoError(t, err)
+		require.Empty(t, fh.inputs)
+	})
+}
+
+func TestDlqReplayEvent(t *testing.T) {
+	arn := "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog"
+	m := Message{
+		MessageType: dataMessage,
+		LogEvents:   []LogEvent{{Id: "a", Message: "ok"}},
+	}
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+
+	// zlib isn't in the decompression order yet, so the record fails
+	// transformation and is forwarded to the DLQ.
+	withConfig(t, func(c *Config) {
+		c.TransformDlqStream = "TransformDLQ"
+	})
+	fh, _ := withFakeAPIs(t)
+
+	r, err := HandleRequest(context.Background(), Event{
+		DeliveryStreamArn: arn,
+		Records: []EventRecord{
+			{RecordId: "1", Data: base64.StdEncoding.EncodeToString(zlibCompress(t, data))},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, resultStatusFailed, r.Records[0].Result)
+	require.Len(t, fh.inputs, 1)
+	dlqData := fh.inputs[0].Records[0].Data
+
+	// Once zlib is added, replaying the DLQ'd record succeeds.
+	withConfig(t, func(c *Config) {
+		c.DecompressionOrder = []string{compressionZlib, compressionGzip}
+	})
+	fh, _ = withFakeAPIs(t)
+
+	e, err := dlqReplayEvent(arn, dlqData)
+	require.NoError(t, err)
+	require.Len(t, e.Records, 1)
+	require.Equal(t, "replay-0", e.Records[0].RecordId)
+	require.NotZero(t, e.Records[0].ApproximateArrivalTimestamp)
+
+	r, err = HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	require.Len(t, r.Records, 1)
+	require.Equal(t, "replay-0", r.Records[0].RecordId)
+	require.Equal(t, resultStatusOk, r.Records[0].Result)
+	require.Empty(t, fh.inputs)
+}
+
+func TestForwardToTransformDlqStreamBatchSize(t *testing.T) {
+	captureLogs(t)
+	withConfig(t, func(c *Config) {
+		c.TransformDlqStream = "TransformDLQ"
+		c.StreamBatchSizes = map[string]int{"TransformDLQ": 2}
+	})
+	fh, _ := withFakeAPIs(t)
+
+	e := Event{DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog"}
+	resultRecords := ResultRecordList{}
+	inputDataByRecId := map[string]ReingestionRecord{}
+	stats := &Stats{}
+	for _, id := range []string{"1", "2", "3"} {
+		resultRecords = append(resultRecords, ResultRecord{RecordId: id, Result: resultStatusFailed})
+		inputDataByRecId[id] = ReingestionRecord{Data: []byte(id)}
+		stats.fail(id, failReasonDecompress, nil)
+	}
+
+	require.NoError(t, forwardToTransformDlq(context.Background(), e, resultRecords, inputDataByRecId, stats))
+	require.Len(t, fh.inputs, 2)
+	require.Len(t, fh.inputs[0].Records, 2)
+	require.Len(t, fh.inputs[1].Records, 1)
+}
+
+func TestForwardToTransformDlqEnvelope(t *testing.T) {
+	arn := "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog"
+	withConfig(t, func(c *Config) {
+		c.TransformDlqStream = "TransformDLQ"
+		c.TransformDlqEnvelope = true
+	})
+	fh, _ := withFakeAPIs(t)
+
+	r, err := HandleRequest(context.Background(), Event{
+		DeliveryStreamArn: arn,
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{MessageType: "UNKNOWN"})},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, resultStatusFailed, r.Records[0].Result)
+
+	require.Len(t, fh.inputs, 1)
+	require.Len(t, fh.inputs[0].Records, 1)
+	env := dlqEnvelope{}
+	require.NoError(t, json.Unmarshal(fh.inputs[0].Records[0].Data, &env))
+	require.Equal(t, "1", env.RecordId)
+	require.Equal(t, arn, env.DeliveryStreamArn)
+	require.Equal(t, failReasonUnknownMessageType, env.Reason)
+	require.NotEmpty(t, env.Error)
+	require.Equal(t, clock.Now().UnixNano()/int64(time.Millisecond), env.FailedAt)
+	require.Equal(t, gzipMessage(t, Message{MessageType: "UNKNOWN"}), env.Data)
+
+	// Replaying unwraps the envelope back to the original data.
+	e, err := dlqReplayEvent(arn, fh.inputs[0].Records[0].Data)
+	require.NoError(t, err)
+	require.Len(t, e.Records, 1)
+	require.Equal(t, base64.StdEncoding.EncodeToString(env.Data), e.Records[0].Data)
+
+	_, err = dlqReplayEvent(arn, []byte("not json"))
+	require.Error(t, err)
+}
+
+func TestForwardToTransformDlqReingestFailures(t *testing.T) {
+	captureLogs(t)
+	withConfig(t, func(c *Config) {
+		c.TransformDlqStream = "TransformDLQ"
+		c.TransformDlqEnvelope = true
+		c.PutFailure = putFailureMarkFailed
+	})
+	fh, _ := withFakeAPIs(t)
+	fh.errs = []error{awserr.New("ResourceNotFoundException", "no such stream", nil)}
+	withConfig(t, func(c *Config) {
+		c.RecordPerLogEvent = true
+	})
+
+	twoEvents := encodeMessage(t, Message{
+		MessageType: dataMessage,
+		LogEvents: []LogEvent{
+			{Id: "a", Message: "first"},
+			{Id: "b", Message: "second"},
+		},
+	})
+	r, err := HandleRequest(context.Background(), Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records:           []EventRecord{{RecordId: "1", Data: twoEvents}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, resultStatusFailed, r.Records[0].Result)
+
+	// The reingestion attempt, then the DLQ.
+	require.Len(t, fh.inputs, 2)
+	require.Equal(t, "TransformDLQ", *fh.inputs[1].DeliveryStreamName)
+	require.Len(t, fh.inputs[1].Records, 1)
+	env := dlqEnvelope{}
+	require.NoError(t, json.Unmarshal(fh.inputs[1].Records[0].Data, &env))
+	require.Equal(t, "1", env.RecordId)
+	require.Equal(t, failReasonReingest, env.Reason)
+	require.Empty(t, env.Error)
+}
+
+func TestForwardToTransformDlqAnyFailure(t *testing.T) {
+	captureLogs(t)
+	withConfig(t, func(c *Config) {
+		c.TransformDlqStream = "TransformDLQ"
+		c.TransformDlqEnvelope = true
+	})
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: "dGVzdAo="},
+			{RecordId: "2", Data: "dGVzdAo="},
+			{RecordId: "3", Data: "dGVzdAo="},
+			{RecordId: "4", Data: "dGVzdAo="},
+		},
+	}
+	resultRecords := ResultRecordList{}
+	stats := &Stats{}
+	for i, reason := range []string{failReasonDeadline, failReasonLimit, failReasonPartitionKey, failReasonDecompress} {
+		id := e.Records[i].RecordId
+		resultRecords = append(resultRecords, ResultRecord{RecordId: id, Result: resultStatusFailed})
+		stats.fail(id, reason, nil)
+	}
+
+	// Firehose doesn't retry any of them, so all of them are forwarded.
+	fh, _ := withFakeAPIs(t)
+	require.NoError(t, forwardToTransformDlq(context.Background(), e, resultRecords, nil, stats))
+	require.Len(t, fh.inputs, 1)
+	require.Len(t, fh.inputs[0].Records, 4)
+	for i, reason := range []string{failReasonDeadline, failReasonLimit, failReasonPartitionKey, failReasonDecompress} {
+		env := dlqEnvelope{}
+		require.NoError(t, json.Unmarshal(fh.inputs[0].Records[i].Data, &env))
+		require.Equal(t, e.Records[i].RecordId, env.RecordId)
+		require.Equal(t, reason, env.Reason)
+		require.Equal(t, []byte("dGVzdAo="), env.Data)
+	}
+}
+
+func TestHandleRequestInvalidBase64(t *testing.T) {
+	captureLogs(t)
+	withConfig(t, func(c *Config) {
+		c.TransformDlqStream = "TransformDLQ"
+	})
+	fh, _ := withFakeAPIs(t)
+
+	r, err := HandleRequest(context.Background(), Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: "not base64!"},
+			{RecordId: "2", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "a", Message: "ok"}},
+			})},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, r.Records, 2)
+	require.Equal(t, ResultRecord{RecordId: "1", Result: resultStatusFailed}, r.Records[0])
+	require.Equal(t, resultStatusOk, r.Records[1].Result)
+
+	require.Len(t, fh.inputs, 1)
+	require.Len(t, fh.inputs[0].Records, 1)
+	require.Equal(t, []byte("not base64!"), fh.inputs[0].Records[0].Data)
+}
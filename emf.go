@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	metricsFormatLog = "log"
+	metricsFormatEmf = "emf"
+)
+
+// emfDocument collects the metrics of an invocation to be written as a
+// single CloudWatch Embedded Metric Format log line, see
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+type emfDocument struct {
+	names  []string
+	values map[string]float64
+	units  map[string]string
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// add adds a metric to the document. It has the signature of emitMetric, so
+// it can stand in for it.
+func (d *emfDocument) add(name string, value float64, unit string) {
+	if d.values == nil {
+		d.values = map[string]float64{}
+		d.units = map[string]string{}
+	}
+	if _, ok := d.values[name]; !ok {
+		d.names = append(d.names, name)
+	}
+	d.values[name] = value
+	d.units[name] = unit
+}
+
+// render returns the document as JSON, with the metrics in the order they
+// were added, timestamped now.
+func (d *emfDocument) render(now time.Time) ([]byte, error) {
+	dimensions := make([]string, 0, len(config.EmfDimensions))
+	for k := range config.EmfDimensions {
+		dimensions = append(dimensions, k)
+	}
+	sort.Strings(dimensions)
+
+	directive := emfDirective{
+		Namespace:  config.EmfNamespace,
+		Dimensions: [][]string{dimensions},
+		Metrics:    make([]emfMetric, 0, len(d.names)),
+	}
+	for _, name := range d.names {
+		directive.Metrics = append(directive.Metrics, emfMetric{Name: name, Unit: d.units[name]})
+	}
+
+	doc := map[string]interface{}{
+		"_aws": emfMetadata{
+			Timestamp:         now.UnixNano() / int64(time.Millisecond),
+			CloudWatchMetrics: []emfDirective{directive},
+		},
+	}
+	for k, v := range config.EmfDimensions {
+		doc[k] = v
+	}
+	for name, value := range d.values {
+		doc[name] = value
+	}
+	if correlationId != "" {
+		doc["correlationId"] = correlationId
+	}
+
+	return json.Marshal(doc)
+}
+
+// write writes the document as a log line of its own. The line is not
+// prefixed like those of logf, as CloudWatch only reads lines that are JSON
+// through and through.
+func (d *emfDocument) write() {
+	data, err := d.render(clock.Now())
+	if err != nil {
+		warnf("Failed to render the EMF metrics. %s\n", err)
+		return
+	}
+
+	fmt.Fprintln(logOutput, string(data))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmfDocumentRender(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.EmfNamespace = "Logs"
+		c.EmfDimensions = map[string]string{"env": "prod", "app": "api"}
+	})
+
+	d := &emfDocument{}
+	d.add("Puts", 3, "Count")
+	d.add("Bytes", 1024, "Bytes")
+
+	data, err := d.render(time.Unix(1621224088, 0))
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"_aws": {
+			"Timestamp": 1621224088000,
+			"CloudWatchMetrics": [{
+				"Namespace": "Logs",
+				"Dimensions": [["app", "env"]],
+				"Metrics": [
+					{"Name": "Puts", "Unit": "Count"},
+					{"Name": "Bytes", "Unit": "Bytes"}
+				]
+			}]
+		},
+		"app": "api",
+		"env": "prod",
+		"Puts": 3,
+		"Bytes": 1024
+	}`, string(data))
+}
+
+func TestEmfDocumentRenderNoDimensions(t *testing.T) {
+	d := &emfDocument{}
+	d.add("Puts", 1, "Count")
+
+	data, err := d.render(time.Unix(1621224088, 0))
+	require.NoError(t, err)
+
+	doc := struct {
+		Aws emfMetadata `json:"_aws"`
+	}{}
+	require.NoError(t, json.Unmarshal(data, &doc))
+	require.Equal(t, "FirehoseSplunkLambda", doc.Aws.CloudWatchMetrics[0].Namespace)
+	require.Equal(t, [][]string{{}}, doc.Aws.CloudWatchMetrics[0].Dimensions)
+}
+
+func TestHandleRequestEmitsEmf(t *testing.T) {
+	b := captureLogs(t)
+	withConfig(t, func(c *Config) {
+		c.MetricsFormat = metricsFormatEmf
+		c.EmfDimensions = map[string]string{"env": "prod"}
+	})
+	withFakeAPIs(t)
+	withFakeClock(t)
+	countMetric("RetryableErrors", 2, "Count")
+
+	_, err := HandleRequest(context.Background(), Event{
+		InvocationId:      "invocation",
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "a", Message: "ok"}},
+			})},
+		},
+	})
+	require.NoError(t, err)
+	require.NotContains(t, b.String(), "metric ")
+
+	var line string
+	for _, l := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(l, "{") {
+			require.Empty(t, line, "more than one EMF line")
+			line = l
+		}
+	}
+	require.NotEmpty(t, line)
+
+	doc := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(line), &doc))
+	require.Equal(t, "prod", doc["env"])
+	require.Equal(t, "invocation", doc["correlationId"])
+	require.Equal(t, float64(2), doc["RetryableErrors"])
+	require.Equal(t, float64(0), doc["DroppedRecords.size_limit"])
+	require.Equal(t, float64(1), doc["Records"])
+	require.Equal(t, float64(1), doc["OkRecords"])
+	require.Equal(t, float64(0), doc["FailedRecords"])
+
+	aws := doc["_aws"].(map[string]interface{})
+	require.Equal(t, float64(1621224088000), aws["Timestamp"])
+	directive := aws["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, "FirehoseSplunkLambda", directive["Namespace"])
+	require.Equal(t, []interface{}{[]interface{}{"env"}}, directive["Dimensions"])
+
+	names := []string{}
+	for _, m := range directive["Metrics"].([]interface{}) {
+		names = append(names, m.(map[string]interface{})["Name"].(string))
+	}
+	require.Contains(t, names, "EstimatedCost")
+	require.Contains(t, names, "RetryableErrors")
+	for _, name := range names {
+		require.Contains(t, doc, name)
+	}
+}
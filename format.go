@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	outputFormatRaw       = "raw"
+	outputFormatHec       = "hec"
+	outputFormatCwl       = "cwl"
+	outputFormatJsonField = "json-field"
+	outputFormatKv        = "kv"
+	outputFormatFlowLog   = "flow-log"
+	outputFormatRawParsed = "raw-parsed"
+)
+
+// kvPair matches a key=value pair, whose value may be double quoted.
+var kvPair = regexp.MustCompile(`(?:^|\s)([\w.-]+)=("(?:[^"\\]|\\.)*"|\S*)`)
+
+// flowLogFields are the fields of a VPC flow log record in the default
+// (version 2) format.
+var flowLogFields = []string{
+	"version", "account-id", "interface-id", "srcaddr", "dstaddr", "srcport",
+	"dstport", "protocol", "packets", "bytes", "start", "end", "action",
+	"log-status",
+}
+
+// outputFormatFor returns the output format for events from logGroup. An
+// exact match in LogGroupFormats wins, then the longest matching prefix
+// pattern (one ending in "*"), then the default OutputFormat.
+func outputFormatFor(logGroup string) string {
+	if f, ok := matchLogGroup(config.LogGroupFormats, logGroup); ok {
+		return f
+	}
+	return config.OutputFormat
+}
+
+// matchLogGroup returns the value in m for logGroup: that of its name, or
+// else that of the longest prefix ending in "*" that it starts with.
+func matchLogGroup(m map[string]string, logGroup string) (string, bool) {
+	if v, ok := m[logGroup]; ok {
+		return v, true
+	}
+
+	value, matched, found := "", 0, false
+	for pattern, v := range m {
+		if !strings.HasSuffix(pattern, "*") {
+			continue
+		}
+
+		prefix := strings.TrimSuffix(pattern, "*")
+		if strings.HasPrefix(logGroup, prefix) && (!found || len(prefix) > matched) {
+			value, matched, found = v, len(prefix), true
+		}
+	}
+
+	return value, found
+}
+
+// formatJsonField returns the JsonField field of a JSON message, or the
+// message as is if it isn't JSON or doesn't have that field.
+func formatJsonField(message string) string {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(message), &fields); err != nil {
+		return message
+	}
+
+	v, ok := fields[config.JsonField]
+	if !ok {
+		return message
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return message
+	}
+	return string(data)
+}
+
+// formatKv renders the message and its metadata as key=value pairs.
+func formatKv(m *Message, l LogEvent, message string) string {
+	return fmt.Sprintf(
+		"timestamp=%d log_group=%s log_stream=%s message=%s",
+		l.Timestamp, strconv.Quote(m.LogGroup), strconv.Quote(m.LogStream), strconv.Quote(message),
+	)
+}
+
+// flowLogFormatField matches a field of a VPC flow log format, such as
+// "${srcaddr}".
+var flowLogFormatField = regexp.MustCompile(`^\$\{([a-z0-9-]+)\}$`)
+
+// envFlowLogFormat parses a custom VPC flow log format, as given when
+// creating the flow log, into its field names. It returns nil if there is
+// none or it is invalid.
+func envFlowLogFormat(key string) []string {
+	v, ok := os.LookupEnv(key)
+	if !ok || strings.TrimSpace(v) == "" {
+		return nil
+	}
+
+	fields := []string{}
+	for _, f := range strings.Fields(v) {
+		match := flowLogFormatField.FindStringSubmatch(f)
+		if match == nil {
+			warnf("Invalid value %q for %s, ignoring it. %q is not a field like ${srcaddr}\n", v, key, f)
+			return nil
+		}
+		fields = append(fields, match[1])
+	}
+
+	return fields
+}
+
+// parseFlowLog returns the values of a VPC flow log record by field name,
+// or nil if the message isn't one. The fields are those of
+// config.FlowLogFormat, or else of the default format.
+func parseFlowLog(message string) map[string]string {
+	fields := config.FlowLogFormat
+	if len(fields) == 0 {
+		fields = flowLogFields
+	}
+
+	values := strings.Fields(message)
+	if len(values) != len(fields) {
+		return nil
+	}
+
+	record := map[string]string{}
+	for i, f := range fields {
+		record[f] = values[i]
+	}
+	return record
+}
+
+// formatFlowLog renders a VPC flow log record as a JSON object keyed by
+// field name. Messages that aren't flow log records are returned as is.
+func formatFlowLog(message string) (string, error) {
+	record := parseFlowLog(message)
+	if record == nil {
+		return message, nil
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// parseMessage returns the fields of a message: those of a JSON object, the
+// values of a VPC flow log record, or else its key=value pairs. It returns
+// nil for messages that are none of these.
+func parseMessage(message string) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(message), &fields); err == nil {
+		return fields
+	}
+
+	if record := parseFlowLog(message); record != nil {
+		for k, v := range record {
+			fields[k] = v
+		}
+		return fields
+	}
+
+	for _, match := range kvPair.FindAllStringSubmatch(message, -1) {
+		v := match[2]
+		if unquoted, err := strconv.Unquote(v); err == nil && strings.HasPrefix(v, `"`) {
+			v = unquoted
+		}
+		fields[match[1]] = v
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// formatRawParsed renders the message as a JSON object of the message as is
+// and its fields as parsed by parseMessage, for checking the parsing of
+// messages before relying on it.
+func formatRawParsed(message string) (string, error) {
+	data, err := json.Marshal(struct {
+		Raw    string                 `json:"raw"`
+		Parsed map[string]interface{} `json:"parsed"`
+	}{
+		Raw:    message,
+		Parsed: parseMessage(message),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// formatTags renders tags as space separated key=value pairs, sorted by key.
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+tags[k])
+	}
+
+	return strings.Join(pairs, " ")
+}
+
+// formatLogEvent renders a transformed log event message in the output
+// format configured for the message's log group.
+func formatLogEvent(m *Message, l LogEvent, meta eventMeta, message string) (string, error) {
+	if line, ok := formatStatsd(message); ok {
+		return line, nil
+	}
+
+	format := outputFormatFor(m.LogGroup)
+	if format == outputFormatHec {
+		data, err := json.Marshal(newHecEvent(m, l, meta, message))
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+
+	var out string
+	var err error
+	switch format {
+	case outputFormatJsonField:
+		out = formatJsonField(message)
+	case outputFormatKv:
+		out = formatKv(m, l, message)
+	case outputFormatFlowLog:
+		out, err = formatFlowLog(message)
+	case outputFormatRawParsed:
+		out, err = formatRawParsed(message)
+	case outputFormatTemplate:
+		out = formatTemplate(m, l, meta, message)
+	default:
+		out = message
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if config.IncludeOrderingIndex {
+		out = fmt.Sprintf("record_index=%d event_index=%d %s", meta.recordIndex, meta.eventIndex, out)
+	}
+	if len(config.EnrichTags) > 0 {
+		out += " " + formatTags(config.EnrichTags)
+	}
+	if config.TimestampPrefix {
+		// Leading, where Splunk looks for a timestamp.
+		out = l.time().Format(config.TimestampLayout) + " " + out
+	}
+
+	return out, nil
+}
+
+// formatEvents formats events of m that aren't CWL log events, such as those
+// of CloudTrail log files, the way formatLogEvent does log events, one per
+// line. They skip the transform pipeline, but not redaction. Those without a
+// timestamp of their own are given the arrival time of their record.
+func formatEvents(m *Message, events []LogEvent, meta eventMeta) (string, error) {
+	b := strings.Builder{}
+	for idx, l := range events {
+		meta.eventIndex = idx
+		if l.Timestamp == 0 {
+			l.Timestamp = meta.record.ApproximateArrivalTimestamp
+		}
+
+		out, err := formatLogEvent(m, l, meta, redact(l.Message))
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(out)
+		b.WriteString("\n")
+	}
+
+	return b.String(), nil
+}
+
+// compactJson returns data, which is valid JSON, as compact JSON, so it takes
+// up a single line.
+func compactJson(data json.RawMessage) string {
+	b := &bytes.Buffer{}
+	if err := json.Compact(b, data); err != nil {
+		return string(data)
+	}
+
+	return b.String()
+}
+
+// recordHeaderLine is the line config.RecordHeader is prepended to the data
+// of every output record as.
+func recordHeaderLine() string {
+	return config.RecordHeader + "\n"
+}
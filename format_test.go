@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutputFormatFor(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.OutputFormat = outputFormatRaw
+		c.LogGroupFormats = map[string]string{
+			"/aws/lambda/*":        outputFormatJsonField,
+			"/aws/lambda/special*": outputFormatKv,
+			"/aws/lambda/exact":    outputFormatHec,
+			"DataLog":              outputFormatFlowLog,
+		}
+	})
+
+	for logGroup, expected := range map[string]string{
+		"/aws/lambda/exact":     outputFormatHec,
+		"/aws/lambda/other":     outputFormatJsonField,
+		"/aws/lambda/special-1": outputFormatKv,
+		"DataLog":               outputFormatFlowLog,
+		"DataLog2":              outputFormatRaw,
+		"":                      outputFormatRaw,
+	} {
+		require.Equal(t, expected, outputFormatFor(logGroup), logGroup)
+	}
+}
+
+func TestFormatLogEventRaw(t *testing.T) {
+	m := &Message{Owner: "1234567890"}
+
+	out, err := formatLogEvent(m, LogEvent{}, eventMeta{}, "hello")
+	require.NoError(t, err)
+	require.Equal(t, "hello", out)
+}
+
+func TestFormatJsonField(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.JsonField = "msg"
+	})
+
+	require.Equal(t, "hello", formatJsonField(`{"level":"info","msg":"hello"}`))
+	require.Equal(t, `{"a":1}`, formatJsonField(`{"msg":{"a":1}}`))
+	require.Equal(t, `{"level":"info"}`, formatJsonField(`{"level":"info"}`))
+	require.Equal(t, "not json", formatJsonField("not json"))
+}
+
+func TestFormatKv(t *testing.T) {
+	m := &Message{LogGroup: "group", LogStream: "stream"}
+	l := LogEvent{Timestamp: 1621224088000}
+
+	require.Equal(
+		t,
+		`timestamp=1621224088000 log_group="group" log_stream="stream" message="say \"hi\""`,
+		formatKv(m, l, `say "hi"`),
+	)
+}
+
+func TestFormatFlowLog(t *testing.T) {
+	out, err := formatFlowLog("2 1234567890 eni-0abcedf0987654321 10.11.1.231 10.11.2.128 30036 9954 6 5 503 1621224044 1623324097 ACCEPT OK")
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"version": "2",
+		"account-id": "1234567890",
+		"interface-id": "eni-0abcedf0987654321",
+		"srcaddr": "10.11.1.231",
+		"dstaddr": "10.11.2.128",
+		"srcport": "30036",
+		"dstport": "9954",
+		"protocol": "6",
+		"packets": "5",
+		"bytes": "503",
+		"start": "1621224044",
+		"end": "1623324097",
+		"action": "ACCEPT",
+		"log-status": "OK"
+	}`, out)
+
+	out, err = formatFlowLog("not a flow log")
+	require.NoError(t, err)
+	require.Equal(t, "not a flow log", out)
+}
+
+func TestFormatFlowLogCustomFormat(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.FlowLogFormat = []string{"version", "vpc-id", "srcaddr", "dstaddr", "action", "tcp-flags"}
+	})
+
+	out, err := formatFlowLog("5 vpc-0a1b2c3d 10.11.1.231 10.11.2.128 REJECT 2")
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"version": "5",
+		"vpc-id": "vpc-0a1b2c3d",
+		"srcaddr": "10.11.1.231",
+		"dstaddr": "10.11.2.128",
+		"action": "REJECT",
+		"tcp-flags": "2"
+	}`, out)
+
+	// Records in the default format don't match a custom one.
+	message := "2 1234567890 eni-0abcedf0987654321 10.11.1.231 10.11.2.128 30036 9954 6 5 503 1621224044 1623324097 ACCEPT OK"
+	out, err = formatFlowLog(message)
+	require.NoError(t, err)
+	require.Equal(t, message, out)
+}
+
+func TestEnvFlowLogFormat(t *testing.T) {
+	captureLogs(t)
+
+	for _, tc := range []struct {
+		value    string
+		expected []string
+	}{
+		{value: "", expected: nil},
+		{value: "${version} ${vpc-id}  ${pkt-srcaddr}", expected: []string{"version", "vpc-id", "pkt-srcaddr"}},
+		{value: "${version} srcaddr", expected: nil},
+		{value: "${version ${srcaddr}", expected: nil},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			t.Setenv("TEST_FLOW_LOG_FORMAT", tc.value)
+			require.Equal(t, tc.expected, envFlowLogFormat("TEST_FLOW_LOG_FORMAT"))
+		})
+	}
+}
+
+func TestFormatRawParsed(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		message  string
+		expected string
+	}{
+		{
+			name:     "json",
+			message:  `{"level":"info","count":3}`,
+			expected: `{"raw":"{\"level\":\"info\",\"count\":3}","parsed":{"level":"info","count":3}}`,
+		},
+		{
+			name:    "flow log",
+			message: "2 1234567890 eni-0abcedf0987654321 10.11.1.231 10.11.2.128 30036 9954 6 5 503 1621224044 1623324097 ACCEPT OK",
+			expected: `{
+				"raw": "2 1234567890 eni-0abcedf0987654321 10.11.1.231 10.11.2.128 30036 9954 6 5 503 1621224044 1623324097 ACCEPT OK",
+				"parsed": {
+					"version": "2",
+					"account-id": "1234567890",
+					"interface-id": "eni-0abcedf0987654321",
+					"srcaddr": "10.11.1.231",
+					"dstaddr": "10.11.2.128",
+					"srcport": "30036",
+					"dstport": "9954",
+					"protocol": "6",
+					"packets": "5",
+					"bytes": "503",
+					"start": "1621224044",
+					"end": "1623324097",
+					"action": "ACCEPT",
+					"log-status": "OK"
+				}
+			}`,
+		},
+		{
+			name:     "key=value",
+			message:  `GET /index.html status=200 user.name="Jane \"JD\" Doe" empty= ignored`,
+			expected: `{"raw":"GET /index.html status=200 user.name=\"Jane \\\"JD\\\" Doe\" empty= ignored","parsed":{"status":"200","user.name":"Jane \"JD\" Doe","empty":""}}`,
+		},
+		{
+			name:     "unparsable",
+			message:  "plain text",
+			expected: `{"raw":"plain text","parsed":null}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := formatRawParsed(tc.message)
+			require.NoError(t, err)
+			require.JSONEq(t, tc.expected, out)
+		})
+	}
+}
+
+func TestFormatLogEventRawParsed(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.LogGroupFormats = map[string]string{"app": outputFormatRawParsed}
+	})
+
+	out, err := formatLogEvent(&Message{LogGroup: "app"}, LogEvent{}, eventMeta{}, "status=200")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"raw":"status=200","parsed":{"status":"200"}}`, out)
+
+	out, err = formatLogEvent(&Message{LogGroup: "other"}, LogEvent{}, eventMeta{}, "status=200")
+	require.NoError(t, err)
+	require.Equal(t, "status=200", out)
+}
+
+func TestTransformRecordsLogGroupFormats(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.OutputFormat = outputFormatRaw
+		c.JsonField = "msg"
+		c.LogGroupFormats = map[string]string{
+			"/aws/lambda/*": outputFormatJsonField,
+			"app":           outputFormatKv,
+			"vpc":           outputFormatFlowLog,
+		}
+	})
+
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogGroup:    "/aws/lambda/fn",
+				LogEvents:   []LogEvent{{Id: "a", Message: `{"msg":"from lambda"}`}},
+			})},
+			{RecordId: "2", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogGroup:    "app",
+				LogStream:   "s",
+				LogEvents:   []LogEvent{{Id: "b", Timestamp: 5, Message: "from app"}},
+			})},
+			{RecordId: "3", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogGroup:    "vpc",
+				LogEvents:   []LogEvent{{Id: "c", Message: "2 1 eni-1 10.0.0.1 10.0.0.2 1 2 6 1 40 1 2 ACCEPT OK"}},
+			})},
+			{RecordId: "4", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogGroup:    "other",
+				LogEvents:   []LogEvent{{Id: "d", Message: `{"msg":"untouched"}`}},
+			})},
+		},
+	}
+
+	resultRecords, _ := transformRecords(e, &Stats{})
+	require.Len(t, resultRecords, 4)
+
+	outputs := []string{}
+	for _, r := range resultRecords {
+		require.Equal(t, resultStatusOk, r.Result)
+		data, err := base64.StdEncoding.DecodeString(r.Data)
+		require.NoError(t, err)
+		outputs = append(outputs, string(data))
+	}
+
+	require.Equal(t, "from lambda\n", outputs[0])
+	require.Equal(t, `timestamp=5 log_group="app" log_stream="s" message="from app"`+"\n", outputs[1])
+	require.Contains(t, outputs[2], `"interface-id":"eni-1"`)
+	require.Equal(t, `{"msg":"untouched"}`+"\n", outputs[3])
+}
+
+func TestTransformRecordsOrderingIndex(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.IncludeOrderingIndex = true
+	})
+
+	e := Event{}
+	for i := 0; i < 3; i++ {
+		e.Records = append(e.Records, EventRecord{
+			RecordId: strconv.Itoa(i),
+			Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents: []LogEvent{
+					{Id: "a", Message: "first"},
+					{Id: "b", Message: "second"},
+				},
+			}),
+		})
+	}
+
+	resultRecords, _ := transformRecords(e, &Stats{})
+	require.Len(t, resultRecords, 3)
+
+	for i, r := range resultRecords {
+		data, err := base64.StdEncoding.DecodeString(r.Data)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf(
+			"record_index=%d event_index=0 first\nrecord_index=%d event_index=1 second\n", i, i,
+		), string(data))
+	}
+}
+
+func TestFormatLogEventTimestampPrefix(t *testing.T) {
+	l := LogEvent{Timestamp: 1621224132233}
+
+	for _, tc := range []struct {
+		name     string
+		layout   string
+		location *time.Location
+		format   string
+		expected string
+	}{
+		{
+			name:     "default",
+			layout:   iso8601Milliseconds,
+			location: time.UTC,
+			format:   outputFormatRaw,
+			expected: "2021-05-17T04:02:12.233Z hello",
+		},
+		{
+			name:     "local time zone is ignored",
+			layout:   iso8601Milliseconds,
+			location: time.FixedZone("UTC+10", 10*60*60),
+			format:   outputFormatRaw,
+			expected: "2021-05-17T04:02:12.233Z hello",
+		},
+		{
+			name:     "negative offset time zone is ignored",
+			layout:   iso8601Milliseconds,
+			location: time.FixedZone("UTC-7", -7*60*60),
+			format:   outputFormatRaw,
+			expected: "2021-05-17T04:02:12.233Z hello",
+		},
+		{
+			name:     "layout override",
+			layout:   "Jan _2 15:04:05",
+			location: time.UTC,
+			format:   outputFormatRaw,
+			expected: "May 17 04:02:12 hello",
+		},
+		{
+			name:     "kv",
+			layout:   time.RFC3339,
+			location: time.UTC,
+			format:   outputFormatKv,
+			expected: `2021-05-17T04:02:12Z timestamp=1621224132233 log_group="" log_stream="" message="hello"`,
+		},
+		{
+			name:     "hec",
+			layout:   iso8601Milliseconds,
+			location: time.UTC,
+			format:   outputFormatHec,
+			expected: `{"time":1621224132.233,"sourcetype":"aws:cloudwatchlogs","event":"hello"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			local := time.Local
+			t.Cleanup(func() {
+				time.Local = local
+			})
+			time.Local = tc.location
+
+			withConfig(t, func(c *Config) {
+				c.OutputFormat = tc.format
+				c.TimestampPrefix = true
+				c.TimestampLayout = tc.layout
+			})
+
+			out, err := formatLogEvent(&Message{}, l, eventMeta{}, "hello")
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, out)
+		})
+	}
+}
+
+func TestFormatLogEventTimestampPrefixWithOrderingIndex(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.IncludeOrderingIndex = true
+		c.TimestampPrefix = true
+		c.TimestampLayout = iso8601Milliseconds
+	})
+
+	out, err := formatLogEvent(&Message{}, LogEvent{Timestamp: 0}, eventMeta{recordIndex: 1, eventIndex: 2}, "hello")
+	require.NoError(t, err)
+	require.Equal(t, "1970-01-01T00:00:00.000Z record_index=1 event_index=2 hello", out)
+}
+
+func TestFormatLogEventEnrichTags(t *testing.T) {
+	for _, tc := range []struct {
+		format   string
+		expected string
+	}{
+		{
+			format:   outputFormatRaw,
+			expected: "hello env=prod team=platform",
+		},
+		{
+			format:   outputFormatKv,
+			expected: `timestamp=0 log_group="" log_stream="" message="hello" env=prod team=platform`,
+		},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.OutputFormat = tc.format
+				c.EnrichTags = map[string]string{"team": "platform", "env": "prod"}
+			})
+
+			out, err := formatLogEvent(&Message{}, LogEvent{}, eventMeta{}, "hello")
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, out)
+		})
+	}
+}
+
+func TestFormatTags(t *testing.T) {
+	require.Equal(t, "", formatTags(map[string]string{}))
+	require.Equal(t, "a=1 b=2 c=3", formatTags(map[string]string{"c": "3", "a": "1", "b": "2"}))
+}
+
+func TestTransformRecordsTrailingNewline(t *testing.T) {
+	m := Message{
+		MessageType: dataMessage,
+		LogGroup:    "DataLog",
+		LogEvents: []LogEvent{
+			{Id: "a", Timestamp: 1, Message: "first"},
+			{Id: "b", Timestamp: 2, Message: "second"},
+		},
+	}
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, m)},
+		},
+	}
+
+	for _, format := range []string{outputFormatRaw, outputFormatHec, outputFormatKv, outputFormatCwl} {
+		for _, trailingNewline := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s-%t", format, trailingNewline), func(t *testing.T) {
+				withConfig(t, func(c *Config) {
+					c.OutputFormat = format
+					c.TrailingNewline = trailingNewline
+				})
+
+				resultRecords, _ := transformRecords(e, &Stats{})
+				data, err := base64.StdEncoding.DecodeString(resultRecords[0].Data)
+				require.NoError(t, err)
+
+				lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+				if format == outputFormatCwl {
+					require.Len(t, lines, 1)
+				} else {
+					require.Len(t, lines, 2)
+				}
+				for _, line := range lines {
+					require.NotEmpty(t, line)
+				}
+
+				require.Equal(t, trailingNewline, strings.HasSuffix(string(data), "\n"))
+			})
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+// The EventRecord metadata that can be passed through to HEC fields.
+const (
+	hecRecordFieldRecordId         = "record_id"
+	hecRecordFieldArrivalTimestamp = "arrival_timestamp" // in milliseconds
+	hecRecordFieldPartitionKey     = "partition_key"
+)
+
+// The precisions the time of HEC events can be given in.
+const (
+	hecTimePrecisionMilliseconds = "milliseconds"
+	hecTimePrecisionSeconds      = "seconds"
+)
+
+// HecEvent is an event in the Splunk HTTP Event Collector (HEC) format.
+type HecEvent struct {
+	Time       float64                `json:"time,omitempty"` // in seconds
+	Host       string                 `json:"host,omitempty"`
+	Source     string                 `json:"source,omitempty"`
+	Sourcetype string                 `json:"sourcetype,omitempty"`
+	Index      string                 `json:"index,omitempty"`
+	Event      string                 `json:"event"`
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+}
+
+// newHecEvent wraps the transformed message of log event l from m in a
+// HecEvent. The host is the account that owns the log group and the source is
+// the log group and stream, so events can be searched by where they came from.
+// The sourcetype and index are routed by log group, see hecSourcetypeFor and
+// LogGroupIndexes.
+func newHecEvent(m *Message, l LogEvent, meta eventMeta, message string) HecEvent {
+	h := HecEvent{
+		Time:       hecTime(l.Timestamp),
+		Host:       m.Owner,
+		Source:     hecSource(m),
+		Sourcetype: hecSourcetypeFor(m.LogGroup),
+		Event:      message,
+	}
+	if index, ok := matchLogGroup(config.LogGroupIndexes, m.LogGroup); ok {
+		h.Index = index
+	}
+
+	fields := map[string]interface{}{}
+	if config.HecIncludeAccountId && m.Owner != "" {
+		fields["aws_account_id"] = m.Owner
+	}
+	if config.IncludeOrderingIndex {
+		fields["record_index"] = meta.recordIndex
+		fields["event_index"] = meta.eventIndex
+	}
+	for _, f := range config.HecRecordFields {
+		switch f {
+		case hecRecordFieldRecordId:
+			fields[f] = meta.record.RecordId
+		case hecRecordFieldArrivalTimestamp:
+			fields[f] = meta.record.ApproximateArrivalTimestamp
+		case hecRecordFieldPartitionKey:
+			if k := meta.record.KinesisMetadata.PartitionKey; k != "" {
+				fields[f] = k
+			}
+		}
+	}
+	for k, v := range config.EnrichTags {
+		// Tags are only defaults; they never replace the fields above.
+		if _, ok := fields[k]; !ok {
+			fields[k] = v
+		}
+	}
+	if len(fields) > 0 {
+		h.Fields = fields
+	}
+
+	return h
+}
+
+// hecTime converts a log event timestamp, in milliseconds since the epoch,
+// to the seconds of a HEC event time, truncated to whole seconds with
+// config.HecTimePrecision "seconds".
+func hecTime(timestamp int) float64 {
+	t := millisecondsToTime(timestamp)
+	if config.HecTimePrecision == hecTimePrecisionSeconds {
+		return float64(t.Unix())
+	}
+	return float64(t.UnixMilli()) / 1000
+}
+
+// hecSourcetypeFor returns the HEC sourcetype for events from logGroup: its
+// match in LogGroupSourcetypes, or else the default HecSourcetype.
+func hecSourcetypeFor(logGroup string) string {
+	if s, ok := matchLogGroup(config.LogGroupSourcetypes, logGroup); ok {
+		return s
+	}
+	return config.HecSourcetype
+}
+
+// hecSource returns the HEC source of the log events in m:
+// "<log group>:<log stream>".
+func hecSource(m *Message) string {
+	if m.LogStream == "" {
+		return m.LogGroup
+	}
+	return m.LogGroup + ":" + m.LogStream
+}
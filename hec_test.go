@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatLogEventHecAccountId(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		hecIncludeAccountId bool
+		expected            string
+	}{
+		{
+			name:                "enabled",
+			hecIncludeAccountId: true,
+			expected:            `{"host":"1234567890","sourcetype":"aws:cloudwatchlogs","event":"hello","fields":{"aws_account_id":"1234567890"}}`,
+		},
+		{
+			name:                "disabled",
+			hecIncludeAccountId: false,
+			expected:            `{"host":"1234567890","sourcetype":"aws:cloudwatchlogs","event":"hello"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.OutputFormat = outputFormatHec
+				c.HecIncludeAccountId = tc.hecIncludeAccountId
+			})
+
+			out, err := formatLogEvent(&Message{Owner: "1234567890"}, LogEvent{}, eventMeta{}, "hello")
+			require.NoError(t, err)
+			require.JSONEq(t, tc.expected, out)
+		})
+	}
+}
+
+func TestFormatLogEventHecOrderingIndex(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.OutputFormat = outputFormatHec
+		c.IncludeOrderingIndex = true
+	})
+
+	out, err := formatLogEvent(&Message{}, LogEvent{}, eventMeta{recordIndex: 3, eventIndex: 7}, "hello")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"sourcetype":"aws:cloudwatchlogs","event":"hello","fields":{"record_index":3,"event_index":7}}`, out)
+}
+
+func TestFormatLogEventHecRecordFields(t *testing.T) {
+	record := EventRecord{
+		RecordId:                    "49546986683135544286507457936321625675700192471156785154",
+		ApproximateArrivalTimestamp: 1621224132233,
+		KinesisMetadata:             KinesisRecordMetadata{PartitionKey: "key"},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		fields   []string
+		record   EventRecord
+		expected map[string]interface{}
+	}{
+		{
+			name:   "all",
+			fields: []string{"record_id", "arrival_timestamp", "partition_key"},
+			record: record,
+			expected: map[string]interface{}{
+				"record_id":         record.RecordId,
+				"arrival_timestamp": float64(1621224132233),
+				"partition_key":     "key",
+			},
+		},
+		{
+			name:   "some",
+			fields: []string{"arrival_timestamp"},
+			record: record,
+			expected: map[string]interface{}{
+				"arrival_timestamp": float64(1621224132233),
+			},
+		},
+		{
+			name:   "no partition key",
+			fields: []string{"record_id", "partition_key"},
+			record: EventRecord{RecordId: "1"},
+			expected: map[string]interface{}{
+				"record_id": "1",
+			},
+		},
+		{
+			name:   "unknown",
+			fields: []string{"nope"},
+			record: record,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.OutputFormat = outputFormatHec
+				c.HecRecordFields = tc.fields
+			})
+
+			out, err := formatLogEvent(&Message{}, LogEvent{}, eventMeta{record: tc.record}, "hello")
+			require.NoError(t, err)
+
+			h := struct {
+				Event  string                 `json:"event"`
+				Fields map[string]interface{} `json:"fields"`
+			}{}
+			require.NoError(t, json.Unmarshal([]byte(out), &h))
+			require.Equal(t, "hello", h.Event)
+			require.Equal(t, tc.expected, h.Fields)
+		})
+	}
+}
+
+func TestFormatLogEventHecEnrichTags(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.OutputFormat = outputFormatHec
+		c.HecIncludeAccountId = true
+		c.EnrichTags = map[string]string{
+			"env":            "prod",
+			"team":           "platform",
+			"aws_account_id": "not-this-one",
+		}
+	})
+
+	out, err := formatLogEvent(&Message{Owner: "1234567890"}, LogEvent{}, eventMeta{}, "hello")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"host":"1234567890","sourcetype":"aws:cloudwatchlogs","event":"hello","fields":{"env":"prod","team":"platform","aws_account_id":"1234567890"}}`, out)
+}
+
+func TestFormatLogEventHecEnvelope(t *testing.T) {
+	m := &Message{
+		Owner:     "1234567890",
+		LogGroup:  "/aws/lambda/app",
+		LogStream: "2021/05/17/[$LATEST]abc",
+	}
+
+	for _, tc := range []struct {
+		name       string
+		message    *Message
+		sourcetype string
+		expected   string
+	}{
+		{
+			name:       "full",
+			message:    m,
+			sourcetype: "aws:cloudwatchlogs",
+			expected:   `{"time":1621224132.233,"host":"1234567890","source":"/aws/lambda/app:2021/05/17/[$LATEST]abc","sourcetype":"aws:cloudwatchlogs","event":"hello"}`,
+		},
+		{
+			name:       "no log stream",
+			message:    &Message{Owner: "1234567890", LogGroup: "/aws/lambda/app"},
+			sourcetype: "aws:lambda",
+			expected:   `{"time":1621224132.233,"host":"1234567890","source":"/aws/lambda/app","sourcetype":"aws:lambda","event":"hello"}`,
+		},
+		{
+			name:     "no sourcetype",
+			message:  m,
+			expected: `{"time":1621224132.233,"host":"1234567890","source":"/aws/lambda/app:2021/05/17/[$LATEST]abc","event":"hello"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.OutputFormat = outputFormatHec
+				c.HecSourcetype = tc.sourcetype
+			})
+
+			out, err := formatLogEvent(tc.message, LogEvent{Timestamp: 1621224132233}, eventMeta{}, "hello")
+			require.NoError(t, err)
+			require.JSONEq(t, tc.expected, out)
+		})
+	}
+}
+
+func TestFormatLogEventHecTime(t *testing.T) {
+	for _, tc := range []struct {
+		precision string
+		timestamp int
+		expected  string
+	}{
+		{precision: hecTimePrecisionMilliseconds, timestamp: 1621224132233, expected: `{"time":1621224132.233,"event":"hello"}`},
+		{precision: hecTimePrecisionSeconds, timestamp: 1621224132233, expected: `{"time":1621224132,"event":"hello"}`},
+		// Without a timestamp, Splunk uses the time it indexes the event at.
+		{precision: hecTimePrecisionMilliseconds, timestamp: 0, expected: `{"event":"hello"}`},
+	} {
+		t.Run(fmt.Sprintf("%s %d", tc.precision, tc.timestamp), func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.OutputFormat = outputFormatHec
+				c.HecSourcetype = ""
+				c.HecTimePrecision = tc.precision
+			})
+
+			out, err := formatLogEvent(&Message{}, LogEvent{Timestamp: tc.timestamp}, eventMeta{}, "hello")
+			require.NoError(t, err)
+			require.JSONEq(t, tc.expected, out)
+		})
+	}
+}
+
+func TestFormatLogEventHecRouting(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.OutputFormat = outputFormatHec
+		c.HecSourcetype = "aws:cloudwatchlogs"
+		c.LogGroupSourcetypes = map[string]string{
+			"/aws/lambda/*":     "aws:lambda",
+			"/aws/lambda/api-*": "aws:lambda:api",
+			"DataLog":           "aws:vpcflow",
+		}
+		c.LogGroupIndexes = map[string]string{
+			"/aws/lambda/*": "lambda",
+			"DataLog":       "network",
+		}
+	})
+
+	for _, tc := range []struct {
+		logGroup   string
+		sourcetype string
+		index      string
+	}{
+		{logGroup: "/aws/lambda/app", sourcetype: "aws:lambda", index: "lambda"},
+		{logGroup: "/aws/lambda/api-gateway", sourcetype: "aws:lambda:api", index: "lambda"},
+		{logGroup: "DataLog", sourcetype: "aws:vpcflow", index: "network"},
+		{logGroup: "/aws/rds/db", sourcetype: "aws:cloudwatchlogs"},
+	} {
+		t.Run(tc.logGroup, func(t *testing.T) {
+			out, err := formatLogEvent(&Message{LogGroup: tc.logGroup}, LogEvent{}, eventMeta{}, "hello")
+			require.NoError(t, err)
+
+			var h HecEvent
+			require.NoError(t, json.Unmarshal([]byte(out), &h))
+			require.Equal(t, tc.sourcetype, h.Sourcetype)
+			require.Equal(t, tc.index, h.Index)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the buckets of a latencyHistogram.
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// latencyHistogram counts durations by the first of latencyBuckets they
+// are within, or as over all of them.
+type latencyHistogram struct {
+	// Counts has a count per bucket, and one more for durations over all
+	// of them.
+	Counts []int
+	Max    time.Duration
+}
+
+// observe counts a duration.
+func (h *latencyHistogram) observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]int, len(latencyBuckets)+1)
+	}
+
+	idx := len(latencyBuckets)
+	for i, b := range latencyBuckets {
+		if d <= b {
+			idx = i
+			break
+		}
+	}
+	h.Counts[idx]++
+
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+// emit emits the count of every bucket as name.le_<bound>, the count of
+// durations over all of them as name.le_inf, and the longest duration in
+// milliseconds as name.max.
+func (h *latencyHistogram) emit(emit func(name string, value float64, unit string), name string) {
+	for i, b := range latencyBuckets {
+		emit(name+".le_"+b.String(), float64(h.count(i)), "Count")
+	}
+	emit(name+".le_inf", float64(h.count(len(latencyBuckets))), "Count")
+	emit(name+".max", float64(h.Max)/float64(time.Millisecond), "Milliseconds")
+}
+
+func (h *latencyHistogram) count(idx int) int {
+	if h.Counts == nil {
+		return 0
+	}
+	return h.Counts[idx]
+}
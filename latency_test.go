@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogramObserve(t *testing.T) {
+	h := latencyHistogram{}
+	for _, d := range []time.Duration{
+		0,
+		time.Millisecond,
+		2 * time.Millisecond,
+		7 * time.Millisecond,
+		10 * time.Millisecond,
+		300 * time.Millisecond,
+		time.Second,
+		3 * time.Second,
+		time.Minute,
+	} {
+		h.observe(d)
+	}
+
+	require.Equal(t, []int{2, 1, 2, 0, 0, 1, 1, 2}, h.Counts)
+	require.Equal(t, time.Minute, h.Max)
+}
+
+func TestLatencyHistogramEmit(t *testing.T) {
+	b := captureLogs(t)
+
+	h := latencyHistogram{}
+	h.observe(3 * time.Millisecond)
+	h.observe(1500 * time.Millisecond)
+	h.emit(emitMetric, "RecordLatency")
+
+	require.Equal(t, ""+
+		"metric RecordLatency.le_1ms=0 unit=Count\n"+
+		"metric RecordLatency.le_5ms=1 unit=Count\n"+
+		"metric RecordLatency.le_10ms=0 unit=Count\n"+
+		"metric RecordLatency.le_50ms=0 unit=Count\n"+
+		"metric RecordLatency.le_100ms=0 unit=Count\n"+
+		"metric RecordLatency.le_500ms=0 unit=Count\n"+
+		"metric RecordLatency.le_1s=0 unit=Count\n"+
+		"metric RecordLatency.le_inf=1 unit=Count\n"+
+		"metric RecordLatency.max=1500 unit=Milliseconds\n",
+		b.String())
+
+	// Nothing observed.
+	b.Reset()
+	(&latencyHistogram{}).emit(emitMetric, "RecordLatency")
+	require.Contains(t, b.String(), "metric RecordLatency.le_inf=0 unit=Count\n")
+}
+
+func TestHandleRequestEmitsRecordLatency(t *testing.T) {
+	b := captureLogs(t)
+	withConfig(t, func(c *Config) {
+		c.EmitRecordLatency = true
+	})
+	withFakeAPIs(t)
+	// Every record takes the one step between reading the clock before and
+	// after transforming it.
+	withFakeClock(t).step = 20 * time.Millisecond
+
+	e := Event{DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog"}
+	for _, id := range []string{"1", "2", "3"} {
+		e.Records = append(e.Records, EventRecord{RecordId: id, Data: encodeMessage(t, Message{
+			MessageType: dataMessage,
+			LogEvents:   []LogEvent{{Id: id, Message: "m"}},
+		})})
+	}
+
+	_, stats, err := HandleRequestWithStats(context.Background(), e)
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 0, 0, 3, 0, 0, 0, 0}, stats.RecordLatency.Counts)
+	require.Equal(t, 20*time.Millisecond, stats.RecordLatency.Max)
+	require.Contains(t, b.String(), "metric RecordLatency.le_50ms=3 unit=Count\n")
+	require.Contains(t, b.String(), "metric RecordLatency.max=20 unit=Milliseconds\n")
+}
+
+func TestHandleRequestRecordLatencyDisabled(t *testing.T) {
+	b := captureLogs(t)
+	withFakeAPIs(t)
+
+	_, stats, err := HandleRequestWithStats(context.Background(), Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{MessageType: dataMessage})},
+		},
+	})
+	require.NoError(t, err)
+	require.Nil(t, stats.RecordLatency.Counts)
+	require.NotContains(t, b.String(), "RecordLatency")
+}
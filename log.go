@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// The log levels, from the most to the least verbose.
+const (
+	logLevelDebug = "debug"
+	logLevelInfo  = "info"
+	logLevelWarn  = "warn"
+	logLevelError = "error"
+)
+
+// logLevelRanks orders the log levels by verbosity.
+var logLevelRanks = map[string]int{
+	logLevelDebug: 0,
+	logLevelInfo:  1,
+	logLevelWarn:  2,
+	logLevelError: 3,
+}
+
+const (
+	logFormatText = "text"
+	logFormatJson = "json"
+)
+
+// logOutput is where log lines are written. It is swapped out in tests.
+var logOutput io.Writer = os.Stdout
+
+// correlationId ties together all log lines of one invocation. It is set at
+// the start of every invocation; Lambda never runs two invocations in the
+// same container at once.
+var correlationId string
+
+// invocationLog is the context of the current invocation added to JSON log
+// lines, set along with correlationId.
+var invocationLog struct {
+	DeliveryStreamArn string
+	Records           int
+}
+
+// jsonLogLine is a log line in the JSON log format.
+type jsonLogLine struct {
+	Level             string `json:"level"`
+	CorrelationId     string `json:"correlationId,omitempty"`
+	DeliveryStreamArn string `json:"deliveryStreamArn,omitempty"`
+	Records           int    `json:"records,omitempty"`
+	Message           string `json:"message"`
+}
+
+// newCorrelationId builds a correlation id from the Lambda request id, when
+// there is one in ctx, and the Firehose invocation id.
+func newCorrelationId(ctx context.Context, e Event) string {
+	ids := []string{}
+
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+		ids = append(ids, lc.AwsRequestID)
+	}
+	if e.InvocationId != "" {
+		ids = append(ids, e.InvocationId)
+	}
+
+	return strings.Join(ids, "/")
+}
+
+// logf logs at the info level.
+func logf(format string, args ...interface{}) {
+	logAt(logLevelInfo, format, args...)
+}
+
+// debugf logs at the debug level, for detail only wanted when debugging.
+func debugf(format string, args ...interface{}) {
+	logAt(logLevelDebug, format, args...)
+}
+
+// warnf logs at the warn level, for problems that were worked around.
+func warnf(format string, args ...interface{}) {
+	logAt(logLevelWarn, format, args...)
+}
+
+// errorf logs at the error level, for records that could not be delivered.
+func errorf(format string, args ...interface{}) {
+	logAt(logLevelError, format, args...)
+}
+
+// outputf logs a line that is parsed downstream, such as a metric, so it is
+// written whatever config.LogLevel is.
+func outputf(format string, args ...interface{}) {
+	writeLog(logLevelInfo, fmt.Sprintf(format, args...))
+}
+
+// logAt logs at level, unless config.LogLevel is less verbose.
+func logAt(level string, format string, args ...interface{}) {
+	if logLevelRanks[level] < logLevelRanks[config.LogLevel] {
+		return
+	}
+
+	writeLog(level, fmt.Sprintf(format, args...))
+}
+
+// writeLog writes a log line in config.LogFormat. Text lines are prefixed
+// with the correlation id of the current invocation if there is one, and with
+// the level unless it is info.
+func writeLog(level string, message string) {
+	message = strings.TrimSuffix(message, "\n")
+
+	if config.LogFormat == logFormatJson {
+		data, err := json.Marshal(jsonLogLine{
+			Level:             level,
+			CorrelationId:     correlationId,
+			DeliveryStreamArn: invocationLog.DeliveryStreamArn,
+			Records:           invocationLog.Records,
+			Message:           message,
+		})
+		if err == nil {
+			fmt.Fprintf(logOutput, "%s\n", data)
+			return
+		}
+	}
+
+	line := message + "\n"
+	if level != logLevelInfo {
+		line = strings.ToUpper(level) + " " + line
+	}
+	if correlationId != "" {
+		line = fmt.Sprintf("correlationId=%s %s", correlationId, line)
+	}
+
+	fmt.Fprint(logOutput, line)
+}
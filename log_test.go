@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/require"
+)
+
+// captureLogs collects everything logged for the duration of a test. The
+// test starts without any metrics accumulated, so none leak in from other
+// tests.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	b := &bytes.Buffer{}
+
+	origOutput, origCorrelationId, origInvocationLog, origMetrics := logOutput, correlationId, invocationLog, metrics
+	t.Cleanup(func() {
+		logOutput, correlationId, invocationLog, metrics = origOutput, origCorrelationId, origInvocationLog, origMetrics
+	})
+	logOutput = b
+	metrics = &metricAccumulator{}
+
+	return b
+}
+
+func TestNewCorrelationId(t *testing.T) {
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{
+		AwsRequestID: "request-id",
+	})
+	e := Event{InvocationId: "invocation-id"}
+
+	require.Equal(t, "request-id/invocation-id", newCorrelationId(ctx, e))
+	require.Equal(t, "invocation-id", newCorrelationId(context.Background(), e))
+	require.Equal(t, "", newCorrelationId(context.Background(), Event{}))
+}
+
+func TestLogf(t *testing.T) {
+	b := captureLogs(t)
+
+	logf("no correlation id")
+	correlationId = "abc"
+	logf("hello %s\n", "world")
+
+	require.Equal(t, "no correlation id\ncorrelationId=abc hello world\n", b.String())
+}
+
+func TestLogLevels(t *testing.T) {
+	for _, tc := range []struct {
+		level    string
+		expected string
+	}{
+		{
+			level:    logLevelDebug,
+			expected: "DEBUG debug\ninfo\nWARN warn\nERROR error\noutput\n",
+		},
+		{
+			level:    logLevelInfo,
+			expected: "info\nWARN warn\nERROR error\noutput\n",
+		},
+		{
+			level:    logLevelError,
+			expected: "ERROR error\noutput\n",
+		},
+	} {
+		t.Run(tc.level, func(t *testing.T) {
+			b := captureLogs(t)
+			withConfig(t, func(c *Config) {
+				c.LogLevel = tc.level
+			})
+
+			debugf("debug")
+			logf("info")
+			warnf("warn")
+			errorf("error")
+			outputf("output")
+
+			require.Equal(t, tc.expected, b.String())
+		})
+	}
+}
+
+func TestLogJson(t *testing.T) {
+	b := captureLogs(t)
+	withConfig(t, func(c *Config) {
+		c.LogFormat = logFormatJson
+	})
+
+	correlationId = ""
+	invocationLog.DeliveryStreamArn, invocationLog.Records = "", 0
+	warnf("no context\n")
+
+	correlationId = "abc"
+	invocationLog.DeliveryStreamArn = "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog"
+	invocationLog.Records = 3
+	logf("hello %q", "world")
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	require.JSONEq(t, `{"level":"warn","message":"no context"}`, lines[0])
+	require.JSONEq(t, `{
+		"level": "info",
+		"correlationId": "abc",
+		"deliveryStreamArn": "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		"records": 3,
+		"message": "hello \"world\""
+	}`, lines[1])
+}
+
+func TestHandleRequestLogsCorrelationId(t *testing.T) {
+	b := captureLogs(t)
+
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{
+		AwsRequestID: "request-id",
+	})
+	e := Event{
+		InvocationId:      "invocation-id",
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: ""},
+		},
+	}
+
+	_, err := HandleRequest(ctx, e)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	require.NotEmpty(t, lines)
+	for _, line := range lines {
+		require.True(t, strings.HasPrefix(line, "correlationId=request-id/invocation-id "), line)
+	}
+}
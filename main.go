@@ -6,18 +6,46 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/firehose"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 )
 
 const (
+	// maxFirehoseRecordSize is the largest record Firehose accepts, 1,000 KiB.
+	maxFirehoseRecordSize = 1000 * 1024
+
+	// maxKinesisRecordSize is the largest record Kinesis accepts, 1 MiB of
+	// data and partition key together.
+	maxKinesisRecordSize = 1024 * 1024
+
+	// maxPutRecordBatchRecords is the most records PutRecordBatch accepts.
+	maxPutRecordBatchRecords = 500
+
+	// maxPutRecordBatchBytes is the most data PutRecordBatch accepts, 4 MiB.
+	maxPutRecordBatchBytes = 4 * 1024 * 1024
+
+	// maxPutRecordsBytes is the most data and partition keys PutRecords
+	// accepts, 5 MiB.
+	maxPutRecordsBytes = 5 * 1024 * 1024
+
+	// defaultMaxPutAttempts is the number of attempts a put gets, unless
+	// config.StreamMaxAttempts says otherwise.
+	defaultMaxPutAttempts = 20
+
 	controlMessage = "CONTROL_MESSAGE"
 	dataMessage    = "DATA_MESSAGE"
 
@@ -26,34 +54,92 @@ const (
 	resultStatusOk      = "Ok"
 )
 
+const (
+	putFailureError      = "error"
+	putFailureMarkFailed = "mark-failed"
+)
+
+const (
+	missingPartitionKeyFail     = "fail"
+	missingPartitionKeyRecordId = "record-id"
+)
+
+const (
+	logEventsOverCapDrop     = "drop"
+	logEventsOverCapReingest = "reingest"
+)
+
+const (
+	missingDataDrop = "drop"
+	missingDataFail = "fail"
+)
+
 type KinesisRecordMetadata struct {
 	PartitionKey string `json:"partitionKey"`
 }
 
+// EventRecord is a record of a Firehose event. Its
+// ApproximateArrivalTimestamp is in milliseconds, see millisecondsToTime.
 type EventRecord struct {
 	RecordId                    string                `json:"recordId"`
 	ApproximateArrivalTimestamp int                   `json:"approximateArrivalTimestamp"`
 	Data                        string                `json:"data"`
 	KinesisMetadata             KinesisRecordMetadata `json:"kinesisRecordMetadata"`
+
+	// dataMissing is set for records decoded from JSON without a data
+	// field, or with a null one, as opposed to an empty one.
+	dataMissing bool
 }
 
-func (er *EventRecord) createReingestionRecord(isSas bool) (ResultRecord, error) {
+// UnmarshalJSON decodes an event record, noting whether it has data at all.
+func (er *EventRecord) UnmarshalJSON(b []byte) error {
+	type eventRecord EventRecord
+	aux := struct {
+		*eventRecord
+		Data *string `json:"data"`
+	}{eventRecord: (*eventRecord)(er)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+
+	er.Data, er.dataMissing = "", aux.Data == nil
+	if aux.Data != nil {
+		er.Data = *aux.Data
+	}
+
+	return nil
+}
+
+func (er *EventRecord) createReingestionRecord(isSas bool) (ReingestionRecord, error) {
 	data, err := base64.StdEncoding.DecodeString(er.Data)
 	if err != nil {
-		return ResultRecord{}, err
+		return ReingestionRecord{}, err
 	}
 
-	r := ResultRecord{
-		Data: string(data),
+	r := ReingestionRecord{
+		Data:           data,
+		SourceRecordId: er.RecordId,
 	}
 
 	if isSas {
-		r.PartitionKey = er.KinesisMetadata.PartitionKey
+		r.PartitionKey = er.partitionKey()
 	}
 
 	return r, nil
 }
 
+// partitionKey returns the partition key the record came in with. Records
+// from a Kinesis stream should all have one, but if one doesn't it falls
+// back to the record id when config.MissingPartitionKey says to, and is
+// empty otherwise.
+func (er *EventRecord) partitionKey() string {
+	if er.KinesisMetadata.PartitionKey == "" && config.MissingPartitionKey == missingPartitionKeyRecordId {
+		return er.RecordId
+	}
+
+	return er.KinesisMetadata.PartitionKey
+}
+
 type Event struct {
 	InvocationId           string        `json:"invocationId"`
 	DeliveryStreamArn      string        `json:"deliveryStreamArn"`
@@ -74,36 +160,139 @@ func (e *Event) streamARN() string {
 	}
 }
 
+// boundedPrefix returns how many of the event's records, from the start,
+// fit within maxBytes of data. Zero maxBytes means no limit.
+func (e *Event) boundedPrefix(maxBytes int) int {
+	if maxBytes <= 0 {
+		return len(e.Records)
+	}
+
+	size := 0
+	for idx, r := range e.Records {
+		size += len(r.Data)
+		if size > maxBytes {
+			return idx
+		}
+	}
+
+	return len(e.Records)
+}
+
+// validate checks that the event has what is needed to process it. It fills
+// in missing records with an empty list, and a missing region from the
+// AWS_REGION environment variable or, failing that, from its stream ARN.
+func (e *Event) validate() error {
+	// Without a stream ARN there is nowhere to reingest records to, and
+	// streamName would panic trying to split an empty string.
+	if e.streamARN() == "" {
+		return errors.New("Event has neither a deliveryStreamArn nor a sourceKinesisStreamArn")
+	}
+	if !strings.Contains(e.streamARN(), "/") {
+		return fmt.Errorf("Event stream ARN %q has no stream name", e.streamARN())
+	}
+	if e.Records == nil {
+		// Nothing to do, as with an empty list of records.
+		e.Records = []EventRecord{}
+	}
+
+	if e.Region == "" {
+		e.Region = os.Getenv("AWS_REGION")
+	}
+	if e.Region == "" {
+		// arn:partition:service:region:account-id:resource
+		if parts := strings.Split(e.streamARN(), ":"); len(parts) > 3 {
+			e.Region = parts[3]
+		}
+	}
+
+	return nil
+}
+
 func (e *Event) streamName() string {
 	return strings.Split(e.streamARN(), "/")[1]
 }
 
-// getInputDataByRecId
-func (e *Event) getInputDataByRecId() (map[string]ResultRecord, error) {
-	inputDataByRecId := map[string]ResultRecord{}
+// getInputDataByRecId decodes the original data of every record in the
+// event, keyed by record id, for use when reingesting. Records whose data
+// can't be decoded are left out, and their errors returned by record id
+// instead, so that one bad record doesn't fail the rest.
+//
+// Records are decoded in parallel, but each worker only writes to its own
+// slot of a pre-sized slice; the maps themselves are built serially
+// afterwards so they are never written to concurrently.
+func (e *Event) getInputDataByRecId() (map[string]ReingestionRecord, map[string]error) {
+	decoded := make([]ReingestionRecord, len(e.Records))
+	errs := make([]error, len(e.Records))
+
+	workers := runtime.NumCPU()
+	if workers > len(e.Records) {
+		workers = len(e.Records)
+	}
 
-	for _, r := range e.Records {
-		rr, err := r.createReingestionRecord(e.isSas())
-		if err != nil {
-			return nil, err
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				decoded[idx], errs[idx] = e.Records[idx].createReingestionRecord(e.isSas())
+			}
+		}()
+	}
+	for idx := range e.Records {
+		indexes <- idx
+	}
+	close(indexes)
+	wg.Wait()
+
+	inputDataByRecId := make(map[string]ReingestionRecord, len(e.Records))
+	decodeErrs := map[string]error{}
+	for idx, r := range e.Records {
+		if errs[idx] != nil {
+			decodeErrs[r.RecordId] = errs[idx]
+			continue
 		}
 
-		inputDataByRecId[r.RecordId] = rr
+		inputDataByRecId[r.RecordId] = decoded[idx]
 	}
 
-	return inputDataByRecId, nil
+	return inputDataByRecId, decodeErrs
 }
 
 type ResultRecord struct {
-	RecordId     string `json:"recordId"`
-	Result       string `json:"result"`
-	Data         string `json:"data"`
-	PartitionKey string `json:"partitionKey"`
+	RecordId     string          `json:"recordId"`
+	Result       string          `json:"result"`
+	Data         string          `json:"data"`
+	PartitionKey string          `json:"partitionKey"`
+	Metadata     *ResultMetadata `json:"metadata,omitempty"`
+}
+
+// ResultMetadata is the metadata Firehose accepts alongside a transformed
+// record.
+type ResultMetadata struct {
+	PartitionKeys map[string]string `json:"partitionKeys"`
+}
+
+// ReingestionRecord is a record to be put back on to the source stream. Its
+// data is kept as bytes throughout since it is usually gzipped and so not
+// valid UTF-8.
+type ReingestionRecord struct {
+	Data         []byte
+	PartitionKey string
+
+	// SourceRecordId is the id of the event record the data came from.
+	SourceRecordId string
+
+	// combined is the number of records combined into this one by
+	// combineRecords, and 0 for records that weren't combined.
+	combined int
 }
 
-func (rr ResultRecord) getReingestionRecord(isSas bool) ResultRecord {
-	r := ResultRecord{
-		Data: rr.Data,
+func (rr ReingestionRecord) getReingestionRecord(isSas bool) ReingestionRecord {
+	r := ReingestionRecord{
+		Data:           rr.Data,
+		SourceRecordId: rr.SourceRecordId,
 	}
 
 	if isSas {
@@ -115,8 +304,14 @@ func (rr ResultRecord) getReingestionRecord(isSas bool) ResultRecord {
 
 type ResultResponse struct {
 	Records []ResultRecord `json:"records"`
+
+	// Config is only set in response to a diagnostic invocation, see
+	// diagnosticInvocationId.
+	Config map[string]interface{} `json:"config,omitempty"`
 }
 
+// LogEvent is a log event of a CWL message. Its Timestamp is in
+// milliseconds, see time.
 type LogEvent struct {
 	Id        string `json:"id"`
 	Timestamp int    `json:"timestamp"`
@@ -130,14 +325,48 @@ type Message struct {
 	LogStream           string     `json:"logStream"`
 	SubscriptionFilters []string   `json:"subscriptionFilters"`
 	LogEvents           []LogEvent `json:"logEvents"`
+
+	// Data is the already transformed data of a transformedMessage.
+	Data string `json:"data,omitempty"`
+
+	// raw is the JSON the message was decoded from.
+	raw json.RawMessage
+}
+
+// eventMeta locates a log event within the Firehose event: the record it
+// came in and its index among the log events of that record's message.
+type eventMeta struct {
+	record      EventRecord
+	recordIndex int
+	eventIndex  int
+}
+
+// reconstructMessage re-encodes m as compact JSON, keeping only the given log
+// events, so the full CWL envelope can be forwarded rather than just the
+// log event messages.
+func reconstructMessage(m *Message, logEvents []LogEvent) (string, error) {
+	c := *m
+	c.LogEvents = logEvents
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
 }
 
-func transformLogEvent(l LogEvent) string {
-	return l.Message
+// transformLogEvent runs the message of a log event through
+// config.TransformChain. An empty message means the log event was dropped.
+func transformLogEvent(l LogEvent) (string, error) {
+	return config.TransformChain.Transform(l.Message)
 }
 
 func gunzip(b *bytes.Buffer, gzippedData []byte) error {
 	gr, err := gzip.NewReader(bytes.NewBuffer(gzippedData))
+	if err != nil {
+		return err
+	}
 	defer gr.Close()
 
 	data, err := ioutil.ReadAll(gr)
@@ -153,90 +382,570 @@ func gunzip(b *bytes.Buffer, gzippedData []byte) error {
 	return nil
 }
 
-func transformRecords(e Event) ResultRecordList {
-	// Open the event
-	resultRecords := []ResultRecord{}
+// gzipCompress writes the gzip compressed form of data to b.
+func gzipCompress(b *bytes.Buffer, data []byte) error {
+	gw := gzip.NewWriter(b)
 
-	// For each record, transform the record.
-	for _, r := range e.Records {
-		gzippedData, err := base64.StdEncoding.DecodeString(r.Data)
+	if _, err := gw.Write(data); err != nil {
+		return err
+	}
+
+	return gw.Close()
+}
+
+// splitMessage creates one reingestion record per log event, each holding
+// a gzipped copy of m with only that log event. When the split records come
+// back through the transform they are emitted as a record apiece. Their
+// partition key is derived from the log event's message if configured to,
+// see partitionKeyFor.
+func splitMessage(m *Message, logEvents []LogEvent, partitionKey string) ([]ReingestionRecord, error) {
+	records := []ReingestionRecord{}
+
+	for _, l := range logEvents {
+		single := *m
+		single.LogEvents = []LogEvent{l}
+
+		data, err := json.Marshal(single)
 		if err != nil {
-			resultRecords = append(resultRecords, ResultRecord{
-				RecordId: r.RecordId,
-				Result:   resultStatusFailed,
-			})
+			return nil, err
+		}
+
+		b := &bytes.Buffer{}
+		if err = gzipCompress(b, data); err != nil {
+			return nil, err
+		}
+
+		records = append(records, ReingestionRecord{
+			Data:         b.Bytes(),
+			PartitionKey: partitionKeyFor(l.Message, partitionKey),
+		})
+	}
+
+	return records, nil
+}
+
+// decodeMessages decodes the CWL messages in data. Normally there is just
+// the one, but records combined for reingestion hold several, one per line.
+// With config.JsonArrayMessages, a JSON array holds one message per element.
+func decodeMessages(data []byte) ([]*Message, error) {
+	messages := []*Message{}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	for {
+		raw := json.RawMessage{}
+		err := d.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		elements := []json.RawMessage{raw}
+		if config.JsonArrayMessages && isJsonArray(raw) {
+			if err := json.Unmarshal(raw, &elements); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, raw := range elements {
+			m := &Message{raw: raw}
+			if err := json.Unmarshal(raw, m); err != nil {
+				return nil, err
+			}
+
+			messages = append(messages, m)
+		}
+	}
+
+	if len(messages) == 0 {
+		return nil, errors.New("No messages found in record")
+	}
+
+	return messages, nil
+}
+
+// isJsonArray tells whether raw is a JSON array.
+func isJsonArray(raw json.RawMessage) bool {
+	trimmed := bytes.TrimLeft(raw, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// combineRecords merges gzipped reingestion records into as few records as
+// possible without going over maxSize bytes. A combined record is a single
+// gzip stream holding the decompressed messages of the records it replaces,
+// one per line, which decodeMessages separates again when the record comes
+// back through the transform.
+//
+// Records are grouped by their compressed size, which the recompressed,
+// combined record should never exceed. A record that is already over
+// maxSize is left as is.
+func combineRecords(records []ReingestionRecord, maxSize int) ([]ReingestionRecord, error) {
+	combined := []ReingestionRecord{}
+
+	group := [][]byte{}
+	groupSize := 0
+	flush := func() error {
+		if len(group) == 0 {
+			return nil
+		}
+
+		b := &bytes.Buffer{}
+		if err := gzipCompress(b, bytes.Join(group, []byte("\n"))); err != nil {
+			return err
+		}
+		combined = append(combined, ReingestionRecord{Data: b.Bytes(), combined: len(group)})
+
+		group = [][]byte{}
+		groupSize = 0
+		return nil
+	}
+
+	for _, r := range records {
+		if len(r.Data) > maxSize {
+			combined = append(combined, r)
 			continue
 		}
 
+		if groupSize+len(r.Data) > maxSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+
 		b := &bytes.Buffer{}
-		if err = gunzip(b, gzippedData); err != nil {
-			resultRecords = append(resultRecords, ResultRecord{
-				RecordId: r.RecordId,
-				Result:   resultStatusFailed,
+		if err := gunzip(b, r.Data); err != nil {
+			return nil, err
+		}
+
+		group = append(group, b.Bytes())
+		groupSize += len(r.Data)
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	return combined, nil
+}
+
+// transformDataMessage transforms the log events of a DATA_MESSAGE into the
+// data for an output record. The data is empty if no log events resulted
+// from the transformations. It also returns any log events that were split
+// off and need to be reingested separately.
+func transformDataMessage(m *Message, meta eventMeta) (string, []ReingestionRecord, error) {
+	transformedLogEvents := []string{}
+	keptLogEvents := []LogEvent{}
+	emittedLogEvents := []LogEvent{}
+
+	logEvents := m.LogEvents
+	if config.SortLogEvents {
+		logEvents = sortLogEvents(logEvents)
+	}
+	logEvents = stitchLogEvents(logEvents)
+
+	var overflowRecords []ReingestionRecord
+	if limit := config.MaxLogEventsPerRecord; limit > 0 && len(logEvents) > limit {
+		overflow := logEvents[limit:]
+		logEvents = logEvents[:limit]
+
+		if config.LogEventsOverCap == logEventsOverCapReingest {
+			// Reingested untransformed, so the log events go through the
+			// transform, and the cap, again when they come back.
+			data, err := reconstructMessage(m, overflow)
+			if err != nil {
+				return "", nil, err
+			}
+			b := &bytes.Buffer{}
+			if err := gzipCompress(b, []byte(data)); err != nil {
+				return "", nil, err
+			}
+			overflowRecords = append(overflowRecords, ReingestionRecord{
+				Data:           b.Bytes(),
+				PartitionKey:   meta.record.partitionKey(),
+				SourceRecordId: meta.record.RecordId,
 			})
+			logf(
+				"Reingesting %d log events over the cap of %d of record %s\n",
+				len(overflow), limit, meta.record.RecordId,
+			)
+		} else {
+			warnf(
+				"Dropping %d log events over the cap of %d of record %s\n",
+				len(overflow), limit, meta.record.RecordId,
+			)
+		}
+	}
+
+	sampleRate := sampleRateFor(m.LogGroup)
+	inRecord := map[string]bool{}
+	for idx, l := range logEvents {
+		meta.eventIndex = idx
+
+		if dedup.isDuplicate(l.Id) || (config.DedupLogEvents > 0 && l.Id != "" && inRecord[l.Id]) {
+			debugf("Dropping duplicate log event %s of record %s\n", l.Id, meta.record.RecordId)
+			countMetric("DuplicateLogEvents", 1, "Count")
 			continue
 		}
+		inRecord[l.Id] = true
 
-		m := &Message{}
-		if err = json.Unmarshal(b.Bytes(), m); err != nil {
-			resultRecords = append(resultRecords, ResultRecord{
-				RecordId: r.RecordId,
-				Result:   resultStatusFailed,
-			})
+		if isSampledOut(l, sampleRate) {
+			countMetric("SampledOutLogEvents", 1, "Count")
+			continue
+		}
+
+		t, err := transformLogEvent(l)
+		if err != nil {
+			return "", nil, err
+		}
+		if t == "" {
+			continue
+		}
+
+		keptLogEvents = append(keptLogEvents, l)
+		emitted := l
+		emitted.Message = t
+		emittedLogEvents = append(emittedLogEvents, emitted)
+
+		t, err = formatLogEvent(m, l, meta, t)
+		if err != nil {
+			return "", nil, err
+		}
+
+		transformedLogEvents = append(transformedLogEvents, t)
+	}
+
+	var splitRecords []ReingestionRecord
+	if config.RecordPerLogEvent && len(transformedLogEvents) > 1 {
+		// Firehose only accepts one output record per input record,
+		// so keep the first log event here and reingest the rest as
+		// messages of their own.
+		var err error
+		splitRecords, err = splitMessage(m, keptLogEvents[1:], meta.record.partitionKey())
+		if err != nil {
+			return "", nil, err
+		}
+		for i := range splitRecords {
+			splitRecords[i].SourceRecordId = meta.record.RecordId
+		}
+
+		transformedLogEvents = transformedLogEvents[:1]
+		emittedLogEvents = emittedLogEvents[:1]
+	}
+	splitRecords = append(splitRecords, overflowRecords...)
+
+	ids := make([]string, 0, len(emittedLogEvents))
+	for _, l := range emittedLogEvents {
+		ids = append(ids, l.Id)
+	}
+	dedup.hold(meta.record.RecordId, ids)
+
+	if len(transformedLogEvents) == 0 {
+		return "", splitRecords, nil
+	}
+
+	if outputFormatFor(m.LogGroup) == outputFormatCwl {
+		data, err := reconstructMessage(m, emittedLogEvents)
+		if err != nil {
+			return "", nil, err
+		}
+		return data + "\n", splitRecords, nil
+	}
+
+	return strings.Join(transformedLogEvents, "\n") + "\n", splitRecords, nil
+}
+
+// transformRecord transforms a single record. It also returns any records
+// that were split off and need to be reingested separately.
+func transformRecord(r EventRecord, recordIndex int, stats *Stats) (ResultRecord, []ReingestionRecord) {
+	failed := ResultRecord{
+		RecordId: r.RecordId,
+		Result:   resultStatusFailed,
+	}
+	dropped := ResultRecord{
+		RecordId: r.RecordId,
+		Result:   resultStatusDropped,
+	}
+	fail := func(reason string, err error) (ResultRecord, []ReingestionRecord) {
+		stats.fail(r.RecordId, reason, err)
+		return failed, nil
+	}
+
+	if r.dataMissing {
+		if config.MissingData == missingDataFail {
+			return fail(failReasonMissingData, fmt.Errorf("Record has no data field"))
+		}
+
+		logf("Dropping record %s: record has no data field\n", r.RecordId)
+		stats.drop(dropReasonMissingData)
+		return dropped, nil
+	}
+
+	gzippedData, err := base64.StdEncoding.DecodeString(r.Data)
+	if err != nil {
+		return fail(failReasonBase64, err)
+	}
+
+	// Data that is valid base64 can still decode to nothing, such as when
+	// it is only line breaks, which base64 decoding skips.
+	if len(gzippedData) == 0 && config.DropEmptyRecords {
+		logf("Dropping record %s: record has no data\n", r.RecordId)
+		stats.drop(dropReasonEmptyRecord)
+		return dropped, nil
+	}
+
+	decompressed, messages, err := decompressMessages(gzippedData)
+	if err != nil {
+		if errors.As(err, new(*messageDecodeError)) {
+			return fail(failReasonJsonUnmarshal, err)
+		}
+		return fail(failReasonDecompress, err)
+	}
+	stats.DecompressedRecords++
+	stats.DecompressedBytes += len(decompressed)
+
+	out := strings.Builder{}
+	splitRecords := []ReingestionRecord{}
+	onlyControlMessages := true
+	for _, m := range messages {
+		if m.MessageType != controlMessage {
+			onlyControlMessages = false
 		}
 
 		if m.MessageType == controlMessage {
 			// Drop CONTROL_MESSAGEs. CONTROL_MESSAGEs are sent by CWL to check if
 			// the subscription is reachable. They do not contain actual data.
-			resultRecords = append(resultRecords, ResultRecord{
-				RecordId: r.RecordId,
-				Result:   resultStatusDropped,
-			})
+			if config.ControlMessageHeartbeat {
+				outputf("subscription_heartbeat log_group=%q log_stream=%q\n", m.LogGroup, m.LogStream)
+				countMetric("SubscriptionHeartbeats", 1, "Count")
+			}
+			continue
 
 		} else if m.MessageType == dataMessage {
 			// Transform DATA_MESSAGEs. Each DATA_MESSAGE has zero or more log
 			// events. This logic transforms those log events.
-			transformedLogEvents := []string{}
-			for _, l := range m.LogEvents {
-				t := transformLogEvent(l)
-				if t != "" {
-					transformedLogEvents = append(transformedLogEvents, t)
-				}
+			stats.seen(m)
+			stats.countSource(m)
+			d, split, err := transformDataMessage(m, eventMeta{record: r, recordIndex: recordIndex})
+			if err != nil {
+				return fail(failReasonTransform, err)
 			}
 
-			var result ResultRecord
-			if len(transformedLogEvents) > 0 {
-				data := strings.Join(transformedLogEvents, "\n") + "\n"
-				result = ResultRecord{
-					RecordId: r.RecordId,
-					Result:   resultStatusOk,
-					Data:     base64.StdEncoding.EncodeToString([]byte(data)),
-				}
-			} else {
-				// Drop the record if no log events resulted from the
-				// transformations.
-				result = ResultRecord{
-					RecordId: r.RecordId,
-					Result:   resultStatusDropped,
-				}
+			out.WriteString(d)
+			splitRecords = append(splitRecords, split...)
+		} else if m.MessageType == transformedMessage && config.ReingestData == reingestDataTransformed {
+			// Data transformed by an earlier invocation, that was
+			// reingested as is. See reingestDataTransformed. Any producer
+			// can send such a message though, so it isn't taken on trust
+			// otherwise, and is still redacted.
+			out.WriteString(redactLines(m.Data))
+		} else if events, ok := cloudTrailEvents(m); ok {
+			// A CloudTrail log file, whose events become events of their
+			// own rather than one blob.
+			d, err := formatEvents(m, events, eventMeta{record: r, recordIndex: recordIndex})
+			if err != nil {
+				return fail(failReasonTransform, err)
 			}
-
-			resultRecords = append(resultRecords, result)
+			out.WriteString(d)
+		} else if m.MessageType == "" && config.ForwardNonCwlJson {
+			// JSON that isn't a CWL message at all, from a producer
+			// writing to the stream directly, which becomes an event of
+			// its own.
+			d, err := formatEvents(m, []LogEvent{{Message: compactJson(m.raw)}}, eventMeta{record: r, recordIndex: recordIndex})
+			if err != nil {
+				return fail(failReasonTransform, err)
+			}
+			out.WriteString(d)
 		} else {
 			// Any message that is not a CONTROL_MESSAGE or a DATA_MESSAGE
 			// should be considered a failure.
+			return fail(failReasonUnknownMessageType, fmt.Errorf("Message type %q", m.MessageType))
+		}
+	}
+
+	data := out.String()
+	if data == "" {
+		// Drop the record if no log events resulted from the
+		// transformations.
+		if onlyControlMessages {
+			stats.drop(dropReasonControlMessage)
+		} else {
+			stats.drop(dropReasonEmptyTransform)
+		}
+		return dropped, splitRecords
+	}
+
+	if !config.TrailingNewline {
+		// Log events, and the messages of records combined for
+		// reingestion, are still separated by newlines.
+		data = strings.TrimSuffix(data, "\n")
+	}
+
+	if config.RecordHeader != "" {
+		data = recordHeaderLine() + data
+	}
+
+	if config.GzipResponse {
+		b := &bytes.Buffer{}
+		if err := gzipCompress(b, []byte(data)); err != nil {
+			return fail(failReasonCompress, err)
+		}
+
+		return ResultRecord{
+			RecordId: r.RecordId,
+			Result:   resultStatusOk,
+			Data:     base64.StdEncoding.EncodeToString(b.Bytes()),
+			Metadata: &ResultMetadata{
+				PartitionKeys: map[string]string{"contentEncoding": "gzip"},
+			},
+		}, splitRecords
+	}
+
+	return ResultRecord{
+		RecordId: r.RecordId,
+		Result:   resultStatusOk,
+		Data:     base64.StdEncoding.EncodeToString([]byte(data)),
+	}, splitRecords
+}
+
+// transformRecords transforms each record of the event, see
+// transformRecordsWithContext, without a deadline.
+func transformRecords(e Event, stats *Stats) (ResultRecordList, []ReingestionRecord) {
+	return transformRecordsWithContext(context.Background(), e, stats)
+}
+
+// transformRecordsWithContext transforms each record of the event, tallying
+// stats as it goes. Once ctx is done, the remaining records are failed
+// untransformed, and go to the processing-failed output. It also returns any
+// records that need to be reingested separately: ones that were split off,
+// and, past config.MaxInputBytes of input, or once the decompressed records
+// grow past config.MaxDecompressedBytes or the results past
+// config.MaxResultBytes, the remaining records themselves, untransformed.
+func transformRecordsWithContext(ctx context.Context, e Event, stats *Stats) (ResultRecordList, []ReingestionRecord) {
+	// Open the event
+	resultRecords := ResultRecordList{}
+	splitRecords := []ReingestionRecord{}
+	resultBytes := 0
+
+	processable := e.boundedPrefix(config.MaxInputBytes)
+	if processable < len(e.Records) {
+		warnf("Event is over the %d bytes input limit, reingesting its last %d records\n",
+			config.MaxInputBytes, len(e.Records)-processable)
+	}
+
+	// For each record, transform the record.
+	for idx, r := range e.Records {
+		stats.Records++
+		stats.InputBytes += base64.StdEncoding.DecodedLen(len(r.Data))
+		stats.BilledBytes += billedSize(base64.StdEncoding.DecodedLen(len(r.Data)))
+
+		if err := ctx.Err(); err != nil {
+			stats.fail(r.RecordId, failReasonDeadline, err)
 			resultRecords = append(resultRecords, ResultRecord{
 				RecordId: r.RecordId,
 				Result:   resultStatusFailed,
 			})
+			continue
 		}
+
+		if e.isSas() && r.partitionKey() == "" {
+			// Without a partition key neither the record nor any log events
+			// split off it could be reingested into the stream.
+			stats.fail(r.RecordId, failReasonPartitionKey, fmt.Errorf("Record has no partition key"))
+			resultRecords = append(resultRecords, ResultRecord{
+				RecordId: r.RecordId,
+				Result:   resultStatusFailed,
+			})
+			continue
+		}
+
+		overDecompressed := config.MaxDecompressedBytes > 0 && stats.DecompressedBytes > config.MaxDecompressedBytes
+		if idx >= processable || overDecompressed || config.MaxResultBytes > 0 && resultBytes > config.MaxResultBytes {
+			// Rather than take on more input than it should, risk running out
+			// of memory decompressing, or hold on to ever more transformed
+			// data, put the record back on the stream to be transformed by a
+			// later invocation.
+			rr, err := r.createReingestionRecord(e.isSas())
+			if err != nil {
+				stats.fail(r.RecordId, failReasonBase64, err)
+				resultRecords = append(resultRecords, ResultRecord{
+					RecordId: r.RecordId,
+					Result:   resultStatusFailed,
+				})
+				continue
+			}
+
+			resultRecords = append(resultRecords, ResultRecord{
+				RecordId: r.RecordId,
+				Result:   resultStatusDropped,
+			})
+			stats.drop(dropReasonSizeLimit)
+			splitRecords = append(splitRecords, rr)
+			continue
+		}
+
+		start := clock.Now()
+		result, split := transformRecord(r, idx, stats)
+		if config.EmitRecordLatency {
+			stats.RecordLatency.observe(clock.Now().Sub(start))
+		}
+		resultRecords = append(resultRecords, result)
+		splitRecords = append(splitRecords, split...)
+		resultBytes += len(result.RecordId) + len(result.Data)
+	}
+
+	return resultRecords, splitRecords
+}
+
+// classify returns the result each record of the event would get, by
+// record id, without reingesting anything. Results can only differ from
+// HandleRequest's where records are reingested to keep the response small
+// or fail to be. It isn't an invocation, so what it counts and the log
+// events it sees are kept apart from the metrics and dedup of the real ones.
+func classify(e Event) map[string]string {
+	origMetrics, origDedup := metrics, dedup
+	metrics, dedup = &metricAccumulator{}, dedup.clone()
+	defer func() {
+		metrics, dedup = origMetrics, origDedup
+	}()
+
+	resultRecords, _ := transformRecords(e, &Stats{})
+
+	results := make(map[string]string, len(resultRecords))
+	for _, r := range resultRecords {
+		results[r.RecordId] = r.Result
 	}
 
-	return resultRecords
+	return results
 }
 
 type ResultRecordList []ResultRecord
 
+// markFailed marks the records the given reingestion records came from as
+// ProcessingFailed. Firehose doesn't retry those, it writes them to its
+// processing-failed output, so the transform DLQ is the way to recover them.
+// It returns their record ids.
+func (rrl ResultRecordList) markFailed(batches [][]ReingestionRecord) []string {
+	failed := map[string]bool{}
+	for _, batch := range batches {
+		for _, r := range batch {
+			failed[r.SourceRecordId] = true
+		}
+	}
+
+	ids := []string{}
+	for idx := range rrl {
+		if failed[rrl[idx].RecordId] {
+			rrl[idx].Result = resultStatusFailed
+			rrl[idx].Data = ""
+			rrl[idx].Metadata = nil
+			ids = append(ids, rrl[idx].RecordId)
+		}
+	}
+
+	return ids
+}
+
 // projectedSize returns the estimated size in bytes of the payload to
 // be reingested.
 func (rrl *ResultRecordList) projectedSize() int {
@@ -249,179 +958,727 @@ func (rrl *ResultRecordList) projectedSize() int {
 	return total
 }
 
-func putRecordsToFirehoseStream(
-	svc *firehose.Firehose,
-	streamName string,
-	records []*firehose.Record,
-	attempt int,
-	maxAttempts int,
-) error {
-	var failed []*firehose.PutRecordBatchResponseEntry
+// firehoseAPI is the part of the Firehose client used to reingest records.
+type firehoseAPI interface {
+	PutRecordBatchWithContext(aws.Context, *firehose.PutRecordBatchInput, ...request.Option) (*firehose.PutRecordBatchOutput, error)
+}
+
+// kinesisAPI is the part of the Kinesis client used to reingest records.
+type kinesisAPI interface {
+	PutRecordsWithContext(aws.Context, *kinesis.PutRecordsInput, ...request.Option) (*kinesis.PutRecordsOutput, error)
+}
 
-	out, err := svc.PutRecordBatch(&firehose.PutRecordBatchInput{
-		DeliveryStreamName: &streamName,
+// newFirehoseAPI and newKinesisAPI create the clients used for reingestion.
+// They are swapped out in tests.
+var newFirehoseAPI = func(region string) firehoseAPI {
+	if config.Sink == sinkStdout {
+		return stdoutFirehoseAPI{}
+	}
+	return firehose.New(session.Must(session.NewSession()), awsConfig(region))
+}
+
+var newKinesisAPI = func(region string) kinesisAPI {
+	if config.Sink == sinkStdout {
+		return stdoutKinesisAPI{}
+	}
+	return kinesis.New(session.Must(session.NewSession()), awsConfig(region))
+}
+
+// awsConfig returns the config of the clients used for reingestion.
+func awsConfig(region string) *aws.Config {
+	return aws.NewConfig().WithRegion(region).WithMaxRetries(config.SdkMaxRetries)
+}
+
+// recordPutter puts records on to a stream, in a single request per call to
+// put, so putRecordsWithRetry can retry the puts of any API the same way.
+type recordPutter interface {
+	// api is the name of the API call records are put with.
+	api() string
+
+	// put puts the records at idxs in a single request. It returns the
+	// error code of every record the service responded for, "" for those
+	// that were put, and the number of records it said failed.
+	put(ctx context.Context, idxs []int, opts ...request.Option) ([]string, int64, error)
+}
+
+// firehosePutter puts records on to a delivery stream with PutRecordBatch.
+type firehosePutter struct {
+	svc        firehoseAPI
+	streamName string
+	records    []*firehose.Record
+}
+
+func (p firehosePutter) api() string {
+	return "PutRecordBatch"
+}
+
+func (p firehosePutter) put(ctx context.Context, idxs []int, opts ...request.Option) ([]string, int64, error) {
+	records := make([]*firehose.Record, 0, len(idxs))
+	for _, idx := range idxs {
+		records = append(records, p.records[idx])
+	}
+
+	out, err := p.svc.PutRecordBatchWithContext(ctx, &firehose.PutRecordBatchInput{
+		DeliveryStreamName: aws.String(p.streamName),
 		Records:            records,
-	})
+	}, opts...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	codes := make([]string, 0, len(out.RequestResponses))
+	for _, r := range out.RequestResponses {
+		codes = append(codes, aws.StringValue(r.ErrorCode))
+	}
+	return codes, aws.Int64Value(out.FailedPutCount), nil
+}
+
+// kinesisPutter puts records on to a Kinesis stream with PutRecords.
+type kinesisPutter struct {
+	svc        kinesisAPI
+	streamName string
+	records    []*kinesis.PutRecordsRequestEntry
+}
 
+func (p kinesisPutter) api() string {
+	return "PutRecords"
+}
+
+func (p kinesisPutter) put(ctx context.Context, idxs []int, opts ...request.Option) ([]string, int64, error) {
+	records := make([]*kinesis.PutRecordsRequestEntry, 0, len(idxs))
+	for _, idx := range idxs {
+		records = append(records, p.records[idx])
+	}
+
+	out, err := p.svc.PutRecordsWithContext(ctx, &kinesis.PutRecordsInput{
+		StreamName: aws.String(p.streamName),
+		Records:    records,
+	}, opts...)
 	if err != nil {
-		failed = out.RequestResponses
-	} else if *out.FailedPutCount != 0 {
-		codes := []string{}
-		for _, r := range out.RequestResponses {
-			r := r
-			if *r.ErrorCode != "" {
-				codes = append(codes, *r.ErrorCode)
-				failed = append(failed, r)
+		return nil, 0, err
+	}
+
+	codes := make([]string, 0, len(out.Records))
+	for _, r := range out.Records {
+		codes = append(codes, aws.StringValue(r.ErrorCode))
+	}
+	return codes, aws.Int64Value(out.FailedRecordCount), nil
+}
+
+// putError is the error of a put that was given up on, either because its
+// error isn't retryable or because it ran out of attempts.
+type putError struct {
+	// category is errorRetryable or errorTerminal.
+	category string
+	attempts int
+	err      error
+}
+
+func (e *putError) Error() string {
+	if e.category == errorTerminal {
+		return fmt.Sprintf("Could not put records, the error is not retryable. %s", e.err)
+	}
+	return fmt.Sprintf("Could not put records after %d attempts. %s", e.attempts, e.err)
+}
+
+func (e *putError) Unwrap() error {
+	return e.err
+}
+
+// putRecordsWithRetry puts the n records of p, retrying those that fail for
+// up to maxAttempts attempts in all. It returns which of the records were
+// delivered, even when it gives up on the rest with a *putError.
+func putRecordsWithRetry(ctx context.Context, p recordPutter, n int, b *backoff, maxAttempts int) ([]bool, error) {
+	defer b.logUnlogged()
+
+	delivered := make([]bool, n)
+	pending := make([]int, n)
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for attempt := 0; ; attempt++ {
+		var requestId string
+		codes, failedCount, err := p.put(ctx, pending, captureRequestId(&requestId))
+
+		failed := false
+		category := errorRetryable
+		if err != nil {
+			category = classifyError(err)
+			failed = true
+		} else if len(codes) != len(pending) {
+			// There is no telling which response goes with which record, so
+			// the whole batch is retried.
+			failed = true
+			err = fmt.Errorf("%s returned %d responses for %d records, request id: %s\n", p.api(), len(codes), len(pending), requestId)
+		} else {
+			// The error codes are checked even when the failed count is 0,
+			// as it has been seen to disagree with them.
+			errorCodes := []string{}
+			for _, code := range codes {
+				if code != "" {
+					errorCodes = append(errorCodes, code)
+				}
+			}
+			if failedCount != 0 || len(errorCodes) > 0 {
+				category = classifyErrorCodes(errorCodes)
+				failed = true
+				if len(errorCodes) == 0 {
+					// There is no telling which records failed, so none of
+					// them count as delivered and all of them are resent.
+					err = fmt.Errorf("%d records failed without error codes, request id: %s\n", failedCount, requestId)
+				} else {
+					err = fmt.Errorf("Individual error codes: %s, request id: %s\n", strings.Join(errorCodes, ","), requestId)
+					for i, code := range codes {
+						if code == "" {
+							delivered[pending[i]] = true
+						}
+					}
+				}
 			}
 		}
-		err = fmt.Errorf("Individual error codes: %s\n", strings.Join(codes, ","))
-	}
 
-	if len(failed) > 0 {
-		if attempt+1 < maxAttempts {
-			fmt.Printf("Some records failed while calling PutRecordBatch, retrying. %s\n", err)
-			if err = putRecordsToFirehoseStream(svc, streamName, records, attempt+1, 20); err != nil {
-				return err
+		if !failed {
+			for _, idx := range pending {
+				delivered[idx] = true
 			}
-		} else {
-			return fmt.Errorf("Could not put records after %d attempts. %s", maxAttempts, err)
+			return delivered, nil
+		}
+
+		if category == errorTerminal || attempt+1 >= maxAttempts {
+			return delivered, &putError{category: category, attempts: maxAttempts, err: err}
 		}
+
+		// Rather than sleep into the Lambda timeout, give up while there is
+		// still time to return the records that were not delivered.
+		delay := b.next(attempt)
+		if deadline, ok := ctx.Deadline(); ok && clock.Now().Add(delay).After(deadline) {
+			err = fmt.Errorf("No time left to retry before the deadline. %s", err)
+			return delivered, &putError{category: category, attempts: attempt + 1, err: err}
+		}
+
+		b.logRetry(attempt, "Some records failed while calling %s, retrying. %s\n", p.api(), err)
+		if serr := clock.Sleep(ctx, delay); serr != nil {
+			return delivered, &putError{category: category, attempts: attempt + 1, err: serr}
+		}
+
+		retry := []int{}
+		for _, idx := range pending {
+			if !delivered[idx] {
+				retry = append(retry, idx)
+			}
+		}
+		pending = retry
+	}
+}
+
+// putRecordsToFirehoseStream puts records on to a delivery stream, see
+// putRecordsWithRetry.
+func putRecordsToFirehoseStream(
+	ctx context.Context,
+	svc firehoseAPI,
+	streamName string,
+	records []*firehose.Record,
+	b *backoff,
+	maxAttempts int,
+) ([]bool, error) {
+	sizes := make([]int, len(records))
+	for i, r := range records {
+		sizes[i] = len(r.Data)
+	}
+	if err := oversizeError(sizes, maxFirehoseRecordSize, "Firehose"); err != nil {
+		return make([]bool, len(records)), err
 	}
 
-	return nil
+	p := firehosePutter{svc: svc, streamName: streamName, records: records}
+	return putRecordsWithRetry(ctx, p, len(records), b, maxAttempts)
 }
 
+// putRecordsToKinesisStream is the Kinesis equivalent of
+// putRecordsToFirehoseStream.
 func putRecordsToKinesisStream(
-	svc *kinesis.Kinesis,
+	ctx context.Context,
+	svc kinesisAPI,
 	streamName string,
 	records []*kinesis.PutRecordsRequestEntry,
-	attempt int,
+	b *backoff,
 	maxAttempts int,
-) error {
-	var failed []*kinesis.PutRecordsResultEntry
+) ([]bool, error) {
+	sizes := make([]int, len(records))
+	for i, r := range records {
+		sizes[i] = len(r.Data) + len(aws.StringValue(r.PartitionKey))
+	}
+	if err := oversizeError(sizes, maxKinesisRecordSize, "Kinesis"); err != nil {
+		return make([]bool, len(records)), err
+	}
 
-	out, err := svc.PutRecords(&kinesis.PutRecordsInput{
-		StreamName: &streamName,
-		Records:    records,
-	})
-	if err != nil {
-		failed = out.Records
-	} else if *out.FailedRecordCount != 0 {
-		codes := []string{}
-		for _, r := range out.Records {
-			r := r
-			if *r.ErrorCode != "" {
-				codes = append(codes, *r.ErrorCode)
-				failed = append(failed, r)
-			}
+	p := kinesisPutter{svc: svc, streamName: streamName, records: records}
+	return putRecordsWithRetry(ctx, p, len(records), b, maxAttempts)
+}
+
+// oversizeError returns an error if any of the record sizes are over limit,
+// the record size limit of service. The service would reject the whole
+// request over an oversize record, with an error that is hard to make sense
+// of, so they are caught up front.
+func oversizeError(sizes []int, limit int, service string) error {
+	oversize := 0
+	for _, s := range sizes {
+		if s > limit {
+			oversize++
 		}
-		err = fmt.Errorf("Individual error codes: %s\n", strings.Join(codes, ","))
 	}
+	if oversize == 0 {
+		return nil
+	}
+
+	countMetric("OversizeRecords", float64(oversize), "Count")
+	return fmt.Errorf(
+		"Could not put records, %d of them are over the %d bytes %s record size limit",
+		oversize, limit, service,
+	)
+}
+
+// captureRequestId stores the id AWS gave a request in id once it is done,
+// to be quoted when escalating a failed put to AWS support. Errors for
+// whole failed requests carry it already, but the outputs of partially
+// failed puts don't.
+func captureRequestId(id *string) request.Option {
+	return func(r *request.Request) {
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			*id = r.RequestID
+		})
+	}
+}
+
+// batchSize returns the total size in bytes of the records' data and
+// partition keys.
+func batchSize(batch []ReingestionRecord) int {
+	total := 0
+	for _, r := range batch {
+		total += len(r.Data) + len(r.PartitionKey)
+	}
+	return total
+}
+
+// maxBatchBytes returns the most data a put on to the event's stream
+// accepts.
+func (e *Event) maxBatchBytes() int {
+	if e.isSas() {
+		return maxPutRecordsBytes
+	}
+	return maxPutRecordBatchBytes
+}
 
-	if len(failed) > 0 {
-		if attempt+1 < maxAttempts {
-			fmt.Printf("Some records failed while calling PutRecords, retrying. %s\n", err)
-			if err = putRecordsToKinesisStream(svc, streamName, records, attempt+1, 20); err != nil {
-				return err
+// responseLimit returns how large the records of a response may get: the
+// Lambda response limit less the headroom left for the stuff not accounted
+// for, such as the JSON around them.
+func responseLimit() int {
+	return config.MaxResponseBytes - config.HeadroomBytes
+}
+
+// batchSizeFor returns the number of records put on to streamName at a
+// time.
+func batchSizeFor(streamName string) int {
+	if n, ok := config.StreamBatchSizes[streamName]; ok && n > 0 && n < maxPutRecordBatchRecords {
+		return n
+	}
+	return maxPutRecordBatchRecords
+}
+
+// maxAttemptsFor returns the number of attempts a put on to streamName gets.
+func maxAttemptsFor(streamName string) int {
+	if n, ok := config.StreamMaxAttempts[streamName]; ok && n > 0 {
+		return n
+	}
+	return defaultMaxPutAttempts
+}
+
+// batchRecords splits records into batches of at most size records and
+// maxBytes bytes. Each batch is filled as far as the limits allow before the
+// next is started, which makes for the fewest puts. It never returns an
+// empty batch.
+func batchRecords(records []ReingestionRecord, size int, maxBytes int) [][]ReingestionRecord {
+	batches := [][]ReingestionRecord{}
+
+	start, bytes := 0, 0
+	for end, r := range records {
+		n := len(r.Data) + len(r.PartitionKey)
+		if end > start && (end-start == size || bytes+n > maxBytes) {
+			batches = append(batches, records[start:end])
+			start, bytes = end, 0
+		}
+		bytes += n
+	}
+	if start < len(records) {
+		batches = append(batches, records[start:])
+	}
+
+	return batches
+}
+
+// compressRecords gzips the data of the records that isn't gzipped already.
+func compressRecords(records []ReingestionRecord) ([]ReingestionRecord, error) {
+	compressed := make([]ReingestionRecord, 0, len(records))
+
+	for _, r := range records {
+		if !isGzipped(r.Data) {
+			b := &bytes.Buffer{}
+			if err := gzipCompress(b, r.Data); err != nil {
+				return nil, err
 			}
-		} else {
-			return fmt.Errorf("Could not put records after %d attempts. %s", maxAttempts, err)
+			r.Data = b.Bytes()
 		}
+
+		compressed = append(compressed, r)
 	}
 
-	return nil
+	return compressed, nil
+}
+
+// isGzipped tells whether data starts with the gzip magic number.
+func isGzipped(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
 }
 
-func putBatches(e Event, batches [][]ResultRecord, totalRecordsToBeReingested int) error {
-	sess := session.Must(session.NewSession())
+// BeforePut is called with every batch of records just before it is put
+// on to the source stream, and the records it returns are put instead. It
+// can be replaced to filter or rewrite records at the last minute; returning
+// an error stops reingestion.
+var BeforePut = func(ctx context.Context, records []ReingestionRecord) ([]ReingestionRecord, error) {
+	return records, nil
+}
+
+// putBatches puts the batches on to the event's stream. It carries on past
+// batches that fail to be put until config.CircuitBreakerThreshold of them
+// fail in a row, at which point it gives up on the rest rather than grind
+// through their retries too.
+//
+// It returns the number of records that were delivered, counted per record
+// across retries, so records that made it on an earlier attempt of a batch
+// are neither put nor counted again.
+//
+// It waits config.ReingestDelay before the first batch, giving a stream that
+// has just been throttled a moment to recover.
+func putBatches(ctx context.Context, e Event, batches [][]ReingestionRecord, totalRecordsToBeReingested int) (int, error) {
+	if config.ReingestDelay > 0 && len(batches) > 0 {
+		if err := clock.Sleep(ctx, config.ReingestDelay); err != nil {
+			return 0, &putBatchesError{
+				err:   fmt.Errorf("Gave up waiting to reingest records. %s", err),
+				unput: batches,
+			}
+		}
+	}
 
 	recordsReingestedSoFar := 0
+	consecutiveFailures := 0
+	var pbe *putBatchesError
 	for idx := 0; idx < len(batches); idx++ {
-		batch := batches[idx]
-		if e.isSas() {
-			svc := kinesis.New(sess, aws.NewConfig().WithRegion(e.Region))
-			svcRecords := []*kinesis.PutRecordsRequestEntry{}
-			for _, r := range batch {
-				svcRecords = append(svcRecords, &kinesis.PutRecordsRequestEntry{
-					Data:         []byte(r.Data),
-					PartitionKey: &r.PartitionKey,
-				})
-			}
-			if err := putRecordsToKinesisStream(svc, e.streamName(), svcRecords, 0, 20); err != nil {
-				fmt.Println("Failed to reingest records.")
-				return err
-			}
-		} else {
-			svc := firehose.New(sess, aws.NewConfig().WithRegion(e.Region))
-			svcRecords := []*firehose.Record{}
-			for _, r := range batch {
-				svcRecords = append(svcRecords, &firehose.Record{Data: []byte(r.Data)})
+		delivered, err := putBatch(ctx, e, batches[idx])
+		recordsReingestedSoFar += delivered
+		if err != nil {
+			errorf("Failed to reingest records.")
+			if pbe == nil {
+				pbe = &putBatchesError{err: err}
 			}
-			if err := putRecordsToFirehoseStream(svc, e.streamName(), svcRecords, 0, 20); err != nil {
-				fmt.Println("Failed to reingest records.")
-				return err
+			pbe.unput = append(pbe.unput, batches[idx])
+
+			consecutiveFailures++
+			if consecutiveFailures >= config.CircuitBreakerThreshold {
+				if rest := batches[idx+1:]; len(rest) > 0 {
+					errorf(
+						"circuit breaker open after %d failed batches in a row, skipping the remaining %d batches\n",
+						consecutiveFailures, len(rest),
+					)
+					countMetric("CircuitBreakerOpen", 1, "Count")
+					pbe.unput = append(pbe.unput, rest...)
+				}
+				break
 			}
+			continue
 		}
-		recordsReingestedSoFar += len(batch)
-		fmt.Printf(
+		consecutiveFailures = 0
+
+		logf(
 			"Reingested %d/%d records out of %d in to %s stream\n",
 			recordsReingestedSoFar, totalRecordsToBeReingested, len(e.Records), e.streamName(),
 		)
 	}
-	fmt.Printf(
+	if pbe != nil {
+		return recordsReingestedSoFar, pbe
+	}
+	logf(
 		"Reingested all %d records out of %d in to %s stream\n",
-		totalRecordsToBeReingested, len(e.Records), e.streamName(),
+		recordsReingestedSoFar, len(e.Records), e.streamName(),
 	)
 
-	return nil
+	return recordsReingestedSoFar, nil
+}
+
+// putBatchesError is returned by putBatches when batches could not be put.
+// It holds on to the error of the first of them, and to all the batches that
+// weren't put, whether they failed or were skipped.
+type putBatchesError struct {
+	err   error
+	unput [][]ReingestionRecord
+}
+
+func (e *putBatchesError) Error() string {
+	return e.err.Error()
 }
 
+func (e *putBatchesError) Unwrap() error {
+	return e.err
+}
+
+// putBatch puts a single batch of records on to the event's stream, and
+// returns the number of them that were delivered.
+func putBatch(ctx context.Context, e Event, batch []ReingestionRecord) (int, error) {
+	batch, err := BeforePut(ctx, batch)
+	if err != nil {
+		return 0, err
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	if config.ReingestCompress {
+		if batch, err = compressRecords(batch); err != nil {
+			return 0, err
+		}
+	}
+
+	var records []ReingestionRecord
+	var delivered []bool
+
+	if e.isSas() {
+		svc := newKinesisAPI(e.Region)
+		svcRecords := []*kinesis.PutRecordsRequestEntry{}
+		for _, r := range batch {
+			svcRecords = append(svcRecords, &kinesis.PutRecordsRequestEntry{
+				Data:         r.Data,
+				PartitionKey: aws.String(fitPartitionKey(r.PartitionKey)),
+			})
+		}
+		records = batch
+		delivered, err = putRecordsToKinesisStream(ctx, svc, e.streamName(), svcRecords, newBackoff(), maxAttemptsFor(e.streamName()))
+	} else {
+		records = batch
+		if config.CombineRecords {
+			combined, err := combineRecords(batch, maxFirehoseRecordSize)
+			if err != nil {
+				warnf("Failed to combine records, putting them separately. %s\n", err)
+			} else {
+				records = combined
+			}
+		}
+
+		svc := newFirehoseAPI(e.Region)
+		svcRecords := []*firehose.Record{}
+		for _, r := range records {
+			svcRecords = append(svcRecords, &firehose.Record{Data: r.Data})
+		}
+		delivered, err = putRecordsToFirehoseStream(ctx, svc, e.streamName(), svcRecords, newBackoff(), maxAttemptsFor(e.streamName()))
+	}
+
+	deliveredCount := 0
+	for i, ok := range delivered {
+		if !ok {
+			continue
+		}
+		if records[i].combined > 0 {
+			deliveredCount += records[i].combined
+		} else {
+			deliveredCount++
+		}
+	}
+	if err != nil {
+		return deliveredCount, err
+	}
+	trackQuota(e.streamName(), len(batch), batchSize(batch))
+
+	return deliveredCount, nil
+}
+
+// HandleRequest is the Lambda handler Firehose invokes to transform an event.
 func HandleRequest(ctx context.Context, e Event) (ResultResponse, error) {
-	resultRecords := transformRecords(e)
+	r, _, err := HandleRequestWithStats(ctx, e)
+	return r, err
+}
+
+// HandleRequestWithStats transforms an event like HandleRequest, but also
+// returns the stats of the invocation, for callers other than Firehose, such
+// as Step Functions, that want more than the records.
+func HandleRequestWithStats(ctx context.Context, e Event) (ResultResponse, Stats, error) {
+	stats := &Stats{}
+	r, err := handleRequest(ctx, e, stats)
+	if err == nil {
+		dedup.commitResponse(r, stats.ResponseBytes)
+	} else {
+		dedup.begin()
+	}
+	return r, *stats, err
+}
+
+// withDeadlineMargin returns a context whose deadline is config.DeadlineMargin
+// before that of ctx, if it has one, but no more than half of the time left
+// until it.
+func withDeadlineMargin(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || config.DeadlineMargin <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	// Context deadlines are by the wall clock, not the fake one of tests.
+	margin := config.DeadlineMargin
+	if max := time.Until(deadline) / 2; margin > max {
+		margin = max
+	}
+	if margin < 0 {
+		margin = 0
+	}
+
+	return context.WithDeadline(ctx, deadline.Add(-margin))
+}
+
+func handleRequest(ctx context.Context, e Event, stats *Stats) (ResultResponse, error) {
+	if e.InvocationId == diagnosticInvocationId {
+		return ResultResponse{
+			Records: []ResultRecord{},
+			Config:  describeConfig(config),
+		}, nil
+	}
+
+	if err := e.validate(); err != nil {
+		return ResultResponse{}, err
+	}
+
+	correlationId = newCorrelationId(ctx, e)
+	invocationLog.DeliveryStreamArn = e.DeliveryStreamArn
+	invocationLog.Records = len(e.Records)
+
+	if config.Sink == sinkStdout {
+		warnf("SINK=%s, records are printed rather than reingested. Never use this in production.", sinkStdout)
+	}
+
+	defer stats.emitMetrics()
+	ctx, cancel := withDeadlineMargin(ctx)
+	defer cancel()
+
+	dedup.begin()
+	start := clock.Now()
+	resultRecords, splitRecords := transformRecordsWithContext(ctx, e, stats)
+	stats.TransformTime = clock.Now().Sub(start)
 
 	ps := resultRecords.projectedSize()
 
-	recordsToReingest := []ResultRecord{}
-	putRecordBatches := [][]ResultRecord{}
+	recordsToReingest := []ReingestionRecord{}
 	totalRecordsToBeReingested := 0
 
-	inputDataByRecId, err := e.getInputDataByRecId()
-	if err != nil {
-		return ResultResponse{}, err
+	// Transforming the records decodes them too, so records that can't be
+	// decoded have already failed; this only makes sure of it.
+	inputDataByRecId, decodeErrs := e.getInputDataByRecId()
+	for idx, r := range resultRecords {
+		if err, ok := decodeErrs[r.RecordId]; ok && r.Result != resultStatusFailed {
+			stats.fail(r.RecordId, failReasonBase64, err)
+			ps -= len(r.RecordId) + len(r.Data)
+			resultRecords[idx] = ResultRecord{RecordId: r.RecordId, Result: resultStatusFailed}
+		}
+	}
+
+	for _, sr := range splitRecords {
+		totalRecordsToBeReingested++
+		recordsToReingest = append(recordsToReingest, sr.getReingestionRecord(e.isSas()))
+	}
+
+	// takeOut reingests the record at idx rather than returning it.
+	takeOut := func(idx int, rtrs []ReingestionRecord) {
+		totalRecordsToBeReingested += len(rtrs)
+		recordsToReingest = append(recordsToReingest, rtrs...)
+
+		ps -= len(resultRecords[idx].RecordId) + len(resultRecords[idx].Data)
+		resultRecords[idx].Data = ""
+		resultRecords[idx].Result = resultStatusDropped
+		stats.drop(dropReasonSizeLimit)
+	}
+
+	// A record too large for the response on its own is taken out wherever
+	// it is, and split, as it would otherwise come back just as large.
+	limit := responseLimit()
+	for idx, r := range resultRecords {
+		if r.Result != resultStatusOk || len(r.RecordId)+len(r.Data) <= limit {
+			continue
+		}
+
+		var rtrs []ReingestionRecord
+		var splitErr error
+		if config.OversizeRecord == oversizeRecordReingest {
+			rtrs, splitErr = splitOversizeRecord(inputDataByRecId[r.RecordId].getReingestionRecord(e.isSas()), r)
+		}
+		if splitErr != nil {
+			warnf("Failed to split record %s, which is over the %d bytes response limit on its own. %s\n", r.RecordId, limit, splitErr)
+		}
+		if len(rtrs) == 0 {
+			stats.fail(r.RecordId, failReasonLimit, fmt.Errorf("Over the %d bytes response limit on its own", limit))
+			ps -= len(r.RecordId) + len(r.Data)
+			resultRecords[idx] = ResultRecord{RecordId: r.RecordId, Result: resultStatusFailed}
+			continue
+		}
+
+		takeOut(idx, rtrs)
 	}
 
-	// 6000000 instead of 6291456 to leave ample headroom for the stuff we
-	// didn't account for.
-	for idx := 0; idx < len(e.Records) && ps > 6000000; idx++ {
+	for idx := 0; idx < len(e.Records) && ps > limit; idx++ {
 		r := resultRecords[idx]
 		if r.Result == resultStatusOk {
-			totalRecordsToBeReingested++
 			rtr := inputDataByRecId[r.RecordId].getReingestionRecord(e.isSas())
-			recordsToReingest = append(recordsToReingest, rtr)
+			if config.ReingestData == reingestDataTransformed {
+				if trtr, err := transformedReingestionRecord(rtr, r); err != nil {
+					warnf("Failed to reingest the transformed data of record %s, reingesting the original. %s\n", r.RecordId, err)
+				} else {
+					rtr = trtr
+				}
+			}
+			takeOut(idx, []ReingestionRecord{rtr})
+		}
+	}
 
-			r.Data = ""
-			ps -= len(r.Data)
+	batchSize := batchSizeFor(e.streamName())
+	putRecordBatches := batchRecords(recordsToReingest, batchSize, e.maxBatchBytes())
 
-			resultRecords[idx].Result = resultStatusDropped
+	if len(putRecordBatches) > 0 {
+		delivered, err := putBatches(ctx, e, putRecordBatches, totalRecordsToBeReingested)
+		stats.Reingested = delivered
+		if err != nil {
+			pbe := &putBatchesError{}
+			if config.PutFailure != putFailureMarkFailed || !errors.As(err, &pbe) {
+				return ResultResponse{}, err
+			}
 
-			if len(recordsToReingest) > 500 {
-				putRecordBatches = append(putRecordBatches, recordsToReingest)
-				recordsToReingest = []ResultRecord{}
+			errorf("Marking the records that could not be reingested as failed. %s\n", err)
+			for _, id := range resultRecords.markFailed(pbe.unput) {
+				stats.fail(id, failReasonReingest, nil)
 			}
 		}
+	} else {
+		debugf("No records needed to be reingested.")
 	}
 
-	if len(recordsToReingest) > 0 {
-		// add the last batch
-		putRecordBatches = append(putRecordBatches, recordsToReingest)
+	if err := forwardToTransformDlq(ctx, e, resultRecords, inputDataByRecId, stats); err != nil {
+		// The failed records still go to Firehose's processing-failed
+		// output, so this is not worth failing the whole invocation, and
+		// with it the records that were transformed fine, over.
+		warnf("Failed to forward failed records to the transform DLQ. %s\n", err)
 	}
 
-	if len(putRecordBatches) > 0 {
-		if err := putBatches(e, putRecordBatches, totalRecordsToBeReingested); err != nil {
-			return ResultResponse{}, err
-		}
-	} else {
-		fmt.Printf("No records needed to be reingested.")
+	stats.ResponseBytes = ps
+	stats.Results = map[string]int{}
+	for _, r := range resultRecords {
+		stats.Results[r.Result]++
+		stats.OutputBytes += base64.StdEncoding.DecodedLen(len(r.Data))
+	}
+
+	if config.Sink == sinkStdout {
+		printResultRecords(resultRecords)
 	}
 
 	return ResultResponse{
@@ -1,10 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/stretchr/testify/require"
 )
 
@@ -43,6 +56,133 @@ func TestHandleRequest(t *testing.T) {
 	require.Equal(t, rr, r)
 }
 
+func TestHandleRequestMissingStreamARNs(t *testing.T) {
+	e := Event{
+		InvocationId: "not-used",
+		Region:       "us-east-1",
+		Records: []EventRecord{
+			{
+				RecordId: "1",
+				Data:     "dGVzdAo=",
+			},
+		},
+	}
+
+	r, err := HandleRequest(context.Background(), e)
+	require.EqualError(t, err, "Event has neither a deliveryStreamArn nor a sourceKinesisStreamArn")
+	require.Equal(t, ResultResponse{}, r)
+}
+
+func TestHandleRequestNoRecords(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		records []EventRecord
+	}{
+		{name: "nil", records: nil},
+		{name: "empty", records: []EventRecord{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			captureLogs(t)
+			fh, ks := withFakeAPIs(t)
+			withConfig(t, func(c *Config) {
+				c.TransformDlqStream = "TransformDLQ"
+			})
+
+			e := Event{
+				InvocationId:      "not-used",
+				DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+				Region:            "us-east-1",
+				Records:           tc.records,
+			}
+
+			r, err := HandleRequest(context.Background(), e)
+			require.NoError(t, err)
+			require.Empty(t, r.Records)
+			require.Empty(t, fh.inputs)
+			require.Empty(t, ks.inputs)
+
+			// Firehose expects a list of records, even an empty one.
+			b, err := json.Marshal(r)
+			require.NoError(t, err)
+			require.JSONEq(t, `{"records":[]}`, string(b))
+		})
+	}
+}
+
+func TestEventValidate(t *testing.T) {
+	records := []EventRecord{{RecordId: "1", Data: "dGVzdAo="}}
+
+	for _, tc := range []struct {
+		name           string
+		event          Event
+		awsRegion      string
+		expectedError  string
+		expectedRegion string
+	}{
+		{
+			name: "valid",
+			event: Event{
+				DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+				Region:            "us-west-2",
+				Records:           records,
+			},
+			awsRegion:      "eu-west-1",
+			expectedRegion: "us-west-2",
+		},
+		{
+			name: "region from the environment",
+			event: Event{
+				SourceKinesisStreamArn: "arn:aws:kinesis:us-east-1:1234567890:stream/DataLog",
+				Records:                records,
+			},
+			awsRegion:      "eu-west-1",
+			expectedRegion: "eu-west-1",
+		},
+		{
+			name: "region from the stream ARN",
+			event: Event{
+				DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+				Records:           []EventRecord{},
+			},
+			expectedRegion: "us-east-1",
+		},
+		{
+			name:          "no stream ARN",
+			event:         Event{Records: records},
+			expectedError: "Event has neither a deliveryStreamArn nor a sourceKinesisStreamArn",
+		},
+		{
+			name: "no stream name",
+			event: Event{
+				DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:DataLog",
+				Records:           records,
+			},
+			expectedError: `Event stream ARN "arn:aws:firehose:us-east-1:1234567890:DataLog" has no stream name`,
+		},
+		{
+			name: "nil records",
+			event: Event{
+				DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+			},
+			expectedRegion: "us-east-1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("AWS_REGION", tc.awsRegion)
+
+			e := tc.event
+			err := e.validate()
+			if tc.expectedError != "" {
+				require.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedRegion, e.Region)
+			require.NotNil(t, e.Records)
+		})
+	}
+}
+
 func TestEventRecordCreateReingestionRecord(t *testing.T) {
 	for _, tc := range []struct {
 		data         string
@@ -71,7 +211,7 @@ func TestEventRecordCreateReingestionRecord(t *testing.T) {
 			rr, err := er.createReingestionRecord(tc.isSas)
 			require.NoError(t, err)
 
-			require.Equal(t, tc.expectedData, rr.Data)
+			require.Equal(t, []byte(tc.expectedData), rr.Data)
 			if tc.isSas {
 				require.Equal(t, "fakeKey", rr.PartitionKey)
 			} else {
@@ -143,17 +283,231 @@ func TestEventGetInputDataByRecId(t *testing.T) {
 				},
 			}
 
-			inputDataByRecId, err := e.getInputDataByRecId()
-			require.NoError(t, err)
+			inputDataByRecId, decodeErrs := e.getInputDataByRecId()
+			require.Empty(t, decodeErrs)
 
 			rr := inputDataByRecId["12345"]
 
-			require.Equal(t, tc.expectedData, rr.Data)
+			require.Equal(t, []byte(tc.expectedData), rr.Data)
+		})
+	}
+}
+
+func TestEventGetInputDataByRecIdLargeEvent(t *testing.T) {
+	// Run with -race to check the parallel decode for data races.
+	e := Event{
+		SourceKinesisStreamArn: "arn:aws:kinesis:us-east-1:1234567890:stream/DataLog",
+	}
+	for i := 0; i < 5000; i++ {
+		e.Records = append(e.Records, EventRecord{
+			RecordId: strconv.Itoa(i),
+			Data:     base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("data-%d", i))),
+			KinesisMetadata: KinesisRecordMetadata{
+				PartitionKey: fmt.Sprintf("key-%d", i),
+			},
 		})
 	}
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			inputDataByRecId, decodeErrs := e.getInputDataByRecId()
+			require.Empty(t, decodeErrs)
+			require.Len(t, inputDataByRecId, len(e.Records))
+
+			for i := 0; i < len(e.Records); i++ {
+				rr := inputDataByRecId[strconv.Itoa(i)]
+				require.Equal(t, []byte(fmt.Sprintf("data-%d", i)), rr.Data)
+				require.Equal(t, fmt.Sprintf("key-%d", i), rr.PartitionKey)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestEventGetInputDataByRecIdInvalidData(t *testing.T) {
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: "dGVzdAo="},
+			{RecordId: "2", Data: "not base64!"},
+		},
+	}
+
+	inputDataByRecId, decodeErrs := e.getInputDataByRecId()
+	require.Equal(t, []byte("test\n"), inputDataByRecId["1"].Data)
+	require.NotContains(t, inputDataByRecId, "2")
+	require.Len(t, decodeErrs, 1)
+	require.Error(t, decodeErrs["2"])
+}
+
+func TestReingestionRecordGetReingestionRecord(t *testing.T) {
+	rr := ReingestionRecord{
+		Data:         []byte{0x1f, 0x8b, 0xff, 0x00},
+		PartitionKey: "fakeKey",
+	}
+
+	require.Equal(t, rr, rr.getReingestionRecord(true))
+	require.Equal(t, ReingestionRecord{Data: rr.Data}, rr.getReingestionRecord(false))
+}
+
+func TestEventGetInputDataByRecIdBinaryData(t *testing.T) {
+	data := []byte{0x1f, 0x8b, 0x08, 0x00, 0xff, 0xfe, 0x80, 0xc3, 0x28}
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: base64.StdEncoding.EncodeToString(data)},
+		},
+	}
+
+	inputDataByRecId, decodeErrs := e.getInputDataByRecId()
+	require.Empty(t, decodeErrs)
+	require.Equal(t, data, inputDataByRecId["1"].Data)
+}
+
+// fakeFirehoseAPI records the puts made to it. Each put gets the next of
+// outputs and errs, if any are left, and succeeds otherwise. Every put is
+// given requestId as its AWS request id.
+type fakeFirehoseAPI struct {
+	inputs    []*firehose.PutRecordBatchInput
+	outputs   []*firehose.PutRecordBatchOutput
+	errs      []error
+	requestId string
+}
+
+func (f *fakeFirehoseAPI) PutRecordBatchWithContext(
+	ctx aws.Context,
+	in *firehose.PutRecordBatchInput,
+	opts ...request.Option,
+) (*firehose.PutRecordBatchOutput, error) {
+	f.inputs = append(f.inputs, in)
+	completeFakeRequest(f.requestId, opts)
+
+	out := &firehose.PutRecordBatchOutput{FailedPutCount: aws.Int64(0)}
+	for range in.Records {
+		out.RequestResponses = append(out.RequestResponses, &firehose.PutRecordBatchResponseEntry{})
+	}
+	if len(f.outputs) > 0 {
+		out, f.outputs = f.outputs[0], f.outputs[1:]
+	}
+	var err error
+	if len(f.errs) > 0 {
+		err, f.errs = f.errs[0], f.errs[1:]
+	}
+
+	return out, err
+}
+
+// fakeKinesisAPI is the Kinesis equivalent of fakeFirehoseAPI.
+type fakeKinesisAPI struct {
+	inputs    []*kinesis.PutRecordsInput
+	outputs   []*kinesis.PutRecordsOutput
+	errs      []error
+	requestId string
+}
+
+// completeFakeRequest runs the Complete handlers that opts add to a request,
+// as the SDK would once it is done, for a request with the given id.
+func completeFakeRequest(requestId string, opts []request.Option) {
+	r := &request.Request{RequestID: requestId}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.Handlers.Complete.Run(r)
+}
+
+func (f *fakeKinesisAPI) PutRecordsWithContext(
+	ctx aws.Context,
+	in *kinesis.PutRecordsInput,
+	opts ...request.Option,
+) (*kinesis.PutRecordsOutput, error) {
+	f.inputs = append(f.inputs, in)
+	completeFakeRequest(f.requestId, opts)
+
+	out := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for range in.Records {
+		out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{})
+	}
+	if len(f.outputs) > 0 {
+		out, f.outputs = f.outputs[0], f.outputs[1:]
+	}
+	var err error
+	if len(f.errs) > 0 {
+		err, f.errs = f.errs[0], f.errs[1:]
+	}
+
+	return out, err
+}
+
+// withFakeAPIs replaces the reingestion clients with fakes, and the clock
+// with a fake one so retries don't wait, for the duration of a test.
+func withFakeAPIs(t *testing.T) (*fakeFirehoseAPI, *fakeKinesisAPI) {
+	fh, ks := &fakeFirehoseAPI{}, &fakeKinesisAPI{}
+
+	origFirehose, origKinesis := newFirehoseAPI, newKinesisAPI
+	t.Cleanup(func() {
+		newFirehoseAPI, newKinesisAPI = origFirehose, origKinesis
+	})
+	newFirehoseAPI = func(string) firehoseAPI { return fh }
+	newKinesisAPI = func(string) kinesisAPI { return ks }
+	withFakeClock(t)
+
+	return fh, ks
 }
 
-func TestResultRecordGetReingestionRecord(t *testing.T) {
+func TestPutBatchesBinaryData(t *testing.T) {
+	batch := []ReingestionRecord{
+		{Data: []byte{0x1f, 0x8b, 0xff, 0x00, 0xfe}, PartitionKey: "key-1"},
+		{Data: []byte{0x80, 0x81, 0xc3, 0x28}, PartitionKey: "key-2"},
+	}
+
+	t.Run("firehose", func(t *testing.T) {
+		fh, _ := withFakeAPIs(t)
+
+		e := Event{DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog"}
+		_, err := putBatches(context.Background(), e, [][]ReingestionRecord{batch}, len(batch))
+		require.NoError(t, err)
+
+		require.Len(t, fh.inputs, 1)
+		require.Equal(t, "DataLog", *fh.inputs[0].DeliveryStreamName)
+		require.Len(t, fh.inputs[0].Records, len(batch))
+		for i, r := range fh.inputs[0].Records {
+			require.Equal(t, batch[i].Data, r.Data)
+		}
+	})
+
+	t.Run("kinesis", func(t *testing.T) {
+		_, ks := withFakeAPIs(t)
+
+		e := Event{SourceKinesisStreamArn: "arn:aws:kinesis:us-east-1:1234567890:stream/DataLog"}
+		_, err := putBatches(context.Background(), e, [][]ReingestionRecord{batch}, len(batch))
+		require.NoError(t, err)
+
+		require.Len(t, ks.inputs, 1)
+		require.Equal(t, "DataLog", *ks.inputs[0].StreamName)
+		require.Len(t, ks.inputs[0].Records, len(batch))
+		for i, r := range ks.inputs[0].Records {
+			require.Equal(t, batch[i].Data, r.Data)
+			require.Equal(t, batch[i].PartitionKey, *r.PartitionKey)
+		}
+	})
+
+	t.Run("kinesis long partition key", func(t *testing.T) {
+		_, ks := withFakeAPIs(t)
+
+		long := []ReingestionRecord{
+			{Data: []byte("a"), PartitionKey: strings.Repeat("k", maxPartitionKeyLength+1)},
+		}
+		e := Event{SourceKinesisStreamArn: "arn:aws:kinesis:us-east-1:1234567890:stream/DataLog"}
+		_, err := putBatches(context.Background(), e, [][]ReingestionRecord{long}, len(long))
+		require.NoError(t, err)
+
+		require.Len(t, ks.inputs, 1)
+		key := *ks.inputs[0].Records[0].PartitionKey
+		require.True(t, validPartitionKey(key))
+		require.Equal(t, fitPartitionKey(long[0].PartitionKey), key)
+	})
 }
 
 func TestGunzip(t *testing.T) {
@@ -162,15 +516,1962 @@ func TestGunzip(t *testing.T) {
 func TestTransformRecords(t *testing.T) {
 }
 
+func TestTransformRecordsEmptyData(t *testing.T) {
+	for _, tc := range []struct {
+		data             string
+		dropEmptyRecords bool
+		expectedResult   string
+	}{
+		{
+			data:             "",
+			dropEmptyRecords: true,
+			expectedResult:   resultStatusDropped,
+		},
+		{
+			data:             "",
+			dropEmptyRecords: false,
+			expectedResult:   resultStatusFailed,
+		},
+		{
+			// Valid base64 that decodes to no bytes at all.
+			data:             "\r\n",
+			dropEmptyRecords: true,
+			expectedResult:   resultStatusDropped,
+		},
+		{
+			data:             "\r\n",
+			dropEmptyRecords: false,
+			expectedResult:   resultStatusFailed,
+		},
+	} {
+		t.Run(fmt.Sprintf("%q-dropEmptyRecords-%t", tc.data, tc.dropEmptyRecords), func(t *testing.T) {
+			captureLogs(t)
+			withConfig(t, func(c *Config) {
+				c.DropEmptyRecords = tc.dropEmptyRecords
+			})
+
+			e := Event{
+				Records: []EventRecord{
+					{RecordId: "1", Data: tc.data},
+				},
+			}
+
+			stats := &Stats{}
+			resultRecords, _ := transformRecords(e, stats)
+			require.Equal(t, ResultRecordList{
+				{RecordId: "1", Result: tc.expectedResult},
+			}, resultRecords)
+			if tc.expectedResult == resultStatusDropped {
+				require.Equal(t, 1, stats.Dropped[dropReasonEmptyRecord])
+			}
+		})
+	}
+}
+
+func TestEventRecordUnmarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		json            string
+		expectedData    string
+		expectedMissing bool
+	}{
+		{
+			name:         "data",
+			json:         `{"recordId":"1","data":"dGVzdAo=","approximateArrivalTimestamp":1621224132233}`,
+			expectedData: "dGVzdAo=",
+		},
+		{
+			name: "empty data",
+			json: `{"recordId":"1","data":""}`,
+		},
+		{
+			name:            "absent data",
+			json:            `{"recordId":"1"}`,
+			expectedMissing: true,
+		},
+		{
+			name:            "null data",
+			json:            `{"recordId":"1","data":null}`,
+			expectedMissing: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			er := EventRecord{}
+			require.NoError(t, json.Unmarshal([]byte(tc.json), &er))
+			require.Equal(t, "1", er.RecordId)
+			require.Equal(t, tc.expectedData, er.Data)
+			require.Equal(t, tc.expectedMissing, er.dataMissing)
+		})
+	}
+
+	er := EventRecord{}
+	require.NoError(t, json.Unmarshal([]byte(`{"recordId":"1","approximateArrivalTimestamp":1621224132233}`), &er))
+	require.Equal(t, 1621224132233, er.ApproximateArrivalTimestamp)
+}
+
+func TestHandleRequestMissingData(t *testing.T) {
+	e := Event{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"deliveryStreamArn": "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		"records": [
+			{"recordId": "absent"},
+			{"recordId": "empty", "data": ""}
+		]
+	}`), &e))
+
+	for _, tc := range []struct {
+		missingData      string
+		expectedResult   string
+		expectedDropped  int
+		expectedLogEntry string
+	}{
+		{
+			missingData:      missingDataDrop,
+			expectedResult:   resultStatusDropped,
+			expectedDropped:  1,
+			expectedLogEntry: "Dropping record absent: record has no data field",
+		},
+		{
+			missingData:      missingDataFail,
+			expectedResult:   resultStatusFailed,
+			expectedLogEntry: "Failing record absent: missing_data. Record has no data field",
+		},
+	} {
+		t.Run(tc.missingData, func(t *testing.T) {
+			logs := captureLogs(t)
+			withConfig(t, func(c *Config) {
+				c.MissingData = tc.missingData
+			})
+			withFakeAPIs(t)
+
+			r, stats, err := HandleRequestWithStats(context.Background(), e)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedResult, r.Records[0].Result)
+			require.Equal(t, tc.expectedDropped, stats.Dropped[dropReasonMissingData])
+			require.Contains(t, logs.String(), tc.expectedLogEntry)
+
+			// Empty data is still told apart from missing data.
+			require.Equal(t, resultStatusDropped, r.Records[1].Result)
+			require.Equal(t, 1, stats.Dropped[dropReasonEmptyRecord])
+		})
+	}
+}
+
 func TestResultRecordListProjectedSize(t *testing.T) {
 }
 
-// Skipping these tests for now...
-// func TestPutRecordsToKinesisStream(t *testing.T) {
-// }
+// messageJson returns m as JSON.
+func messageJson(t *testing.T, m Message) []byte {
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
 
-// func TestPutRecordsToFirehoseStream(t *testing.T) {
-// }
+	return data
+}
 
-// func TestPutBatches(t *testing.T) {
-// }
+// encodeMessage returns m as base64 encoded, gzipped JSON, the way CWL
+// delivers it to Firehose.
+func encodeMessage(t *testing.T, m Message) string {
+	return base64.StdEncoding.EncodeToString(gzipMessage(t, m))
+}
+
+func TestTransformRecordsRecordPerLogEvent(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.RecordPerLogEvent = true
+	})
+
+	m := Message{
+		MessageType: dataMessage,
+		LogGroup:    "DataLog",
+		LogStream:   "stream",
+		LogEvents: []LogEvent{
+			{Id: "a", Timestamp: 1, Message: "first"},
+			{Id: "b", Timestamp: 2, Message: "second"},
+			{Id: "c", Timestamp: 3, Message: "third"},
+		},
+	}
+
+	e := Event{
+		SourceKinesisStreamArn: "arn:aws:kinesis:us-east-1:1234567890:stream/DataLog",
+		Records: []EventRecord{
+			{
+				RecordId:        "1",
+				Data:            encodeMessage(t, m),
+				KinesisMetadata: KinesisRecordMetadata{PartitionKey: "key"},
+			},
+		},
+	}
+
+	resultRecords, splitRecords := transformRecords(e, &Stats{})
+
+	require.Len(t, resultRecords, 1)
+	require.Equal(t, resultStatusOk, resultRecords[0].Result)
+	data, err := base64.StdEncoding.DecodeString(resultRecords[0].Data)
+	require.NoError(t, err)
+	require.Equal(t, "first\n", string(data))
+	require.Equal(t, len("1")+len(resultRecords[0].Data), resultRecords.projectedSize())
+
+	require.Len(t, splitRecords, 2)
+	for i, sr := range splitRecords {
+		require.Equal(t, "key", sr.PartitionKey)
+
+		b := &bytes.Buffer{}
+		require.NoError(t, gunzip(b, sr.Data))
+
+		split := Message{}
+		require.NoError(t, json.Unmarshal(b.Bytes(), &split))
+		require.Equal(t, m.LogGroup, split.LogGroup)
+		require.Equal(t, []LogEvent{m.LogEvents[i+1]}, split.LogEvents)
+	}
+}
+
+func TestReconstructMessage(t *testing.T) {
+	m := &Message{
+		MessageType:         dataMessage,
+		Owner:               "1234567890",
+		LogGroup:            "DataLog",
+		LogStream:           "stream",
+		SubscriptionFilters: []string{"filter"},
+		LogEvents: []LogEvent{
+			{Id: "a", Timestamp: 1, Message: "first"},
+			{Id: "b", Timestamp: 2, Message: "second"},
+		},
+	}
+
+	out, err := reconstructMessage(m, m.LogEvents[1:])
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"messageType": "DATA_MESSAGE",
+		"owner": "1234567890",
+		"logGroup": "DataLog",
+		"logStream": "stream",
+		"subscriptionFilters": ["filter"],
+		"logEvents": [{"id": "b", "timestamp": 2, "message": "second"}]
+	}`, out)
+	require.NotContains(t, out, "\n")
+
+	// The original message is left untouched.
+	require.Len(t, m.LogEvents, 2)
+}
+
+func TestTransformRecordsCwlOutputFormat(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.OutputFormat = outputFormatCwl
+	})
+
+	m := Message{
+		MessageType:         dataMessage,
+		Owner:               "1234567890",
+		LogGroup:            "DataLog",
+		LogStream:           "stream",
+		SubscriptionFilters: []string{"filter"},
+		LogEvents: []LogEvent{
+			{Id: "a", Timestamp: 1, Message: "first"},
+			{Id: "b", Timestamp: 2, Message: "second"},
+		},
+	}
+
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, m)},
+		},
+	}
+
+	resultRecords, _ := transformRecords(e, &Stats{})
+
+	require.Len(t, resultRecords, 1)
+	require.Equal(t, resultStatusOk, resultRecords[0].Result)
+	data, err := base64.StdEncoding.DecodeString(resultRecords[0].Data)
+	require.NoError(t, err)
+
+	reemitted := Message{}
+	require.NoError(t, json.Unmarshal(data, &reemitted))
+	require.Equal(t, m, reemitted)
+}
+
+// gzipMessage returns m as gzipped JSON, the way it is reingested.
+func gzipMessage(t *testing.T, m Message) []byte {
+	b := &bytes.Buffer{}
+	require.NoError(t, gzipCompress(b, messageJson(t, m)))
+
+	return b.Bytes()
+}
+
+func TestCombineRecords(t *testing.T) {
+	records := []ReingestionRecord{}
+	for i := 0; i < 10; i++ {
+		records = append(records, ReingestionRecord{
+			Data: gzipMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents: []LogEvent{
+					{Id: strconv.Itoa(i), Message: fmt.Sprintf("message %d", i)},
+				},
+			}),
+		})
+	}
+	maxSize := 3 * len(records[0].Data)
+
+	combined, err := combineRecords(records, maxSize)
+	require.NoError(t, err)
+	require.True(t, len(combined) > 1)
+	require.True(t, len(combined) < len(records))
+
+	// Every combined record respects the size limit and together they hold
+	// every original message, in order.
+	messages := []*Message{}
+	for _, c := range combined {
+		require.True(t, len(c.Data) <= maxSize, "%d > %d", len(c.Data), maxSize)
+
+		b := &bytes.Buffer{}
+		require.NoError(t, gunzip(b, c.Data))
+
+		decoded, err := decodeMessages(b.Bytes())
+		require.NoError(t, err)
+		messages = append(messages, decoded...)
+	}
+
+	require.Len(t, messages, len(records))
+	for i, m := range messages {
+		require.Equal(t, fmt.Sprintf("message %d", i), m.LogEvents[0].Message)
+	}
+}
+
+func TestCombineRecordsOversizeRecord(t *testing.T) {
+	small := ReingestionRecord{Data: gzipMessage(t, Message{MessageType: dataMessage})}
+	large := ReingestionRecord{Data: bytes.Repeat([]byte{0x1f}, 1000)}
+
+	combined, err := combineRecords([]ReingestionRecord{small, large}, len(small.Data)+10)
+	require.NoError(t, err)
+	require.Len(t, combined, 2)
+	require.Contains(t, combined, large)
+}
+
+func TestTransformRecordsCombinedRecord(t *testing.T) {
+	records := []ReingestionRecord{
+		{Data: gzipMessage(t, Message{
+			MessageType: dataMessage,
+			LogEvents:   []LogEvent{{Id: "a", Message: "first"}},
+		})},
+		{Data: gzipMessage(t, Message{MessageType: controlMessage})},
+		{Data: gzipMessage(t, Message{
+			MessageType: dataMessage,
+			LogEvents:   []LogEvent{{Id: "b", Message: "second"}},
+		})},
+	}
+
+	combined, err := combineRecords(records, maxFirehoseRecordSize)
+	require.NoError(t, err)
+	require.Len(t, combined, 1)
+
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: base64.StdEncoding.EncodeToString(combined[0].Data)},
+		},
+	}
+
+	resultRecords, _ := transformRecords(e, &Stats{})
+	require.Len(t, resultRecords, 1)
+	require.Equal(t, resultStatusOk, resultRecords[0].Result)
+	data, err := base64.StdEncoding.DecodeString(resultRecords[0].Data)
+	require.NoError(t, err)
+	require.Equal(t, "first\nsecond\n", string(data))
+}
+
+func TestPutBatchesCombineRecords(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.CombineRecords = true
+	})
+	fh, _ := withFakeAPIs(t)
+
+	batch := []ReingestionRecord{}
+	for i := 0; i < 5; i++ {
+		batch = append(batch, ReingestionRecord{Data: gzipMessage(t, Message{
+			MessageType: dataMessage,
+			LogEvents:   []LogEvent{{Id: strconv.Itoa(i), Message: "message"}},
+		})})
+	}
+
+	e := Event{DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog"}
+	_, err := putBatches(context.Background(), e, [][]ReingestionRecord{batch}, len(batch))
+	require.NoError(t, err)
+
+	require.Len(t, fh.inputs, 1)
+	require.Len(t, fh.inputs[0].Records, 1)
+}
+
+func TestBatchRecords(t *testing.T) {
+	records := func(n int) []ReingestionRecord {
+		return make([]ReingestionRecord, n)
+	}
+	sizes := func(batches [][]ReingestionRecord) []int {
+		s := []int{}
+		for _, b := range batches {
+			s = append(s, len(b))
+		}
+		return s
+	}
+
+	require.Equal(t, []int{}, sizes(batchRecords(records(0), 500, maxPutRecordBatchBytes)))
+	require.Equal(t, []int{1}, sizes(batchRecords(records(1), 500, maxPutRecordBatchBytes)))
+	require.Equal(t, []int{500}, sizes(batchRecords(records(500), 500, maxPutRecordBatchBytes)))
+	require.Equal(t, []int{500, 1}, sizes(batchRecords(records(501), 500, maxPutRecordBatchBytes)))
+	require.Equal(t, []int{500, 500}, sizes(batchRecords(records(1000), 500, maxPutRecordBatchBytes)))
+
+	t.Run("byte limit", func(t *testing.T) {
+		sized := func(n ...int) []ReingestionRecord {
+			rs := []ReingestionRecord{}
+			for _, s := range n {
+				rs = append(rs, ReingestionRecord{Data: make([]byte, s)})
+			}
+			return rs
+		}
+
+		require.Equal(t, []int{2, 1}, sizes(batchRecords(sized(4, 6, 1), 500, 10)))
+		require.Equal(t, []int{1, 2, 1}, sizes(batchRecords(sized(8, 5, 5, 3), 500, 10)))
+		require.Equal(t, []int{1, 1}, sizes(batchRecords(sized(20, 20), 500, 10)))
+		require.Equal(t, []int{2, 2}, sizes(batchRecords(sized(1, 1, 1, 1), 2, 10)))
+
+		withKeys := []ReingestionRecord{
+			{Data: make([]byte, 4), PartitionKey: "ab"},
+			{Data: make([]byte, 4), PartitionKey: "ab"},
+		}
+		require.Equal(t, []int{1, 1}, sizes(batchRecords(withKeys, 500, 10)))
+	})
+}
+
+func TestEventMaxBatchBytes(t *testing.T) {
+	require.Equal(t, maxPutRecordBatchBytes, (&Event{}).maxBatchBytes())
+	require.Equal(t, maxPutRecordsBytes, (&Event{SourceKinesisStreamArn: "arn:aws:kinesis:us-east-1:1234567890:stream/DataLog"}).maxBatchBytes())
+}
+
+func TestHandleRequestReingestsExactlyOneFullBatch(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.RecordPerLogEvent = true
+	})
+	fh, _ := withFakeAPIs(t)
+
+	// The first log event is kept, the other 500 are split off and
+	// reingested.
+	m := Message{MessageType: dataMessage}
+	for i := 0; i < 501; i++ {
+		m.LogEvents = append(m.LogEvents, LogEvent{Id: strconv.Itoa(i), Message: "message"})
+	}
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, m)},
+		},
+	}
+
+	_, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+
+	require.Len(t, fh.inputs, 1)
+	require.Len(t, fh.inputs[0].Records, 500)
+}
+
+func TestPutBatchesBeforePut(t *testing.T) {
+	fh, _ := withFakeAPIs(t)
+
+	orig := BeforePut
+	t.Cleanup(func() {
+		BeforePut = orig
+	})
+	BeforePut = func(ctx context.Context, records []ReingestionRecord) ([]ReingestionRecord, error) {
+		kept := []ReingestionRecord{}
+		for _, r := range records {
+			if !bytes.HasPrefix(r.Data, []byte("drop")) {
+				kept = append(kept, r)
+			}
+		}
+		return kept, nil
+	}
+
+	e := Event{DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog"}
+	batches := [][]ReingestionRecord{
+		{{Data: []byte("keep 1")}, {Data: []byte("drop 1")}, {Data: []byte("keep 2")}},
+		{{Data: []byte("drop 2")}},
+	}
+	_, err := putBatches(context.Background(), e, batches, 4)
+	require.NoError(t, err)
+
+	// The second batch is left empty by the hook, so it isn't put at all.
+	require.Len(t, fh.inputs, 1)
+	require.Len(t, fh.inputs[0].Records, 2)
+	require.Equal(t, []byte("keep 1"), fh.inputs[0].Records[0].Data)
+	require.Equal(t, []byte("keep 2"), fh.inputs[0].Records[1].Data)
+}
+
+func TestPutBatchesBeforePutError(t *testing.T) {
+	fh, _ := withFakeAPIs(t)
+
+	orig := BeforePut
+	t.Cleanup(func() {
+		BeforePut = orig
+	})
+	BeforePut = func(ctx context.Context, records []ReingestionRecord) ([]ReingestionRecord, error) {
+		return nil, errors.New("rejected")
+	}
+
+	e := Event{DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog"}
+	_, err := putBatches(context.Background(), e, [][]ReingestionRecord{{{Data: []byte("a")}}}, 1)
+	require.EqualError(t, err, "rejected")
+	require.Empty(t, fh.inputs)
+}
+
+func TestTransformRecordsJoinsLogEventsByDefault(t *testing.T) {
+	m := Message{
+		MessageType: dataMessage,
+		LogEvents: []LogEvent{
+			{Id: "a", Message: "first"},
+			{Id: "b", Message: "second"},
+		},
+	}
+
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, m)},
+		},
+	}
+
+	resultRecords, splitRecords := transformRecords(e, &Stats{})
+
+	require.Len(t, resultRecords, 1)
+	require.Empty(t, splitRecords)
+	data, err := base64.StdEncoding.DecodeString(resultRecords[0].Data)
+	require.NoError(t, err)
+	require.Equal(t, "first\nsecond\n", string(data))
+}
+
+func TestTransformRecordsSortLogEvents(t *testing.T) {
+	m := Message{
+		MessageType: dataMessage,
+		LogEvents: []LogEvent{
+			{Id: "b", Timestamp: 1621224044002, Message: "second"},
+			{Id: "a", Timestamp: 1621224044001, Message: "first"},
+		},
+	}
+
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, m)},
+		},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		sort     bool
+		expected string
+	}{
+		{name: "sorted", sort: true, expected: "first\nsecond\n"},
+		{name: "original order", sort: false, expected: "second\nfirst\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.SortLogEvents = tc.sort
+			})
+
+			resultRecords, _ := transformRecords(e, &Stats{})
+
+			require.Len(t, resultRecords, 1)
+			data, err := base64.StdEncoding.DecodeString(resultRecords[0].Data)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, string(data))
+		})
+	}
+}
+
+func TestTransformRecordsMaxLogEventsPerRecord(t *testing.T) {
+	m := Message{
+		MessageType: dataMessage,
+		LogGroup:    "DataLog",
+		LogEvents: []LogEvent{
+			{Id: "a", Message: "first"},
+			{Id: "b", Message: "second"},
+			{Id: "c", Message: "third"},
+		},
+	}
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, m)},
+		},
+	}
+
+	t.Run("drop", func(t *testing.T) {
+		logs := captureLogs(t)
+		withConfig(t, func(c *Config) {
+			c.MaxLogEventsPerRecord = 2
+			c.LogEventsOverCap = logEventsOverCapDrop
+		})
+
+		resultRecords, splitRecords := transformRecords(e, &Stats{})
+
+		require.Len(t, resultRecords, 1)
+		data, err := base64.StdEncoding.DecodeString(resultRecords[0].Data)
+		require.NoError(t, err)
+		require.Equal(t, "first\nsecond\n", string(data))
+		require.Empty(t, splitRecords)
+		require.Contains(t, logs.String(), "Dropping 1 log events over the cap of 2 of record 1")
+	})
+
+	t.Run("reingest", func(t *testing.T) {
+		captureLogs(t)
+		withConfig(t, func(c *Config) {
+			c.MaxLogEventsPerRecord = 1
+			c.LogEventsOverCap = logEventsOverCapReingest
+		})
+
+		resultRecords, splitRecords := transformRecords(e, &Stats{})
+
+		require.Len(t, resultRecords, 1)
+		data, err := base64.StdEncoding.DecodeString(resultRecords[0].Data)
+		require.NoError(t, err)
+		require.Equal(t, "first\n", string(data))
+
+		require.Len(t, splitRecords, 1)
+		require.Equal(t, "1", splitRecords[0].SourceRecordId)
+		b := &bytes.Buffer{}
+		require.NoError(t, gunzip(b, splitRecords[0].Data))
+		overflow := Message{}
+		require.NoError(t, json.Unmarshal(b.Bytes(), &overflow))
+		require.Equal(t, "DataLog", overflow.LogGroup)
+		require.Equal(t, m.LogEvents[1:], overflow.LogEvents)
+	})
+
+	t.Run("under the cap", func(t *testing.T) {
+		withConfig(t, func(c *Config) {
+			c.MaxLogEventsPerRecord = 3
+		})
+
+		resultRecords, splitRecords := transformRecords(e, &Stats{})
+
+		data, err := base64.StdEncoding.DecodeString(resultRecords[0].Data)
+		require.NoError(t, err)
+		require.Equal(t, "first\nsecond\nthird\n", string(data))
+		require.Empty(t, splitRecords)
+	})
+}
+
+func TestTransformRecordsMaxDecompressedBytes(t *testing.T) {
+	captureLogs(t)
+
+	m := Message{
+		MessageType: dataMessage,
+		LogEvents: []LogEvent{
+			{Id: "a", Message: "some message"},
+		},
+	}
+	size := len(messageJson(t, m))
+
+	// The second record takes the event over the limit, so the third and
+	// fourth are reingested untransformed.
+	withConfig(t, func(c *Config) {
+		c.MaxDecompressedBytes = 2*size - 1
+	})
+
+	e := Event{}
+	for _, id := range []string{"1", "2", "3", "4"} {
+		e.Records = append(e.Records, EventRecord{RecordId: id, Data: encodeMessage(t, m)})
+	}
+
+	stats := &Stats{}
+	resultRecords, splitRecords := transformRecords(e, stats)
+
+	require.Len(t, resultRecords, 4)
+	require.Equal(t, resultStatusOk, resultRecords[0].Result)
+	require.Equal(t, resultStatusOk, resultRecords[1].Result)
+	require.Equal(t, ResultRecord{RecordId: "3", Result: resultStatusDropped}, resultRecords[2])
+	require.Equal(t, ResultRecord{RecordId: "4", Result: resultStatusDropped}, resultRecords[3])
+	require.Len(t, splitRecords, 2)
+	require.Equal(t, "3", splitRecords[0].SourceRecordId)
+	require.Equal(t, "4", splitRecords[1].SourceRecordId)
+	data, err := base64.StdEncoding.DecodeString(e.Records[2].Data)
+	require.NoError(t, err)
+	require.Equal(t, data, splitRecords[0].Data)
+	require.Equal(t, map[string]int{dropReasonSizeLimit: 2}, stats.Dropped)
+	require.Empty(t, stats.Failures)
+	require.Equal(t, 2, stats.DecompressedRecords)
+	require.Equal(t, 4, stats.Records)
+}
+
+func TestTransformRecordsMissingPartitionKey(t *testing.T) {
+	m := Message{
+		MessageType: dataMessage,
+		LogEvents: []LogEvent{
+			{Id: "a", Message: "first"},
+			{Id: "b", Message: "second"},
+		},
+	}
+
+	for _, tc := range []struct {
+		missingPartitionKey string
+		expectedResult      string
+		expectedSplitKeys   []string
+	}{
+		{
+			missingPartitionKey: missingPartitionKeyFail,
+			expectedResult:      resultStatusFailed,
+			expectedSplitKeys:   []string{"key"},
+		},
+		{
+			missingPartitionKey: missingPartitionKeyRecordId,
+			expectedResult:      resultStatusOk,
+			expectedSplitKeys:   []string{"key", "2"},
+		},
+	} {
+		t.Run(tc.missingPartitionKey, func(t *testing.T) {
+			captureLogs(t)
+			withConfig(t, func(c *Config) {
+				c.RecordPerLogEvent = true
+				c.MissingPartitionKey = tc.missingPartitionKey
+			})
+
+			e := Event{
+				SourceKinesisStreamArn: "arn:aws:kinesis:us-east-1:1234567890:stream/DataLog",
+				Records: []EventRecord{
+					{
+						RecordId:        "1",
+						Data:            encodeMessage(t, m),
+						KinesisMetadata: KinesisRecordMetadata{PartitionKey: "key"},
+					},
+					{
+						RecordId: "2",
+						Data:     encodeMessage(t, m),
+					},
+				},
+			}
+
+			resultRecords, splitRecords := transformRecords(e, &Stats{})
+			require.Len(t, resultRecords, 2)
+			require.Equal(t, resultStatusOk, resultRecords[0].Result)
+			require.Equal(t, tc.expectedResult, resultRecords[1].Result)
+
+			keys := []string{}
+			for _, r := range splitRecords {
+				keys = append(keys, r.PartitionKey)
+			}
+			require.Equal(t, tc.expectedSplitKeys, keys)
+
+			inputDataByRecId, decodeErrs := e.getInputDataByRecId()
+			require.Empty(t, decodeErrs)
+			require.Equal(t, "key", inputDataByRecId["1"].PartitionKey)
+			if tc.missingPartitionKey == missingPartitionKeyRecordId {
+				require.Equal(t, "2", inputDataByRecId["2"].PartitionKey)
+			}
+		})
+	}
+}
+
+func TestTransformRecordsMissingPartitionKeyNotSas(t *testing.T) {
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{
+				RecordId: "1",
+				Data: encodeMessage(t, Message{
+					MessageType: dataMessage,
+					LogEvents:   []LogEvent{{Id: "a", Message: "first"}},
+				}),
+			},
+		},
+	}
+
+	resultRecords, _ := transformRecords(e, &Stats{})
+	require.Equal(t, resultStatusOk, resultRecords[0].Result)
+}
+
+func TestTransformRecordsRecordHeader(t *testing.T) {
+	m := Message{
+		MessageType: dataMessage,
+		LogEvents: []LogEvent{
+			{Id: "a", Message: "first"},
+			{Id: "b", Message: "second"},
+		},
+	}
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, m)},
+			{RecordId: "2", Data: encodeMessage(t, Message{MessageType: controlMessage})},
+		},
+	}
+
+	for _, tc := range []struct {
+		name         string
+		outputFormat string
+		expected     string
+	}{
+		{name: "raw", outputFormat: outputFormatRaw, expected: "index=main\nfirst\nsecond\n"},
+		{name: "kv", outputFormat: outputFormatKv, expected: "index=main\n" +
+			"timestamp=0 log_group=\"\" log_stream=\"\" message=\"first\"\n" +
+			"timestamp=0 log_group=\"\" log_stream=\"\" message=\"second\"\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.RecordHeader = "index=main"
+				c.OutputFormat = tc.outputFormat
+			})
+
+			resultRecords, _ := transformRecords(e, &Stats{})
+
+			require.Len(t, resultRecords, 2)
+			data, err := base64.StdEncoding.DecodeString(resultRecords[0].Data)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, string(data))
+
+			// Dropped records get no header.
+			require.Equal(t, resultStatusDropped, resultRecords[1].Result)
+			require.Empty(t, resultRecords[1].Data)
+		})
+	}
+}
+
+func TestTransformRecordsGzipResponse(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.GzipResponse = true
+		c.OutputFormat = outputFormatCwl
+	})
+
+	m := Message{
+		MessageType: dataMessage,
+		LogGroup:    "DataLog",
+		LogStream:   "stream",
+		LogEvents: []LogEvent{
+			{Id: "a", Timestamp: 1, Message: "first"},
+			{Id: "b", Timestamp: 2, Message: "second"},
+		},
+	}
+
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, m)},
+		},
+	}
+
+	resultRecords, _ := transformRecords(e, &Stats{})
+	require.Len(t, resultRecords, 1)
+	require.Equal(t, resultStatusOk, resultRecords[0].Result)
+	require.Equal(t, &ResultMetadata{
+		PartitionKeys: map[string]string{"contentEncoding": "gzip"},
+	}, resultRecords[0].Metadata)
+
+	gzipped, err := base64.StdEncoding.DecodeString(resultRecords[0].Data)
+	require.NoError(t, err)
+	b := &bytes.Buffer{}
+	require.NoError(t, gunzip(b, gzipped))
+	require.JSONEq(t, string(messageJson(t, m)), b.String())
+
+	// The compressed data makes it through the transform again unchanged.
+	e.Records[0].Data = resultRecords[0].Data
+	again, _ := transformRecords(e, &Stats{})
+	require.Equal(t, resultRecords, again)
+}
+
+func TestTransformRecordsUncompressedResponseHasNoMetadata(t *testing.T) {
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "a", Message: "first"}},
+			})},
+		},
+	}
+
+	resultRecords, _ := transformRecords(e, &Stats{})
+	require.Nil(t, resultRecords[0].Metadata)
+
+	b, err := json.Marshal(resultRecords[0])
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "metadata")
+}
+
+func TestTransformRecordsJsonArrayMessages(t *testing.T) {
+	first := string(messageJson(t, Message{
+		MessageType: dataMessage,
+		LogEvents:   []LogEvent{{Id: "a", Message: "first"}},
+	}))
+	second := string(messageJson(t, Message{
+		MessageType: dataMessage,
+		LogEvents:   []LogEvent{{Id: "b", Message: "second"}},
+	}))
+	control := string(messageJson(t, Message{MessageType: controlMessage}))
+
+	b := &bytes.Buffer{}
+	require.NoError(t, gzipCompress(b, []byte(" ["+first+", "+control+", "+second+"]")))
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: base64.StdEncoding.EncodeToString(b.Bytes())},
+		},
+	}
+
+	for _, tc := range []struct {
+		name              string
+		jsonArrayMessages bool
+		expectedResult    string
+		expectedData      string
+	}{
+		{name: "disabled", expectedResult: resultStatusFailed},
+		{name: "enabled", jsonArrayMessages: true, expectedResult: resultStatusOk, expectedData: "first\nsecond\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.JsonArrayMessages = tc.jsonArrayMessages
+			})
+
+			resultRecords, _ := transformRecords(e, &Stats{})
+
+			require.Len(t, resultRecords, 1)
+			require.Equal(t, tc.expectedResult, resultRecords[0].Result)
+			data, err := base64.StdEncoding.DecodeString(resultRecords[0].Data)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedData, string(data))
+		})
+	}
+}
+
+func TestTransformRecordsNonCwlJson(t *testing.T) {
+	gzipped := func(data string) string {
+		b := &bytes.Buffer{}
+		require.NoError(t, gzipCompress(b, []byte(data)))
+		return base64.StdEncoding.EncodeToString(b.Bytes())
+	}
+	cwl := string(messageJson(t, Message{
+		MessageType: dataMessage,
+		LogEvents:   []LogEvent{{Id: "a", Message: "from cwl"}},
+	}))
+
+	for _, tc := range []struct {
+		name              string
+		forwardNonCwlJson bool
+		outputFormat      string
+		data              string
+		expectedResult    string
+		expectedData      string
+	}{
+		{
+			name:           "strict",
+			data:           `{"level":"info","msg":"direct"}`,
+			expectedResult: resultStatusFailed,
+		},
+		{
+			name:              "lenient",
+			forwardNonCwlJson: true,
+			data:              `{"level":"info","msg":"direct"}`,
+			expectedResult:    resultStatusOk,
+			expectedData:      "{\"level\":\"info\",\"msg\":\"direct\"}\n",
+		},
+		{
+			name:              "lenient pretty printed",
+			forwardNonCwlJson: true,
+			data:              "{\n  \"level\": \"info\",\n  \"msg\": \"direct\"\n}",
+			expectedResult:    resultStatusOk,
+			expectedData:      "{\"level\":\"info\",\"msg\":\"direct\"}\n",
+		},
+		{
+			name:              "lenient formatted",
+			forwardNonCwlJson: true,
+			outputFormat:      outputFormatHec,
+			data:              `{"msg":"direct"}`,
+			expectedResult:    resultStatusOk,
+			expectedData:      `{"time":1621224132.233,"sourcetype":"aws:cloudwatchlogs","event":"{\"msg\":\"direct\"}"}` + "\n",
+		},
+		{
+			name:              "lenient mixed",
+			forwardNonCwlJson: true,
+			data:              cwl + "\n" + `{"msg":"direct"}`,
+			expectedResult:    resultStatusOk,
+			expectedData:      "from cwl\n{\"msg\":\"direct\"}\n",
+		},
+		{
+			name:              "lenient unknown message type",
+			forwardNonCwlJson: true,
+			data:              `{"messageType":"SOMETHING_ELSE"}`,
+			expectedResult:    resultStatusFailed,
+		},
+		{
+			name:              "lenient not an object",
+			forwardNonCwlJson: true,
+			data:              `["a","b"]`,
+			expectedResult:    resultStatusFailed,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.ForwardNonCwlJson = tc.forwardNonCwlJson
+				if tc.outputFormat != "" {
+					c.OutputFormat = tc.outputFormat
+				}
+			})
+
+			e := Event{
+				Records: []EventRecord{
+					{RecordId: "1", ApproximateArrivalTimestamp: 1621224132233, Data: gzipped(tc.data)},
+				},
+			}
+
+			resultRecords, _ := transformRecords(e, &Stats{})
+			require.Equal(t, tc.expectedResult, resultRecords[0].Result)
+
+			data, err := base64.StdEncoding.DecodeString(resultRecords[0].Data)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedData, string(data))
+		})
+	}
+}
+
+func TestHandleRequestMaxResultBytes(t *testing.T) {
+	captureLogs(t)
+	fh, _ := withFakeAPIs(t)
+
+	m := Message{
+		MessageType: dataMessage,
+		LogEvents: []LogEvent{
+			{Id: "a", Message: strings.Repeat("x", 100*1024)},
+		},
+	}
+	data := encodeMessage(t, m)
+
+	// Each result holds about 137KB of base64 encoded data, so the limit is
+	// passed by the third record and the rest are reingested.
+	withConfig(t, func(c *Config) {
+		c.MaxResultBytes = 400 * 1024
+	})
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records:           []EventRecord{},
+	}
+	for i := 0; i < 10; i++ {
+		e.Records = append(e.Records, EventRecord{RecordId: strconv.Itoa(i), Data: data})
+	}
+
+	r, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	require.Len(t, r.Records, 10)
+	for i, rr := range r.Records {
+		if i < 3 {
+			require.Equal(t, resultStatusOk, rr.Result, i)
+		} else {
+			require.Equal(t, ResultRecord{RecordId: strconv.Itoa(i), Result: resultStatusDropped}, rr, i)
+		}
+	}
+
+	require.Len(t, fh.inputs, 1)
+	require.Len(t, fh.inputs[0].Records, 7)
+	gzipped, err := base64.StdEncoding.DecodeString(data)
+	require.NoError(t, err)
+	require.Equal(t, gzipped, fh.inputs[0].Records[0].Data)
+}
+
+func TestHandleRequestPutFailure(t *testing.T) {
+	twoEvents := encodeMessage(t, Message{
+		MessageType: dataMessage,
+		LogEvents: []LogEvent{
+			{Id: "a", Message: "first"},
+			{Id: "b", Message: "second"},
+		},
+	})
+	oneEvent := encodeMessage(t, Message{
+		MessageType: dataMessage,
+		LogEvents:   []LogEvent{{Id: "c", Message: "only"}},
+	})
+
+	for _, tc := range []struct {
+		putFailure string
+		expectErr  bool
+	}{
+		{putFailure: putFailureError, expectErr: true},
+		{putFailure: putFailureMarkFailed, expectErr: false},
+	} {
+		t.Run(tc.putFailure, func(t *testing.T) {
+			captureLogs(t)
+			fh, _ := withFakeAPIs(t)
+			fh.errs = []error{awserr.New("ResourceNotFoundException", "no such stream", nil)}
+			withConfig(t, func(c *Config) {
+				c.RecordPerLogEvent = true
+				c.PutFailure = tc.putFailure
+			})
+
+			e := Event{
+				DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+				Records: []EventRecord{
+					{RecordId: "1", Data: twoEvents},
+					{RecordId: "2", Data: oneEvent},
+					{RecordId: "3", Data: twoEvents},
+				},
+			}
+
+			r, err := HandleRequest(context.Background(), e)
+			require.Len(t, fh.inputs, 1)
+			if tc.expectErr {
+				require.Error(t, err)
+				require.Equal(t, ResultResponse{}, r)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Len(t, r.Records, 3)
+			require.Equal(t, ResultRecord{RecordId: "1", Result: resultStatusFailed}, r.Records[0])
+			require.Equal(t, resultStatusOk, r.Records[1].Result)
+			require.Equal(t, ResultRecord{RecordId: "3", Result: resultStatusFailed}, r.Records[2])
+		})
+	}
+}
+
+func TestResultRecordListMarkFailed(t *testing.T) {
+	rrl := ResultRecordList{
+		{RecordId: "1", Result: resultStatusOk, Data: "ZGF0YQ=="},
+		{RecordId: "2", Result: resultStatusDropped},
+		{RecordId: "3", Result: resultStatusOk, Data: "ZGF0YQ=="},
+	}
+
+	ids := rrl.markFailed([][]ReingestionRecord{
+		{{SourceRecordId: "2"}},
+		{{SourceRecordId: "3"}, {SourceRecordId: "3"}},
+	})
+	require.Equal(t, []string{"2", "3"}, ids)
+
+	require.Equal(t, ResultRecordList{
+		{RecordId: "1", Result: resultStatusOk, Data: "ZGF0YQ=="},
+		{RecordId: "2", Result: resultStatusFailed},
+		{RecordId: "3", Result: resultStatusFailed},
+	}, rrl)
+}
+
+func TestPutBatchesError(t *testing.T) {
+	captureLogs(t)
+	fh, _ := withFakeAPIs(t)
+	fh.errs = []error{nil, awserr.New("ResourceNotFoundException", "no such stream", nil)}
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+	}
+	batches := [][]ReingestionRecord{
+		{{Data: []byte("a"), SourceRecordId: "1"}},
+		{{Data: []byte("b"), SourceRecordId: "2"}},
+		{{Data: []byte("c"), SourceRecordId: "3"}},
+	}
+
+	delivered, err := putBatches(context.Background(), e, batches, 3)
+	pbe := &putBatchesError{}
+	require.True(t, errors.As(err, &pbe))
+	require.Equal(t, batches[1:], pbe.unput)
+	require.Len(t, fh.inputs, 2)
+	require.Equal(t, 1, delivered)
+}
+
+func TestPutBatchesCountsDeliveredRecordsAcrossRetries(t *testing.T) {
+	captureLogs(t)
+	e := Event{DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog"}
+	batch := []ReingestionRecord{{Data: []byte("a")}, {Data: []byte("b")}, {Data: []byte("c")}}
+	partial := &firehose.PutRecordBatchOutput{
+		FailedPutCount: aws.Int64(1),
+		RequestResponses: []*firehose.PutRecordBatchResponseEntry{
+			{RecordId: aws.String("1")},
+			{ErrorCode: aws.String("ServiceUnavailableException")},
+			{RecordId: aws.String("3")},
+		},
+	}
+	failed := &firehose.PutRecordBatchOutput{
+		FailedPutCount: aws.Int64(1),
+		RequestResponses: []*firehose.PutRecordBatchResponseEntry{
+			{ErrorCode: aws.String("AccessDeniedException")},
+		},
+	}
+
+	for _, tc := range []struct {
+		name              string
+		outputs           []*firehose.PutRecordBatchOutput
+		expectedDelivered int
+		expectError       bool
+	}{
+		{
+			name:              "retry succeeds",
+			outputs:           []*firehose.PutRecordBatchOutput{partial},
+			expectedDelivered: 3,
+		},
+		{
+			name:              "retry fails",
+			outputs:           []*firehose.PutRecordBatchOutput{partial, failed},
+			expectedDelivered: 2,
+			expectError:       true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fh, _ := withFakeAPIs(t)
+			fh.outputs = tc.outputs
+
+			delivered, err := putBatches(context.Background(), e, [][]ReingestionRecord{batch}, len(batch))
+			if tc.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expectedDelivered, delivered)
+
+			// Only the record that failed is put again.
+			require.Len(t, fh.inputs, 2)
+			require.Len(t, fh.inputs[0].Records, 3)
+			require.Equal(t, []*firehose.Record{{Data: []byte("b")}}, fh.inputs[1].Records)
+		})
+	}
+}
+
+func TestPutBatchesCountsCombinedRecords(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.CombineRecords = true
+	})
+	withFakeAPIs(t)
+
+	batch := []ReingestionRecord{}
+	for i := 0; i < 5; i++ {
+		batch = append(batch, ReingestionRecord{Data: gzipMessage(t, Message{
+			MessageType: dataMessage,
+			LogEvents:   []LogEvent{{Id: strconv.Itoa(i), Message: "message"}},
+		})})
+	}
+
+	e := Event{DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog"}
+	delivered, err := putBatches(context.Background(), e, [][]ReingestionRecord{batch}, len(batch))
+	require.NoError(t, err)
+	require.Equal(t, 5, delivered)
+}
+
+func TestPutBatchesReingestCompress(t *testing.T) {
+	plain := messageJson(t, Message{
+		MessageType: dataMessage,
+		LogEvents:   []LogEvent{{Id: "a", Message: "hello"}},
+	})
+	gzipped := gzipMessage(t, Message{
+		MessageType: dataMessage,
+		LogEvents:   []LogEvent{{Id: "b", Message: "already gzipped"}},
+	})
+	batch := []ReingestionRecord{
+		{Data: plain, PartitionKey: "k1"},
+		{Data: gzipped, PartitionKey: "k2"},
+	}
+
+	for _, tc := range []struct {
+		name  string
+		event Event
+		put   func(fh *fakeFirehoseAPI, ks *fakeKinesisAPI) [][]byte
+	}{
+		{
+			name: "kinesis",
+			event: Event{
+				SourceKinesisStreamArn: "arn:aws:kinesis:us-east-1:1234567890:stream/DataLog",
+			},
+			put: func(fh *fakeFirehoseAPI, ks *fakeKinesisAPI) [][]byte {
+				require.Len(t, ks.inputs, 1)
+				data := [][]byte{}
+				for _, r := range ks.inputs[0].Records {
+					data = append(data, r.Data)
+				}
+				return data
+			},
+		},
+		{
+			name: "firehose",
+			event: Event{
+				DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+			},
+			put: func(fh *fakeFirehoseAPI, ks *fakeKinesisAPI) [][]byte {
+				require.Len(t, fh.inputs, 1)
+				data := [][]byte{}
+				for _, r := range fh.inputs[0].Records {
+					data = append(data, r.Data)
+				}
+				return data
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			captureLogs(t)
+			fh, ks := withFakeAPIs(t)
+			withConfig(t, func(c *Config) {
+				c.ReingestCompress = true
+				c.DecompressionOrder = []string{compressionGzip, compressionNone}
+			})
+
+			_, err := putBatches(context.Background(), tc.event, [][]ReingestionRecord{batch}, len(batch))
+			require.NoError(t, err)
+
+			data := tc.put(fh, ks)
+			require.Len(t, data, 2)
+			require.True(t, isGzipped(data[0]))
+			require.Equal(t, gzipped, data[1])
+
+			// The compressed record transforms just like the original did.
+			e := Event{Records: []EventRecord{
+				{RecordId: "original", Data: base64.StdEncoding.EncodeToString(plain)},
+				{RecordId: "reingested", Data: base64.StdEncoding.EncodeToString(data[0])},
+			}}
+			resultRecords, _ := transformRecords(e, &Stats{})
+			require.Equal(t, resultStatusOk, resultRecords[1].Result)
+			require.Equal(t, resultRecords[0].Data, resultRecords[1].Data)
+		})
+	}
+}
+
+func TestPutBatchesReingestDelay(t *testing.T) {
+	captureLogs(t)
+	withConfig(t, func(c *Config) {
+		c.ReingestDelay = 250 * time.Millisecond
+	})
+	e := Event{DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog"}
+	batches := [][]ReingestionRecord{{{Data: []byte("a")}}, {{Data: []byte("b")}}, {{Data: []byte("c")}}}
+
+	t.Run("applied once", func(t *testing.T) {
+		fh, _ := withFakeAPIs(t)
+		c := withFakeClock(t)
+
+		_, err := putBatches(context.Background(), e, batches, 3)
+		require.NoError(t, err)
+		require.Equal(t, []time.Duration{250 * time.Millisecond}, c.slept)
+		require.Len(t, fh.inputs, 3)
+	})
+
+	t.Run("cancellable", func(t *testing.T) {
+		fh, _ := withFakeAPIs(t)
+		withConfig(t, func(c *Config) {
+			c.ReingestDelay = time.Hour
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := putBatches(ctx, e, batches, 3)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), context.Canceled.Error())
+
+		pbe := &putBatchesError{}
+		require.True(t, errors.As(err, &pbe))
+		require.Equal(t, batches, pbe.unput)
+		require.Empty(t, fh.inputs)
+	})
+}
+
+func TestIsGzipped(t *testing.T) {
+	require.True(t, isGzipped(gzipMessage(t, Message{})))
+	require.False(t, isGzipped([]byte("{}")))
+	require.False(t, isGzipped([]byte{0x1f}))
+	require.False(t, isGzipped(nil))
+}
+
+func TestPutBatchesCircuitBreaker(t *testing.T) {
+	terminal := awserr.New("ResourceNotFoundException", "no such stream", nil)
+
+	batches := [][]ReingestionRecord{}
+	for i := 0; i < 6; i++ {
+		batches = append(batches, []ReingestionRecord{{Data: []byte{byte('a' + i)}, SourceRecordId: strconv.Itoa(i)}})
+	}
+
+	for _, tc := range []struct {
+		name          string
+		threshold     int
+		errs          []error
+		expectedPuts  int
+		expectedUnput [][]ReingestionRecord
+		expectedOpen  bool
+	}{
+		{
+			name:          "trips",
+			threshold:     2,
+			errs:          []error{nil, terminal, terminal},
+			expectedPuts:  3,
+			expectedUnput: batches[1:],
+			expectedOpen:  true,
+		},
+		{
+			name:          "resets on success",
+			threshold:     2,
+			errs:          []error{terminal, nil, terminal, nil, terminal, nil},
+			expectedPuts:  6,
+			expectedUnput: [][]ReingestionRecord{batches[0], batches[2], batches[4]},
+		},
+		{
+			name:          "last batch",
+			threshold:     2,
+			errs:          []error{nil, nil, nil, nil, terminal, terminal},
+			expectedPuts:  6,
+			expectedUnput: batches[4:],
+		},
+		{
+			name:          "default stops at the first failure",
+			threshold:     1,
+			errs:          []error{terminal},
+			expectedPuts:  1,
+			expectedUnput: batches,
+			expectedOpen:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := captureLogs(t)
+			fh, _ := withFakeAPIs(t)
+			fh.errs = tc.errs
+			withConfig(t, func(c *Config) {
+				c.CircuitBreakerThreshold = tc.threshold
+			})
+
+			e := Event{
+				DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+			}
+
+			_, err := putBatches(context.Background(), e, batches, len(batches))
+			pbe := &putBatchesError{}
+			require.True(t, errors.As(err, &pbe))
+			require.Contains(t, err.Error(), "ResourceNotFoundException")
+			require.Equal(t, tc.expectedUnput, pbe.unput)
+			require.Len(t, fh.inputs, tc.expectedPuts)
+
+			metrics.flush(emitMetric)
+			if tc.expectedOpen {
+				require.Contains(t, b.String(), "circuit breaker open")
+				require.Contains(t, b.String(), "metric CircuitBreakerOpen=1 unit=Count")
+			} else {
+				require.NotContains(t, b.String(), "circuit breaker open")
+			}
+		})
+	}
+}
+
+func TestClassify(t *testing.T) {
+	captureLogs(t)
+	fh, _ := withFakeAPIs(t)
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "data", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "a", Message: "hello"}},
+			})},
+			{RecordId: "control", Data: encodeMessage(t, Message{MessageType: controlMessage})},
+			{RecordId: "empty", Data: ""},
+			{RecordId: "not gzipped", Data: "dGVzdAo="},
+			{RecordId: "unknown", Data: encodeMessage(t, Message{MessageType: "SOMETHING_ELSE"})},
+		},
+	}
+
+	results := classify(e)
+	require.Equal(t, map[string]string{
+		"data":        resultStatusOk,
+		"control":     resultStatusDropped,
+		"empty":       resultStatusDropped,
+		"not gzipped": resultStatusFailed,
+		"unknown":     resultStatusFailed,
+	}, results)
+	require.Empty(t, fh.inputs)
+	require.Empty(t, metrics.values)
+
+	r, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	require.Len(t, r.Records, len(results))
+	for _, rr := range r.Records {
+		require.Equal(t, results[rr.RecordId], rr.Result, rr.RecordId)
+	}
+}
+
+func TestEventBoundedPrefix(t *testing.T) {
+	e := Event{
+		Records: []EventRecord{
+			{Data: "aaaa"},
+			{Data: "bbbb"},
+			{Data: "cccc"},
+		},
+	}
+
+	require.Equal(t, 3, e.boundedPrefix(0))
+	require.Equal(t, 3, e.boundedPrefix(12))
+	require.Equal(t, 2, e.boundedPrefix(11))
+	require.Equal(t, 1, e.boundedPrefix(4))
+	require.Equal(t, 0, e.boundedPrefix(3))
+	require.Equal(t, 0, (&Event{}).boundedPrefix(1))
+}
+
+func TestHandleRequestMaxInputBytes(t *testing.T) {
+	captureLogs(t)
+	fh, _ := withFakeAPIs(t)
+
+	// A synthetic event of about 6MB, in 1MB records of incompressible data.
+	random := make([]byte, 750*1024)
+	for i := range random {
+		random[i] = byte(i*7919 + i/251)
+	}
+	data := encodeMessage(t, Message{
+		MessageType: dataMessage,
+		LogEvents:   []LogEvent{{Id: "a", Message: base64.StdEncoding.EncodeToString(random)}},
+	})
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+	}
+	for i := 0; i < 6; i++ {
+		e.Records = append(e.Records, EventRecord{RecordId: strconv.Itoa(i), Data: data})
+	}
+
+	withConfig(t, func(c *Config) {
+		c.MaxInputBytes = 4 * len(data)
+	})
+
+	r, stats, err := HandleRequestWithStats(context.Background(), e)
+	require.NoError(t, err)
+	require.Len(t, r.Records, 6)
+	require.Equal(t, 4, stats.DecompressedRecords)
+	require.Equal(t, ResultRecord{RecordId: "4", Result: resultStatusDropped}, r.Records[4])
+	require.Equal(t, ResultRecord{RecordId: "5", Result: resultStatusDropped}, r.Records[5])
+	require.Equal(t, map[string]int{dropReasonSizeLimit: 2}, stats.Dropped)
+	require.Empty(t, stats.Failures)
+
+	var reingested int
+	for _, input := range fh.inputs {
+		reingested += len(input.Records)
+	}
+	require.Equal(t, 2, reingested)
+}
+
+func TestHandleRequestResponseLimit(t *testing.T) {
+	captureLogs(t)
+	fh, _ := withFakeAPIs(t)
+
+	data := encodeMessage(t, Message{
+		MessageType: dataMessage,
+		LogEvents:   []LogEvent{{Id: "a", Message: strings.Repeat("x", 300)}},
+	})
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+	}
+	for i := 0; i < 3; i++ {
+		e.Records = append(e.Records, EventRecord{RecordId: strconv.Itoa(i), Data: data})
+	}
+
+	// Each record takes up about 400 bytes of the response, so only two fit in
+	// the 1000 bytes less 100 of headroom.
+	withConfig(t, func(c *Config) {
+		c.MaxResponseBytes = 1000
+		c.HeadroomBytes = 100
+	})
+
+	r, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	require.Equal(t, resultStatusDropped, r.Records[0].Result)
+	require.Equal(t, resultStatusOk, r.Records[1].Result)
+	require.Equal(t, resultStatusOk, r.Records[2].Result)
+	require.Len(t, fh.inputs, 1)
+	require.Len(t, fh.inputs[0].Records, 1)
+}
+
+// Skipping these tests for now...
+// func TestPutRecordsToKinesisStream(t *testing.T) {
+// }
+
+// func TestPutRecordsToFirehoseStream(t *testing.T) {
+// }
+
+// func TestPutBatches(t *testing.T) {
+// }
+
+func TestStreamOverrides(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.StreamBatchSizes = map[string]int{"DataLog": 100, "Invalid": 0, "TooBig": 1000}
+		c.StreamMaxAttempts = map[string]int{"DataLog": 3, "Invalid": -1}
+	})
+
+	for _, tc := range []struct {
+		stream              string
+		expectedBatchSize   int
+		expectedMaxAttempts int
+	}{
+		{stream: "DataLog", expectedBatchSize: 100, expectedMaxAttempts: 3},
+		{stream: "Other", expectedBatchSize: maxPutRecordBatchRecords, expectedMaxAttempts: defaultMaxPutAttempts},
+		{stream: "Invalid", expectedBatchSize: maxPutRecordBatchRecords, expectedMaxAttempts: defaultMaxPutAttempts},
+		{stream: "TooBig", expectedBatchSize: maxPutRecordBatchRecords, expectedMaxAttempts: defaultMaxPutAttempts},
+	} {
+		t.Run(tc.stream, func(t *testing.T) {
+			require.Equal(t, tc.expectedBatchSize, batchSizeFor(tc.stream))
+			require.Equal(t, tc.expectedMaxAttempts, maxAttemptsFor(tc.stream))
+		})
+	}
+}
+
+func TestPutBatchStreamMaxAttempts(t *testing.T) {
+	throttled := awserr.New("ThrottlingException", "slow down", nil)
+	batch := []ReingestionRecord{{Data: []byte("a")}}
+
+	for _, tc := range []struct {
+		name             string
+		arn              string
+		expectedAttempts int
+	}{
+		{
+			name:             "override",
+			arn:              "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+			expectedAttempts: 2,
+		},
+		{
+			name:             "default",
+			arn:              "arn:aws:firehose:us-east-1:1234567890:deliverystream/Other",
+			expectedAttempts: defaultMaxPutAttempts,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			captureLogs(t)
+			withConfig(t, func(c *Config) {
+				c.StreamMaxAttempts = map[string]int{"DataLog": 2}
+			})
+			fh, _ := withFakeAPIs(t)
+			for i := 0; i < defaultMaxPutAttempts; i++ {
+				fh.errs = append(fh.errs, throttled)
+			}
+
+			_, err := putBatch(context.Background(), Event{DeliveryStreamArn: tc.arn}, batch)
+			require.Error(t, err)
+			require.Len(t, fh.inputs, tc.expectedAttempts)
+		})
+	}
+}
+
+// scriptedPutter is a recordPutter whose puts go as scripted, one step per
+// put, and that records the indexes each put was for.
+type scriptedPutter struct {
+	steps []scriptedPut
+	puts  [][]int
+}
+
+// scriptedPut is the outcome of a put: the error codes, keyed by the index
+// of their record, or else a whole request error. Without codes, every
+// record is put unless failedCount says otherwise.
+type scriptedPut struct {
+	codes       map[int]string
+	failedCount int64
+	err         error
+	// short drops the last response, as if the service had skipped it.
+	short bool
+}
+
+func (p *scriptedPutter) api() string {
+	return "ScriptedPut"
+}
+
+func (p *scriptedPutter) put(ctx context.Context, idxs []int, opts ...request.Option) ([]string, int64, error) {
+	p.puts = append(p.puts, idxs)
+	completeFakeRequest("req-1", opts)
+
+	step := scriptedPut{}
+	if len(p.steps) > 0 {
+		step, p.steps = p.steps[0], p.steps[1:]
+	}
+	if step.err != nil {
+		return nil, 0, step.err
+	}
+
+	codes := make([]string, 0, len(idxs))
+	for _, idx := range idxs {
+		codes = append(codes, step.codes[idx])
+	}
+	if step.short {
+		codes = codes[:len(codes)-1]
+	}
+	return codes, step.failedCount, nil
+}
+
+func TestPutRecordsWithRetry(t *testing.T) {
+	throttled := awserr.New("ThrottlingException", "slow down", nil)
+	notFound := awserr.New("ResourceNotFoundException", "no such stream", nil)
+
+	for _, tc := range []struct {
+		name              string
+		steps             []scriptedPut
+		expectedPuts      [][]int
+		expectedDelivered []bool
+		expectedCategory  string
+		expectedErr       string
+	}{
+		{
+			name:              "success",
+			expectedPuts:      [][]int{{0, 1, 2}},
+			expectedDelivered: []bool{true, true, true},
+		},
+		{
+			name:              "transport error then success",
+			steps:             []scriptedPut{{err: awserr.New("RequestError", "send request failed", errors.New("connection reset"))}},
+			expectedPuts:      [][]int{{0, 1, 2}, {0, 1, 2}},
+			expectedDelivered: []bool{true, true, true},
+		},
+		{
+			name: "partial failures then success",
+			steps: []scriptedPut{
+				{codes: map[int]string{0: "ServiceUnavailableException", 2: "ServiceUnavailableException"}, failedCount: 2},
+				{codes: map[int]string{2: "ServiceUnavailableException"}, failedCount: 1},
+			},
+			expectedPuts:      [][]int{{0, 1, 2}, {0, 2}, {2}},
+			expectedDelivered: []bool{true, true, true},
+		},
+		{
+			name:              "failed count without error codes then success",
+			steps:             []scriptedPut{{failedCount: 1}},
+			expectedPuts:      [][]int{{0, 1, 2}, {0, 1, 2}},
+			expectedDelivered: []bool{true, true, true},
+		},
+		{
+			name:              "short response then success",
+			steps:             []scriptedPut{{short: true}},
+			expectedPuts:      [][]int{{0, 1, 2}, {0, 1, 2}},
+			expectedDelivered: []bool{true, true, true},
+		},
+		{
+			name:              "terminal error",
+			steps:             []scriptedPut{{err: notFound}},
+			expectedPuts:      [][]int{{0, 1, 2}},
+			expectedDelivered: []bool{false, false, false},
+			expectedCategory:  errorTerminal,
+			expectedErr:       "Could not put records, the error is not retryable. ResourceNotFoundException: no such stream",
+		},
+		{
+			name: "terminal partial failure",
+			steps: []scriptedPut{
+				{codes: map[int]string{1: "KMSAccessDeniedException"}, failedCount: 1},
+			},
+			expectedPuts:      [][]int{{0, 1, 2}},
+			expectedDelivered: []bool{true, false, true},
+			expectedCategory:  errorTerminal,
+			expectedErr:       "Could not put records, the error is not retryable. Individual error codes: KMSAccessDeniedException, request id: req-1\n",
+		},
+		{
+			name:              "full failures until out of attempts",
+			steps:             []scriptedPut{{err: throttled}, {err: throttled}, {err: throttled}},
+			expectedPuts:      [][]int{{0, 1, 2}, {0, 1, 2}, {0, 1, 2}},
+			expectedDelivered: []bool{false, false, false},
+			expectedCategory:  errorRetryable,
+			expectedErr:       "Could not put records after 3 attempts. ThrottlingException: slow down",
+		},
+		{
+			name: "partial failures until out of attempts",
+			steps: []scriptedPut{
+				{codes: map[int]string{1: "ServiceUnavailableException", 2: "ServiceUnavailableException"}, failedCount: 2},
+				{codes: map[int]string{2: "ServiceUnavailableException"}, failedCount: 1},
+				{codes: map[int]string{2: "ServiceUnavailableException"}, failedCount: 1},
+			},
+			expectedPuts:      [][]int{{0, 1, 2}, {1, 2}, {2}},
+			expectedDelivered: []bool{true, true, false},
+			expectedCategory:  errorRetryable,
+			expectedErr:       "Could not put records after 3 attempts. Individual error codes: ServiceUnavailableException, request id: req-1\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			captureLogs(t)
+			withFakeClock(t)
+
+			p := &scriptedPutter{steps: tc.steps}
+			delivered, err := putRecordsWithRetry(context.Background(), p, 3, newBackoff(), 3)
+			require.Equal(t, tc.expectedPuts, p.puts)
+			require.Equal(t, tc.expectedDelivered, delivered)
+
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tc.expectedErr)
+			pe := &putError{}
+			require.True(t, errors.As(err, &pe))
+			require.Equal(t, tc.expectedCategory, pe.category)
+		})
+	}
+}
+
+func TestWithDeadlineMargin(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.DeadlineMargin = time.Second
+	})
+
+	ctx, cancel := withDeadlineMargin(context.Background())
+	defer cancel()
+	_, ok := ctx.Deadline()
+	require.False(t, ok)
+
+	deadline := time.Now().Add(time.Minute)
+	parent, cancelParent := context.WithDeadline(context.Background(), deadline)
+	defer cancelParent()
+	ctx, cancel = withDeadlineMargin(parent)
+	defer cancel()
+	d, ok := ctx.Deadline()
+	require.True(t, ok)
+	require.Equal(t, deadline.Add(-time.Second), d)
+
+	// A margin longer than half the time left is cut down to that.
+	withConfig(t, func(c *Config) {
+		c.DeadlineMargin = time.Hour
+	})
+	ctx, cancel = withDeadlineMargin(parent)
+	defer cancel()
+	d, ok = ctx.Deadline()
+	require.True(t, ok)
+	require.WithinDuration(t, deadline.Add(-30*time.Second), d, time.Second)
+}
+
+func TestHandleRequestDeadlineMargin(t *testing.T) {
+	b := captureLogs(t)
+	withFakeAPIs(t)
+	withConfig(t, func(c *Config) {
+		c.DeadlineMargin = time.Minute
+	})
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "a", Message: "hello"}},
+			})},
+		},
+	}
+
+	// Past the deadline already, so nothing is transformed.
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	r, err := HandleRequest(ctx, e)
+	require.NoError(t, err)
+	require.Equal(t, []ResultRecord{{RecordId: "1", Result: resultStatusFailed}}, r.Records)
+	require.Contains(t, b.String(), "Failing record 1: deadline. context deadline exceeded")
+
+	// A margin longer than the timeout still leaves half of it to work in.
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	r, err = HandleRequest(ctx, e)
+	require.NoError(t, err)
+	require.Equal(t, resultStatusOk, r.Records[0].Result)
+}
+
+func TestHandleRequestShortTimeout(t *testing.T) {
+	captureLogs(t)
+	withFakeAPIs(t)
+	withConfig(t, func(c *Config) {
+		c.DeadlineMargin = loadConfig().DeadlineMargin
+	})
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "a", Message: "hello"}},
+			})},
+		},
+	}
+
+	// Below Lambda's default timeout of 3s, with the default margin.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	r, err := HandleRequest(ctx, e)
+	require.NoError(t, err)
+	require.Equal(t, resultStatusOk, r.Records[0].Result)
+}
+
+func TestPutRecordsWithRetryDeadline(t *testing.T) {
+	captureLogs(t)
+	c := withFakeClock(t)
+
+	// The deadline is long past by the real clock too, so the context is
+	// done from the start.
+	ctx, cancel := context.WithDeadline(context.Background(), c.now.Add(time.Nanosecond))
+	defer cancel()
+
+	throttled := awserr.New("ThrottlingException", "slow down", nil)
+	p := &scriptedPutter{steps: []scriptedPut{{err: throttled}}}
+	delivered, err := putRecordsWithRetry(ctx, p, 2, newBackoff(), 3)
+	require.EqualError(t, err, "Could not put records after 1 attempts. No time left to retry before the deadline. ThrottlingException: slow down")
+	require.Equal(t, []bool{false, false}, delivered)
+	require.Equal(t, [][]int{{0, 1}}, p.puts)
+	require.Empty(t, c.slept)
+}
+
+func TestHandleRequestControlMessageHeartbeat(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		heartbeat   bool
+		messageType string
+		expected    bool
+	}{
+		{name: "control message", heartbeat: true, messageType: controlMessage, expected: true},
+		{name: "data message", heartbeat: true, messageType: dataMessage},
+		{name: "disabled", messageType: controlMessage},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			withConfig(t, func(c *Config) {
+				c.ControlMessageHeartbeat = tc.heartbeat
+			})
+			withFakeAPIs(t)
+
+			r, err := HandleRequest(context.Background(), Event{
+				DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+				Records: []EventRecord{
+					{RecordId: "1", Data: encodeMessage(t, Message{
+						MessageType: tc.messageType,
+						LogGroup:    "/aws/lambda/fn",
+						LogStream:   "stream",
+						LogEvents:   []LogEvent{{Id: "a", Message: "m"}},
+					})},
+				},
+			})
+			require.NoError(t, err)
+			if tc.messageType == controlMessage {
+				require.Equal(t, resultStatusDropped, r.Records[0].Result)
+			}
+
+			if tc.expected {
+				require.Contains(t, logs.String(), "subscription_heartbeat log_group=\"/aws/lambda/fn\" log_stream=\"stream\"\n")
+				require.Contains(t, logs.String(), "metric SubscriptionHeartbeats=1 unit=Count\n")
+			} else {
+				require.NotContains(t, logs.String(), "subscription_heartbeat")
+				require.NotContains(t, logs.String(), "SubscriptionHeartbeats")
+			}
+		})
+	}
+}
+
+func TestAwsConfig(t *testing.T) {
+	c := awsConfig("us-west-2")
+	require.Equal(t, "us-west-2", aws.StringValue(c.Region))
+	require.Equal(t, aws.UseServiceDefaultRetries, aws.IntValue(c.MaxRetries))
+
+	withConfig(t, func(c *Config) {
+		c.SdkMaxRetries = 0
+	})
+	require.Equal(t, 0, aws.IntValue(awsConfig("us-west-2").MaxRetries))
+}
+
+func TestClassifyLeavesDedupAlone(t *testing.T) {
+	captureLogs(t)
+	withDedup(t, 100)
+	withFakeAPIs(t)
+
+	dedup.hold("0", []string{"a"})
+	dedup.commit(ResultRecordList{{RecordId: "0", Result: resultStatusOk}})
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "a", Message: "seen"}},
+			})},
+			{RecordId: "2", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "b", Message: "new"}},
+			})},
+		},
+	}
+
+	// What the container has seen counts, but nothing is held for or
+	// counted by a later invocation.
+	require.Equal(t, map[string]string{
+		"1": resultStatusDropped,
+		"2": resultStatusOk,
+	}, classify(e))
+	require.Empty(t, dedup.held)
+	require.Empty(t, metrics.values)
+
+	r, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	require.Equal(t, resultStatusDropped, r.Records[0].Result)
+	require.Equal(t, resultStatusOk, r.Records[1].Result)
+}
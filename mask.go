@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// maskFields replaces the values of the config.MaskFields of a JSON object
+// message with config.MaskToken, leaving the rest of it alone. Fields are
+// dot separated paths, such as "user.email"; a path through an array
+// masks the field in each of its elements. Messages that aren't JSON
+// objects, or have none of the fields, are returned as is.
+func maskFields(message string) string {
+	if len(config.MaskFields) == 0 || !strings.HasPrefix(strings.TrimSpace(message), "{") {
+		return message
+	}
+
+	d := json.NewDecoder(strings.NewReader(message))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return message
+	}
+
+	masked := false
+	for _, path := range config.MaskFields {
+		if maskPath(v, strings.Split(path, ".")) {
+			masked = true
+		}
+	}
+	if !masked {
+		return message
+	}
+
+	b := &bytes.Buffer{}
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return message
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// maskPath masks the field at path within v, telling whether there was one.
+func maskPath(v interface{}, path []string) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		child, ok := v[path[0]]
+		if !ok {
+			return false
+		}
+		if len(path) == 1 {
+			v[path[0]] = config.MaskToken
+			return true
+		}
+		return maskPath(child, path[1:])
+
+	case []interface{}:
+		masked := false
+		for _, child := range v {
+			if maskPath(child, path) {
+				masked = true
+			}
+		}
+		return masked
+	}
+
+	return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaskFields(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.MaskFields = []string{"user.email", "password", "cards.number"}
+		c.MaskToken = "****"
+	})
+
+	for _, tc := range []struct {
+		name     string
+		message  string
+		expected string
+	}{
+		{
+			name:     "nested",
+			message:  `{"level":"info","user":{"id":42,"email":"a@example.com","name":"A"}}`,
+			expected: `{"level":"info","user":{"email":"****","id":42,"name":"A"}}`,
+		},
+		{
+			name:     "top level",
+			message:  `{"password":"hunter2","msg":"login"}`,
+			expected: `{"msg":"login","password":"****"}`,
+		},
+		{
+			name:     "object value",
+			message:  `{"password":{"old":"a","new":"b"}}`,
+			expected: `{"password":"****"}`,
+		},
+		{
+			name:     "array",
+			message:  `{"cards":[{"number":"4111111111111111","exp":"01/30"},{"number":"5500000000000004"}]}`,
+			expected: `{"cards":[{"exp":"01/30","number":"****"},{"number":"****"}]}`,
+		},
+		{
+			name:     "no masked fields",
+			message:  `{"user": {"id": 42}, "b": 1.50}`,
+			expected: `{"user": {"id": 42}, "b": 1.50}`,
+		},
+		{
+			name:     "numbers and html kept as is",
+			message:  `{"password":"x","big":12345678901234567890,"html":"<b>&</b>"}`,
+			expected: `{"big":12345678901234567890,"html":"<b>&</b>","password":"****"}`,
+		},
+		{
+			name:     "not JSON",
+			message:  "password=hunter2",
+			expected: "password=hunter2",
+		},
+		{
+			name:     "invalid JSON",
+			message:  `{"password":`,
+			expected: `{"password":`,
+		},
+		{
+			name:     "path through a scalar",
+			message:  `{"user":"a@example.com"}`,
+			expected: `{"user":"a@example.com"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, maskFields(tc.message))
+		})
+	}
+}
+
+func TestTransformLogEventMaskFields(t *testing.T) {
+	l := LogEvent{Message: `{"user":{"email":"a@example.com"}}`}
+
+	require.Equal(t, l.Message, mustTransformLogEvent(t, l))
+
+	withConfig(t, func(c *Config) {
+		c.MaskFields = []string{"user.email"}
+		c.MaskToken = "[masked]"
+	})
+	require.Equal(t, `{"user":{"email":"[masked]"}}`, mustTransformLogEvent(t, l))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// metricAccumulator adds up the values of metrics counted during an
+// invocation, possibly from several goroutines at once, so each is emitted
+// just once at the end of it rather than every time it is counted.
+type metricAccumulator struct {
+	mu     sync.Mutex
+	values map[string]float64
+	units  map[string]string
+}
+
+// metrics accumulates the metrics of the current invocation. It is flushed
+// by Stats.emitMetrics.
+var metrics = &metricAccumulator{}
+
+// add adds value to the metric called name.
+func (a *metricAccumulator) add(name string, value float64, unit string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.values == nil {
+		a.values = map[string]float64{}
+		a.units = map[string]string{}
+	}
+	a.values[name] += value
+	a.units[name] = unit
+}
+
+// flush emits the accumulated metrics with emit, sorted by name, and starts
+// over.
+func (a *metricAccumulator) flush(emit func(name string, value float64, unit string)) {
+	a.mu.Lock()
+	values, units := a.values, a.units
+	a.values, a.units = nil, nil
+	a.mu.Unlock()
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		emit(name, values[name], units[name])
+	}
+}
+
+// countMetric adds value to a metric that is emitted at the end of the
+// invocation. It is safe to call from several goroutines.
+func countMetric(name string, value float64, unit string) {
+	metrics.add(name, value, unit)
+}
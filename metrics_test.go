@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricAccumulator(t *testing.T) {
+	b := captureLogs(t)
+	a := &metricAccumulator{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				a.add("Puts", 1, "Count")
+				a.add("Bytes", 2, "Bytes")
+			}
+		}()
+	}
+	wg.Wait()
+
+	a.flush(emitMetric)
+	require.Equal(t, "metric Bytes=10000 unit=Bytes\nmetric Puts=5000 unit=Count\n", b.String())
+
+	// Flushing starts over.
+	b.Reset()
+	a.flush(emitMetric)
+	require.Empty(t, b.String())
+}
+
+func TestStatsEmitMetricsFlushesAccumulatedMetrics(t *testing.T) {
+	b := captureLogs(t)
+	countMetric("RetryableErrors", 1, "Count")
+	countMetric("RetryableErrors", 1, "Count")
+
+	(&Stats{}).emitMetrics()
+	require.Contains(t, b.String(), "metric RetryableErrors=2 unit=Count")
+
+	b.Reset()
+	(&Stats{}).emitMetrics()
+	require.NotContains(t, b.String(), "RetryableErrors")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+)
+
+// stitchLogEvents joins the log events that don't match
+// config.MultilineStartPattern on to the one before them, with a newline,
+// so that multi-line output such as stack traces, which CloudWatch Logs
+// often splits into a log event per line, makes up a single event. The
+// joined log event keeps the id and timestamp of the first of its lines.
+// Log events before the first match are left as they are.
+func stitchLogEvents(logEvents []LogEvent) []LogEvent {
+	if config.MultilineStartPattern == nil || len(logEvents) < 2 {
+		return logEvents
+	}
+
+	stitched := make([]LogEvent, 0, len(logEvents))
+	lines := []string{}
+	started := false
+	flush := func() {
+		if len(lines) > 1 {
+			stitched[len(stitched)-1].Message = strings.Join(lines, "\n")
+		}
+		lines = lines[:0]
+	}
+
+	for _, l := range logEvents {
+		starts := config.MultilineStartPattern.MatchString(l.Message)
+		if started && !starts {
+			lines = append(lines, strings.TrimRight(l.Message, "\r\n"))
+			continue
+		}
+
+		flush()
+		stitched = append(stitched, l)
+		if starts {
+			started = true
+			lines = append(lines, strings.TrimRight(l.Message, "\r\n"))
+		}
+	}
+	flush()
+
+	if joined := len(logEvents) - len(stitched); joined > 0 {
+		countMetric("StitchedLogEvents", float64(joined), "Count")
+	}
+
+	return stitched
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/base64"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStitchLogEvents(t *testing.T) {
+	logEvents := []LogEvent{
+		{Id: "a", Timestamp: 1, Message: "\tat leftover.Frame(Frame.java:1)"},
+		{Id: "b", Timestamp: 2, Message: "2021-05-17 04:02:12 ERROR request failed\n"},
+		{Id: "c", Timestamp: 2, Message: "java.lang.IllegalStateException: boom\n"},
+		{Id: "d", Timestamp: 2, Message: "\tat com.example.Handler.handle(Handler.java:42)\n"},
+		{Id: "e", Timestamp: 3, Message: "2021-05-17 04:02:13 INFO next request\n"},
+	}
+
+	require.Equal(t, logEvents, stitchLogEvents(logEvents))
+
+	withConfig(t, func(c *Config) {
+		c.MultilineStartPattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}`)
+	})
+	require.Equal(t, []LogEvent{
+		{Id: "a", Timestamp: 1, Message: "\tat leftover.Frame(Frame.java:1)"},
+		{Id: "b", Timestamp: 2, Message: "2021-05-17 04:02:12 ERROR request failed\n" +
+			"java.lang.IllegalStateException: boom\n" +
+			"\tat com.example.Handler.handle(Handler.java:42)"},
+		{Id: "e", Timestamp: 3, Message: "2021-05-17 04:02:13 INFO next request\n"},
+	}, stitchLogEvents(logEvents))
+}
+
+func TestTransformRecordsMultiline(t *testing.T) {
+	b := captureLogs(t)
+	withConfig(t, func(c *Config) {
+		c.MultilineStartPattern = regexp.MustCompile(`^Traceback|^(DEBUG|INFO|WARNING|ERROR) `)
+	})
+
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents: []LogEvent{
+					{Id: "a", Message: "Traceback (most recent call last):"},
+					{Id: "b", Message: `  File "app.py", line 3, in <module>`},
+					{Id: "c", Message: "ZeroDivisionError: division by zero"},
+					{Id: "d", Message: "INFO retrying"},
+				},
+			})},
+		},
+	}
+
+	stats := &Stats{}
+	resultRecords, _ := transformRecords(e, stats)
+	require.Equal(t, ResultRecordList{
+		{RecordId: "1", Result: resultStatusOk, Data: base64.StdEncoding.EncodeToString([]byte(
+			"Traceback (most recent call last):\n" +
+				`  File "app.py", line 3, in <module>` + "\n" +
+				"ZeroDivisionError: division by zero\n" +
+				"INFO retrying\n",
+		))},
+	}, resultRecords)
+
+	stats.emitMetrics()
+	require.Contains(t, b.String(), "metric StitchedLogEvents=2 unit=Count")
+}
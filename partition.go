@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// maxPartitionKeyLength is the longest partition key Kinesis accepts.
+const maxPartitionKeyLength = 256
+
+const (
+	longPartitionKeyHash     = "hash"
+	longPartitionKeyTruncate = "truncate"
+)
+
+// partitionKeyFor derives the partition key of a reingested log event from
+// its message, using config.PartitionKeyField if the message is JSON with
+// that field, or else config.PartitionKeyPattern. It falls back to
+// defaultKey when neither yields a usable key.
+func partitionKeyFor(message string, defaultKey string) string {
+	if config.PartitionKeyField != "" {
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(message), &fields); err == nil {
+			if v, ok := fields[config.PartitionKeyField]; ok && v != nil {
+				if key := fmt.Sprint(v); validPartitionKey(key) {
+					return key
+				}
+			}
+		}
+	}
+
+	if config.PartitionKeyPattern != nil {
+		// Use the first capture group if there is one, the whole match
+		// otherwise.
+		if match := config.PartitionKeyPattern.FindStringSubmatch(message); match != nil {
+			key := match[0]
+			if len(match) > 1 {
+				key = match[1]
+			}
+			if validPartitionKey(key) {
+				return key
+			}
+		}
+	}
+
+	return defaultKey
+}
+
+func validPartitionKey(key string) bool {
+	return key != "" && len([]rune(key)) <= maxPartitionKeyLength
+}
+
+// fitPartitionKey shortens a partition key that is too long for Kinesis to
+// accept, as config.LongPartitionKey says to.
+func fitPartitionKey(key string) string {
+	runes := []rune(key)
+	if len(runes) <= maxPartitionKeyLength {
+		return key
+	}
+
+	if config.LongPartitionKey == longPartitionKeyTruncate {
+		return string(runes[:maxPartitionKeyLength])
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
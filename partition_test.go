@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionKeyFor(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		field    string
+		pattern  string
+		message  string
+		expected string
+	}{
+		{
+			name:     "not configured",
+			message:  `{"user_id":"u-1"}`,
+			expected: "original",
+		},
+		{
+			name:     "field",
+			field:    "user_id",
+			message:  `{"user_id":"u-1"}`,
+			expected: "u-1",
+		},
+		{
+			name:     "numeric field",
+			field:    "user_id",
+			message:  `{"user_id":42}`,
+			expected: "42",
+		},
+		{
+			name:     "missing field",
+			field:    "user_id",
+			message:  `{"other":"u-1"}`,
+			expected: "original",
+		},
+		{
+			name:     "null field",
+			field:    "user_id",
+			message:  `{"user_id":null}`,
+			expected: "original",
+		},
+		{
+			name:     "pattern group",
+			pattern:  `user=(\w+)`,
+			message:  "GET /index.html user=bob status=200",
+			expected: "bob",
+		},
+		{
+			name:     "pattern match",
+			pattern:  `\d+\.\d+\.\d+\.\d+`,
+			message:  "connection from 10.0.0.1 closed",
+			expected: "10.0.0.1",
+		},
+		{
+			name:     "no match",
+			pattern:  `user=(\w+)`,
+			message:  "GET /index.html status=200",
+			expected: "original",
+		},
+		{
+			name:     "field before pattern",
+			field:    "user_id",
+			pattern:  `"user_id":"(u)`,
+			message:  `{"user_id":"u-1"}`,
+			expected: "u-1",
+		},
+		{
+			name:     "pattern for non-JSON messages",
+			field:    "user_id",
+			pattern:  `user=(\w+)`,
+			message:  "user=bob",
+			expected: "bob",
+		},
+		{
+			name:     "too long",
+			field:    "user_id",
+			message:  `{"user_id":"` + strings.Repeat("u", maxPartitionKeyLength+1) + `"}`,
+			expected: "original",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.PartitionKeyField = tc.field
+				if tc.pattern != "" {
+					c.PartitionKeyPattern = regexp.MustCompile(tc.pattern)
+				}
+			})
+
+			require.Equal(t, tc.expected, partitionKeyFor(tc.message, "original"))
+		})
+	}
+}
+
+func TestSplitMessagePartitionKeyFromMessage(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.PartitionKeyField = "user_id"
+	})
+
+	m := &Message{
+		MessageType: dataMessage,
+		LogGroup:    "DataLog",
+	}
+	logEvents := []LogEvent{
+		{Id: "a", Message: `{"user_id":"u-1"}`},
+		{Id: "b", Message: `{"user_id":"u-2"}`},
+		{Id: "c", Message: "not JSON"},
+	}
+
+	records, err := splitMessage(m, logEvents, "original")
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, "u-1", records[0].PartitionKey)
+	require.Equal(t, "u-2", records[1].PartitionKey)
+	require.Equal(t, "original", records[2].PartitionKey)
+
+	b := &bytes.Buffer{}
+	require.NoError(t, gunzip(b, records[1].Data))
+	require.Contains(t, b.String(), `u-2`)
+}
+
+func TestFitPartitionKey(t *testing.T) {
+	long := strings.Repeat("ü", maxPartitionKeyLength+1)
+
+	for _, tc := range []struct {
+		name     string
+		handling string
+		key      string
+		expected string
+	}{
+		{
+			name:     "short",
+			handling: longPartitionKeyHash,
+			key:      "k",
+			expected: "k",
+		},
+		{
+			name:     "at the limit",
+			handling: longPartitionKeyHash,
+			key:      strings.Repeat("ü", maxPartitionKeyLength),
+			expected: strings.Repeat("ü", maxPartitionKeyLength),
+		},
+		{
+			name:     "hash",
+			handling: longPartitionKeyHash,
+			key:      long,
+			expected: "2af8c99ccdd8c38da1e1920a94e600700a4457cba16aa693f5903d298726d699",
+		},
+		{
+			name:     "truncate",
+			handling: longPartitionKeyTruncate,
+			key:      long,
+			expected: strings.Repeat("ü", maxPartitionKeyLength),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.LongPartitionKey = tc.handling
+			})
+
+			key := fitPartitionKey(tc.key)
+			require.Equal(t, tc.expected, key)
+			require.True(t, validPartitionKey(key))
+		})
+	}
+}
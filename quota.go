@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// quotaEntry is the amount of data sent by a single put.
+type quotaEntry struct {
+	at      time.Time
+	records int
+	bytes   int
+}
+
+// quotaTracker keeps a rolling tally of the records and bytes put to the
+// destination stream. It lives for as long as the warm container does, so
+// it covers puts from consecutive invocations.
+type quotaTracker struct {
+	mu      sync.Mutex
+	entries []quotaEntry
+}
+
+var sentQuota = &quotaTracker{}
+
+// add records a put and returns the records and bytes sent within the
+// window up to and including it.
+func (q *quotaTracker) add(records, bytes int, window time.Duration) (int, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := clock.Now()
+	q.entries = append(q.entries, quotaEntry{at: now, records: records, bytes: bytes})
+
+	// Drop the entries that have fallen out of the window.
+	cutoff := now.Add(-window)
+	idx := 0
+	for idx < len(q.entries) && !q.entries[idx].at.After(cutoff) {
+		idx++
+	}
+	q.entries = q.entries[idx:]
+
+	totalRecords, totalBytes := 0, 0
+	for _, e := range q.entries {
+		totalRecords += e.records
+		totalBytes += e.bytes
+	}
+
+	return totalRecords, totalBytes
+}
+
+// nearQuota reports whether used is at or above the configured warning
+// ratio of quota. A quota of zero means no quota is being tracked.
+func nearQuota(used, quota int) bool {
+	return quota > 0 && float64(used) >= float64(quota)*config.QuotaWarnRatio
+}
+
+// trackQuota adds a put to the rolling tally and logs a warning when the
+// stream is approaching its configured throughput quota.
+func trackQuota(streamName string, records, bytes int) {
+	if config.QuotaRecords <= 0 && config.QuotaBytes <= 0 {
+		return
+	}
+
+	totalRecords, totalBytes := sentQuota.add(records, bytes, config.QuotaWindow)
+
+	if nearQuota(totalRecords, config.QuotaRecords) || nearQuota(totalBytes, config.QuotaBytes) {
+		warnf(
+			"approaching quota for %s stream: %d/%d records and %d/%d bytes put in the last %s\n",
+			streamName, totalRecords, config.QuotaRecords, totalBytes, config.QuotaBytes, config.QuotaWindow,
+		)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaTrackerAdd(t *testing.T) {
+	c := withFakeClock(t)
+	q := &quotaTracker{}
+
+	records, bytes := q.add(10, 100, time.Second)
+	require.Equal(t, 10, records)
+	require.Equal(t, 100, bytes)
+
+	c.advance(500 * time.Millisecond)
+	records, bytes = q.add(5, 50, time.Second)
+	require.Equal(t, 15, records)
+	require.Equal(t, 150, bytes)
+
+	// The first put falls out of the window.
+	c.advance(600 * time.Millisecond)
+	records, bytes = q.add(1, 10, time.Second)
+	require.Equal(t, 6, records)
+	require.Equal(t, 60, bytes)
+
+	c.advance(time.Hour)
+	records, bytes = q.add(0, 0, time.Second)
+	require.Equal(t, 0, records)
+	require.Equal(t, 0, bytes)
+	require.Len(t, q.entries, 1)
+}
+
+func TestNearQuota(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.QuotaWarnRatio = 0.8
+	})
+
+	require.False(t, nearQuota(79, 100))
+	require.True(t, nearQuota(80, 100))
+	require.True(t, nearQuota(120, 100))
+	require.False(t, nearQuota(1000, 0))
+}
+
+func TestTrackQuota(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.QuotaRecords = 100
+		c.QuotaWindow = time.Second
+		c.QuotaWarnRatio = 0.8
+	})
+	b := captureLogs(t)
+
+	c := withFakeClock(t)
+	orig := sentQuota
+	t.Cleanup(func() {
+		sentQuota = orig
+	})
+	sentQuota = &quotaTracker{}
+
+	trackQuota("DataLog", 50, 1000)
+	require.Empty(t, b.String())
+
+	trackQuota("DataLog", 30, 1000)
+	require.Contains(t, b.String(), "WARN approaching quota for DataLog stream: 80/100 records")
+
+	b.Reset()
+	c.advance(2 * time.Second)
+	trackQuota("DataLog", 30, 1000)
+	require.Empty(t, b.String())
+}
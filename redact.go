@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// The built-in redaction patterns.
+const (
+	redactEmail        = "email"
+	redactCreditCard   = "credit-card"
+	redactSsn          = "ssn"
+	redactIpv4         = "ipv4"
+	redactIpv6         = "ipv6"
+	redactAwsAccessKey = "aws-access-key"
+)
+
+// redactPatterns are the built-in redaction patterns by name.
+var redactPatterns = map[string]*regexp.Regexp{
+	redactEmail:      regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	redactCreditCard: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+	redactSsn:        regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+	redactIpv4:       regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\b`),
+	// Full addresses, or ones with "::", so times such as 12:30:45 aren't
+	// taken for addresses.
+	redactIpv6:         regexp.MustCompile(`(?i)\b(?:[0-9a-f]{1,4}:){7}[0-9a-f]{1,4}\b|(?:\b[0-9a-f]{1,4}(?::[0-9a-f]{1,4}){0,6})?::(?:[0-9a-f]{1,4}(?::[0-9a-f]{1,4}){0,6}\b)?`),
+	redactAwsAccessKey: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+}
+
+// redactMatch tells whether a match of the built-in pattern name is one to
+// redact. Card numbers have to pass the Luhn check, so that other long
+// numbers, such as timestamps, are left alone.
+func redactMatch(name string, match string) bool {
+	if name != redactCreditCard {
+		return true
+	}
+
+	sum, double := 0, false
+	for i := len(match) - 1; i >= 0; i-- {
+		c := match[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+
+	return sum%10 == 0
+}
+
+// redactRule replaces the matches of a user supplied pattern with
+// Replacement, which can refer to capture groups like $1.
+type redactRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// UnmarshalJSON reads a rule from {"pattern": "...", "replacement": "..."}.
+func (r *redactRule) UnmarshalJSON(data []byte) error {
+	raw := struct {
+		Pattern     string `json:"pattern"`
+		Replacement string `json:"replacement"`
+	}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	re, err := regexp.Compile(raw.Pattern)
+	if err != nil {
+		return err
+	}
+	r.Pattern, r.Replacement = re, raw.Replacement
+
+	return nil
+}
+
+// MarshalJSON writes r the way UnmarshalJSON reads it, e.g. for the config
+// diagnostics.
+func (r redactRule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{
+		"pattern":     r.Pattern.String(),
+		"replacement": r.Replacement,
+	})
+}
+
+// redacting tells whether any redaction is configured.
+func redacting() bool {
+	return len(config.RedactPatterns) > 0 || len(config.RedactRules) > 0
+}
+
+// redactLines redacts each line of data on its own, so that patterns can't
+// match across events.
+func redactLines(data string) string {
+	if !redacting() {
+		return data
+	}
+
+	lines := strings.Split(data, "\n")
+	for i, line := range lines {
+		lines[i] = redact(line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// redact replaces what the config.RedactPatterns built-in patterns match in
+// message with config.MaskToken, and then applies the config.RedactRules in
+// order.
+func redact(message string) string {
+	for _, name := range config.RedactPatterns {
+		re, ok := redactPatterns[name]
+		if !ok {
+			continue
+		}
+		message = re.ReplaceAllStringFunc(message, func(match string) string {
+			if !redactMatch(name, match) {
+				return match
+			}
+			return config.MaskToken
+		})
+	}
+
+	for _, r := range config.RedactRules {
+		message = r.Pattern.ReplaceAllString(message, r.Replacement)
+	}
+
+	return message
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+)
+
+const (
+	// reingestDataOriginal reingests the original, untransformed data of
+	// records, which is transformed all over again when it comes back.
+	reingestDataOriginal = "original"
+
+	// reingestDataTransformed reingests the data records were transformed
+	// into, wrapped in a transformedMessage, which is passed through as is
+	// when it comes back.
+	reingestDataTransformed = "transformed"
+)
+
+const (
+	// oversizeRecordReingest splits records too large for a response on
+	// their own into smaller ones, and reingests those.
+	oversizeRecordReingest = "reingest"
+
+	// oversizeRecordFail marks records too large for a response on their
+	// own as ProcessingFailed.
+	oversizeRecordFail = "fail"
+)
+
+// transformedMessage is the message type of the messages that wrap the
+// transformed data of reingested records, see reingestDataTransformed.
+const transformedMessage = "TRANSFORMED_MESSAGE"
+
+// transformedReingestionRecord returns a copy of rr whose data is the
+// transformed data of r, wrapped in a gzipped transformedMessage.
+func transformedReingestionRecord(rr ReingestionRecord, r ResultRecord) (ReingestionRecord, error) {
+	transformed, err := transformedData(r)
+	if err != nil {
+		return ReingestionRecord{}, err
+	}
+
+	return wrapTransformed(rr, transformed)
+}
+
+// transformedData returns the transformed data of r, without the record
+// header, which is prepended again when the data comes back.
+func transformedData(r ResultRecord) ([]byte, error) {
+	transformed, err := base64.StdEncoding.DecodeString(r.Data)
+	if err != nil {
+		return nil, err
+	}
+	if isGzipped(transformed) {
+		b := &bytes.Buffer{}
+		if err := gunzip(b, transformed); err != nil {
+			return nil, err
+		}
+		transformed = b.Bytes()
+	}
+	if config.RecordHeader != "" {
+		transformed = bytes.TrimPrefix(transformed, []byte(recordHeaderLine()))
+	}
+
+	return transformed, nil
+}
+
+// wrapTransformed returns a copy of rr whose data is transformed, wrapped in
+// a gzipped transformedMessage.
+func wrapTransformed(rr ReingestionRecord, transformed []byte) (ReingestionRecord, error) {
+	data, err := json.Marshal(Message{MessageType: transformedMessage, Data: string(transformed)})
+	if err != nil {
+		return ReingestionRecord{}, err
+	}
+
+	b := &bytes.Buffer{}
+	if err := gzipCompress(b, data); err != nil {
+		return ReingestionRecord{}, err
+	}
+
+	rr.Data = b.Bytes()
+	return rr, nil
+}
+
+// splitOversizeRecord splits rr, the reingestion record of r, whose
+// transformed data is too large for a response on its own, into records
+// whose transformed data is at most about maxFirehoseRecordSize, so they
+// don't come back just as large. Depending on config.ReingestData, either
+// the log events of the original data or the lines of the transformed data
+// are split between them.
+func splitOversizeRecord(rr ReingestionRecord, r ResultRecord) ([]ReingestionRecord, error) {
+	if config.ReingestData == reingestDataTransformed {
+		transformed, err := transformedData(r)
+		if err != nil {
+			return nil, err
+		}
+
+		records := []ReingestionRecord{}
+		for _, chunk := range splitLines(transformed, maxFirehoseRecordSize) {
+			wrapped, err := wrapTransformed(rr, chunk)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, wrapped)
+		}
+		return records, nil
+	}
+
+	_, messages, err := decompressMessages(rr.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := len(r.Data)/maxFirehoseRecordSize + 1
+	records := []ReingestionRecord{}
+	for _, m := range messages {
+		if m.MessageType != dataMessage {
+			continue
+		}
+
+		size := (len(m.LogEvents) + parts - 1) / parts
+		for start := 0; start < len(m.LogEvents); start += size {
+			end := start + size
+			if end > len(m.LogEvents) {
+				end = len(m.LogEvents)
+			}
+
+			part := *m
+			part.LogEvents = m.LogEvents[start:end]
+			data, err := json.Marshal(part)
+			if err != nil {
+				return nil, err
+			}
+
+			b := &bytes.Buffer{}
+			if err := gzipCompress(b, data); err != nil {
+				return nil, err
+			}
+
+			split := rr
+			split.Data = b.Bytes()
+			records = append(records, split)
+		}
+	}
+
+	return records, nil
+}
+
+// splitLines splits data into chunks of whole lines of at most maxSize bytes,
+// bar lines longer than that, which are chunks of their own.
+func splitLines(data []byte, maxSize int) [][]byte {
+	chunks := [][]byte{}
+
+	var chunk []byte
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if len(chunk) > 0 && len(chunk)+len(line) > maxSize {
+			chunks = append(chunks, chunk)
+			chunk = nil
+		}
+		chunk = append(chunk, line...)
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleRequestReingestData(t *testing.T) {
+	// Together the records transform to more than Firehose takes in a
+	// response, so some of them are reingested.
+	e := Event{DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog"}
+	for i := 0; i < 4; i++ {
+		e.Records = append(e.Records, EventRecord{
+			RecordId: strconv.Itoa(i),
+			Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: strconv.Itoa(i), Message: strings.Repeat("x", 1200*1024)}},
+			}),
+		})
+	}
+	original := Event{Records: e.Records[:1]}
+	expected, _ := transformRecords(original, &Stats{})
+
+	for _, tc := range []struct {
+		name         string
+		reingestData string
+		check        func(t *testing.T, reingested []byte)
+	}{
+		{
+			name:         "original",
+			reingestData: reingestDataOriginal,
+			check: func(t *testing.T, reingested []byte) {
+				data, err := base64.StdEncoding.DecodeString(e.Records[0].Data)
+				require.NoError(t, err)
+				require.Equal(t, data, reingested)
+			},
+		},
+		{
+			name:         "transformed",
+			reingestData: reingestDataTransformed,
+			check: func(t *testing.T, reingested []byte) {
+				b := &bytes.Buffer{}
+				require.NoError(t, gunzip(b, reingested))
+				messages, err := decodeMessages(b.Bytes())
+				require.NoError(t, err)
+				require.Len(t, messages, 1)
+				require.Equal(t, transformedMessage, messages[0].MessageType)
+				require.Empty(t, messages[0].LogEvents)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			captureLogs(t)
+			withConfig(t, func(c *Config) {
+				c.ReingestData = tc.reingestData
+			})
+			fh, _ := withFakeAPIs(t)
+
+			resp, err := HandleRequest(context.Background(), e)
+			require.NoError(t, err)
+			require.Equal(t, resultStatusDropped, resp.Records[0].Result)
+
+			require.NotEmpty(t, fh.inputs)
+			reingested := fh.inputs[0].Records[0].Data
+			tc.check(t, reingested)
+
+			// Either way the reingested record comes back as what the
+			// original record would have been transformed into.
+			roundTrip, _ := transformRecords(Event{Records: []EventRecord{
+				{RecordId: "reingested", Data: base64.StdEncoding.EncodeToString(reingested)},
+			}}, &Stats{})
+			require.Equal(t, resultStatusOk, roundTrip[0].Result)
+			require.Equal(t, expected[0].Data, roundTrip[0].Data)
+		})
+	}
+}
+
+func TestTransformedReingestionRecordRecordHeader(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.RecordHeader = "index=main"
+		c.ReingestData = reingestDataTransformed
+	})
+
+	rr := ReingestionRecord{Data: []byte("original")}
+	r := ResultRecord{RecordId: "1", Result: resultStatusOk, Data: base64.StdEncoding.EncodeToString([]byte("index=main\nline\n"))}
+	trr, err := transformedReingestionRecord(rr, r)
+	require.NoError(t, err)
+
+	// The header isn't doubled up when the record comes back.
+	resultRecords, _ := transformRecords(Event{Records: []EventRecord{
+		{RecordId: "2", Data: base64.StdEncoding.EncodeToString(trr.Data)},
+	}}, &Stats{})
+	require.Equal(t, r.Data, resultRecords[0].Data)
+}
+
+func TestTransformedReingestionRecord(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ReingestData = reingestDataTransformed
+	})
+	b := &bytes.Buffer{}
+	require.NoError(t, gzipCompress(b, []byte("zipped\n")))
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{name: "plain", data: []byte("zipped\n")},
+		{name: "gzipped response", data: b.Bytes()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := ReingestionRecord{Data: []byte("original"), PartitionKey: "key", SourceRecordId: "1"}
+			r := ResultRecord{RecordId: "1", Result: resultStatusOk, Data: base64.StdEncoding.EncodeToString(tc.data)}
+
+			trr, err := transformedReingestionRecord(rr, r)
+			require.NoError(t, err)
+			require.Equal(t, "key", trr.PartitionKey)
+			require.Equal(t, "1", trr.SourceRecordId)
+
+			resultRecords, _ := transformRecords(Event{Records: []EventRecord{
+				{RecordId: "2", Data: base64.StdEncoding.EncodeToString(trr.Data)},
+			}}, &Stats{})
+			data, err := base64.StdEncoding.DecodeString(resultRecords[0].Data)
+			require.NoError(t, err)
+			require.Equal(t, "zipped\n", string(data))
+		})
+	}
+}
+
+func TestHandleRequestOversizeRecord(t *testing.T) {
+	// The big record alone transforms to more than Firehose takes in a
+	// response, even though it comes after a small one.
+	logEvents := []LogEvent{}
+	for i := 0; i < 100; i++ {
+		logEvents = append(logEvents, LogEvent{Id: strconv.Itoa(i), Message: strings.Repeat("x", 50*1024)})
+	}
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "small", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "s", Message: "small"}},
+			})},
+			{RecordId: "big", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogGroup:    "DataLog",
+				LogEvents:   logEvents,
+			})},
+		},
+	}
+
+	for _, tc := range []struct {
+		name           string
+		oversizeRecord string
+		reingestData   string
+		expectedResult string
+		check          func(t *testing.T, reingested []*firehose.Record)
+	}{
+		{
+			name:           "reingest original",
+			oversizeRecord: oversizeRecordReingest,
+			reingestData:   reingestDataOriginal,
+			expectedResult: resultStatusDropped,
+			check: func(t *testing.T, reingested []*firehose.Record) {
+				require.Len(t, reingested, 7)
+
+				ids := []string{}
+				for _, r := range reingested {
+					_, messages, err := decompressMessages(r.Data)
+					require.NoError(t, err)
+					require.Len(t, messages, 1)
+					require.Equal(t, "DataLog", messages[0].LogGroup)
+					for _, l := range messages[0].LogEvents {
+						ids = append(ids, l.Id)
+					}
+				}
+				require.Len(t, ids, len(logEvents))
+				require.Equal(t, "0", ids[0])
+				require.Equal(t, "99", ids[99])
+			},
+		},
+		{
+			name:           "reingest transformed",
+			oversizeRecord: oversizeRecordReingest,
+			reingestData:   reingestDataTransformed,
+			expectedResult: resultStatusDropped,
+			check: func(t *testing.T, reingested []*firehose.Record) {
+				require.True(t, len(reingested) > 1)
+
+				lines := 0
+				for _, r := range reingested {
+					_, messages, err := decompressMessages(r.Data)
+					require.NoError(t, err)
+					require.Len(t, messages, 1)
+					require.Equal(t, transformedMessage, messages[0].MessageType)
+					require.True(t, len(messages[0].Data) <= maxFirehoseRecordSize)
+					lines += strings.Count(messages[0].Data, "\n")
+				}
+				require.Equal(t, len(logEvents), lines)
+			},
+		},
+		{
+			name:           "fail",
+			oversizeRecord: oversizeRecordFail,
+			reingestData:   reingestDataOriginal,
+			expectedResult: resultStatusFailed,
+			check: func(t *testing.T, reingested []*firehose.Record) {
+				require.Empty(t, reingested)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			captureLogs(t)
+			withConfig(t, func(c *Config) {
+				c.OversizeRecord = tc.oversizeRecord
+				c.ReingestData = tc.reingestData
+			})
+			fh, _ := withFakeAPIs(t)
+
+			resp, err := HandleRequest(context.Background(), e)
+			require.NoError(t, err)
+			require.Equal(t, resultStatusOk, resp.Records[0].Result)
+			require.Equal(t, tc.expectedResult, resp.Records[1].Result)
+			require.Empty(t, resp.Records[1].Data)
+
+			reingested := []*firehose.Record{}
+			for _, in := range fh.inputs {
+				reingested = append(reingested, in.Records...)
+			}
+			tc.check(t, reingested)
+		})
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		data     string
+		expected []string
+	}{
+		{
+			name:     "fits",
+			data:     "a\nb\n",
+			expected: []string{"a\nb\n"},
+		},
+		{
+			name:     "split",
+			data:     "aa\nbb\ncc\n",
+			expected: []string{"aa\nbb\n", "cc\n"},
+		},
+		{
+			name:     "long line",
+			data:     "a\nbbbbbbbbbb\nc",
+			expected: []string{"a\n", "bbbbbbbbbb\n", "c"},
+		},
+		{
+			name:     "empty",
+			data:     "",
+			expected: []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chunks := []string{}
+			for _, c := range splitLines([]byte(tc.data), 6) {
+				chunks = append(chunks, string(c))
+			}
+			require.Equal(t, tc.expected, chunks)
+		})
+	}
+}
+
+func TestTransformRecordsTransformedMessage(t *testing.T) {
+	captureLogs(t)
+	withConfig(t, func(c *Config) {
+		c.RedactPatterns = []string{redactIpv4}
+		c.MaskToken = "****"
+	})
+
+	wrapped, err := wrapTransformed(ReingestionRecord{}, []byte("login from 10.1.2.3\n"))
+	require.NoError(t, err)
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: base64.StdEncoding.EncodeToString(wrapped.Data)},
+		},
+	}
+
+	// Only this Lambda reingesting transformed data sends such messages.
+	stats := &Stats{}
+	resultRecords, _ := transformRecords(e, stats)
+	require.Equal(t, resultStatusFailed, resultRecords[0].Result)
+	require.Equal(t, failReasonUnknownMessageType, stats.Failures["1"].Reason)
+
+	withConfig(t, func(c *Config) {
+		c.ReingestData = reingestDataTransformed
+	})
+	resultRecords, _ = transformRecords(e, &Stats{})
+	require.Equal(t, ResultRecordList{
+		{RecordId: "1", Result: resultStatusOk, Data: base64.StdEncoding.EncodeToString([]byte("login from ****\n"))},
+	}, resultRecords)
+}
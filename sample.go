@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"math/rand"
+)
+
+// sampleRandom returns a number in [0, 1) for sampling log events without an
+// id. It is swapped out in tests.
+var sampleRandom = rand.Float64
+
+// samplePatterns returns the log group patterns of rates keyed by
+// themselves, so matchLogGroup can tell which of them a log group matches.
+func samplePatterns(rates map[string]float64) map[string]string {
+	patterns := make(map[string]string, len(rates))
+	for p := range rates {
+		patterns[p] = p
+	}
+
+	return patterns
+}
+
+// sampleRateFor returns the share of the log events of logGroup that are
+// kept: that of config.LogGroupSampleRates, matched like
+// config.LogGroupFormats, or else config.SampleRate.
+func sampleRateFor(logGroup string) float64 {
+	if p, ok := matchLogGroup(config.LogGroupSamplePatterns, logGroup); ok {
+		return config.LogGroupSampleRates[p]
+	}
+
+	return config.SampleRate
+}
+
+// isSampledOut tells whether l is left out when keeping rate of the log
+// events. Log events are picked by a hash of their id, so the same ones are
+// kept when Firehose retries or a record is replayed, and at random if they
+// have none.
+func isSampledOut(l LogEvent, rate float64) bool {
+	if rate >= 1 {
+		return false
+	}
+	if rate <= 0 {
+		return true
+	}
+
+	if l.Id == "" {
+		return sampleRandom() >= rate
+	}
+
+	// FNV and the like spread ids that only differ at the end too unevenly.
+	sum := sha256.Sum256([]byte(l.Id))
+	return float64(binary.BigEndian.Uint64(sum[:8]))/(math.MaxUint64+1.0) >= rate
+}
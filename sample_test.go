@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampleRateFor(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.SampleRate = 0.5
+		c.LogGroupSampleRates = map[string]float64{
+			"/aws/lambda/*":       0.2,
+			"/aws/lambda/chatty*": 0.1,
+			"DataLog":             0,
+		}
+	})
+
+	require.Equal(t, 0.1, sampleRateFor("/aws/lambda/chatty-api"))
+	require.Equal(t, 0.2, sampleRateFor("/aws/lambda/orders"))
+	require.Equal(t, 0.0, sampleRateFor("DataLog"))
+	require.Equal(t, 0.5, sampleRateFor("/aws/rds/db"))
+}
+
+func TestIsSampledOut(t *testing.T) {
+	l := LogEvent{Id: "36166575453237618839547424587340345418035539493574770688"}
+	require.False(t, isSampledOut(l, 1))
+	require.True(t, isSampledOut(l, 0))
+
+	// The same log event is always picked the same way.
+	for i := 0; i < 10; i++ {
+		require.Equal(t, isSampledOut(l, 0.5), isSampledOut(l, 0.5))
+	}
+
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		if !isSampledOut(LogEvent{Id: fmt.Sprintf("event-%d", i)}, 0.1) {
+			kept++
+		}
+	}
+	require.InDelta(t, 1000, kept, 150)
+
+	orig := sampleRandom
+	t.Cleanup(func() {
+		sampleRandom = orig
+	})
+	sampleRandom = func() float64 { return 0.3 }
+	require.True(t, isSampledOut(LogEvent{}, 0.2))
+	require.False(t, isSampledOut(LogEvent{}, 0.4))
+}
+
+func TestTransformRecordsSampling(t *testing.T) {
+	b := captureLogs(t)
+	withConfig(t, func(c *Config) {
+		c.LogGroupSampleRates = map[string]float64{"chatty": 0}
+	})
+
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogGroup:    "chatty",
+				LogEvents: []LogEvent{
+					{Id: "a", Message: "noise"},
+					{Id: "b", Message: "more noise"},
+				},
+			})},
+			{RecordId: "2", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogGroup:    "quiet",
+				LogEvents:   []LogEvent{{Id: "c", Message: "signal"}},
+			})},
+		},
+	}
+
+	stats := &Stats{}
+	resultRecords, _ := transformRecords(e, stats)
+	require.Equal(t, ResultRecordList{
+		{RecordId: "1", Result: resultStatusDropped},
+		{RecordId: "2", Result: resultStatusOk, Data: base64.StdEncoding.EncodeToString([]byte("signal\n"))},
+	}, resultRecords)
+
+	stats.emitMetrics()
+	require.Contains(t, b.String(), "metric SampledOutLogEvents=2 unit=Count")
+}
+
+func TestHandleRequestSamplingIsStableAcrossRetries(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.SampleRate = 0.5
+	})
+	withFakeAPIs(t)
+
+	logEvents := []LogEvent{}
+	for i := 0; i < 20; i++ {
+		logEvents = append(logEvents, LogEvent{Id: fmt.Sprintf("event-%d", i), Message: fmt.Sprintf("message %d", i)})
+	}
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{MessageType: dataMessage, LogEvents: logEvents})},
+		},
+	}
+
+	captureLogs(t)
+	first, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	retried, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	require.Equal(t, first, retried)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// captureSink captures what the stdout sink prints.
+func captureSink(t *testing.T) *bytes.Buffer {
+	b := &bytes.Buffer{}
+
+	origOutput := sinkOutput
+	t.Cleanup(func() {
+		sinkOutput = origOutput
+	})
+	sinkOutput = b
+
+	return b
+}
+
+func TestHandleRequestStdoutSink(t *testing.T) {
+	logs := captureLogs(t)
+	out := captureSink(t)
+	withConfig(t, func(c *Config) {
+		c.Sink = sinkStdout
+		c.RecordPerLogEvent = true
+	})
+
+	m := Message{
+		MessageType: dataMessage,
+		LogGroup:    "DataLog",
+		LogStream:   "stream",
+		LogEvents: []LogEvent{
+			{Id: "a", Timestamp: 1, Message: "first"},
+			{Id: "b", Timestamp: 2, Message: "second"},
+		},
+	}
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, m)},
+		},
+	}
+
+	resp, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	require.Len(t, resp.Records, 1)
+
+	printed := out.String()
+	require.Contains(t, printed, "==> reingest to DataLog\n")
+	require.Contains(t, printed, `"message":"second"`)
+	require.Contains(t, printed, "==> record 1 Ok\nfirst\n")
+	require.NotContains(t, printed, `"message":"first"`)
+
+	require.Contains(t, logs.String(), "WARN SINK=stdout")
+}
+
+func TestNewAPIsDefaultToAws(t *testing.T) {
+	require.Equal(t, sinkAws, loadConfig().Sink)
+
+	withConfig(t, func(c *Config) {
+		c.Sink = sinkStdout
+	})
+	require.Equal(t, stdoutFirehoseAPI{}, newFirehoseAPI("us-east-1"))
+	require.Equal(t, stdoutKinesisAPI{}, newKinesisAPI("us-east-1"))
+}
+
+func TestPrintSinkRecord(t *testing.T) {
+	out := captureSink(t)
+
+	gzipped := &bytes.Buffer{}
+	require.NoError(t, gzipCompress(gzipped, []byte("zipped")))
+
+	printSinkRecord("plain", []byte("line\n"))
+	printSinkRecord("unterminated", []byte("line"))
+	printSinkRecord("gzipped", gzipped.Bytes())
+
+	require.Equal(t, "==> plain\nline\n==> unterminated\nline\n==> gzipped\nzipped\n", out.String())
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"runtime"
+	"sort"
+	"time"
+)
+
+// The reasons records are Dropped for.
+const (
+	// dropReasonEmptyRecord is for records without any data.
+	dropReasonEmptyRecord = "empty_record"
+	// dropReasonMissingData is for records without a data field at all.
+	dropReasonMissingData = "missing_data"
+	// dropReasonControlMessage is for records of only CONTROL_MESSAGEs.
+	dropReasonControlMessage = "control_message"
+	// dropReasonEmptyTransform is for records none of whose log events were
+	// left after transforming them.
+	dropReasonEmptyTransform = "empty_transform"
+	// dropReasonSizeLimit is for records reingested, rather than returned,
+	// to keep the response or memory use within limits.
+	dropReasonSizeLimit = "size_limit"
+)
+
+// dropReasons are all the reasons records are Dropped for, in the order
+// their metrics are emitted.
+var dropReasons = []string{
+	dropReasonEmptyRecord,
+	dropReasonMissingData,
+	dropReasonControlMessage,
+	dropReasonEmptyTransform,
+	dropReasonSizeLimit,
+}
+
+// The reasons records are Failed for.
+const (
+	// failReasonMissingData is for records without a data field at all,
+	// when config.MissingData is "fail".
+	failReasonMissingData = "missing_data"
+	// failReasonBase64 is for records whose data isn't valid base64.
+	failReasonBase64 = "base64_decode"
+	// failReasonDecompress is for records whose data couldn't be
+	// decompressed with any of config.DecompressionOrder.
+	failReasonDecompress = "decompress"
+	// failReasonJsonUnmarshal is for records whose decompressed data isn't
+	// JSON messages.
+	failReasonJsonUnmarshal = "json_unmarshal"
+	// failReasonUnknownMessageType is for records with a message of a type
+	// other than DATA_MESSAGE or CONTROL_MESSAGE.
+	failReasonUnknownMessageType = "unknown_message_type"
+	// failReasonTransform is for records a log event of which failed to
+	// transform.
+	failReasonTransform = "transform"
+	// failReasonCompress is for records whose output couldn't be gzipped.
+	failReasonCompress = "compress"
+	// failReasonLimit is for records too large for the response on their own
+	// that couldn't be reingested instead.
+	failReasonLimit = "limit"
+	// failReasonPartitionKey is for records of a Kinesis source stream
+	// without a partition key.
+	failReasonPartitionKey = "partition_key"
+	// failReasonReingest is for records that could not be reingested.
+	failReasonReingest = "reingest"
+	// failReasonDeadline is for records left untransformed as the Lambda's
+	// deadline neared.
+	failReasonDeadline = "deadline"
+)
+
+// failReasons are all the reasons records are Failed for, in the order their
+// metrics are emitted.
+var failReasons = []string{
+	failReasonMissingData,
+	failReasonBase64,
+	failReasonDecompress,
+	failReasonJsonUnmarshal,
+	failReasonUnknownMessageType,
+	failReasonTransform,
+	failReasonCompress,
+	failReasonLimit,
+	failReasonPartitionKey,
+	failReasonReingest,
+	failReasonDeadline,
+}
+
+// recordFailure is why a record was failed: one of the failReasons, and the
+// error behind it, if any.
+type recordFailure struct {
+	Reason string
+	Error  string
+}
+
+// Stats are the processing statistics of a single invocation.
+type Stats struct {
+	// Records is the number of records in the event.
+	Records int
+
+	// DecompressedRecords and DecompressedBytes count the records that were
+	// successfully decompressed and their total decompressed size.
+	DecompressedRecords int
+	DecompressedBytes   int
+
+	// InputBytes and OutputBytes are the total size of the records' data in
+	// the event and in the response.
+	InputBytes  int
+	OutputBytes int
+
+	// BilledBytes is the size Firehose bills the records as, see billedSize.
+	BilledBytes int
+
+	// Dropped counts the records Dropped, by reason.
+	Dropped map[string]int
+
+	// Failed counts the records failed, by reason, and Failures is why each
+	// record was failed, by record id.
+	Failed   map[string]int
+	Failures map[string]recordFailure
+
+	// Results counts the records of the response by result, and Reingested
+	// the records put back on to the stream, once the invocation is done.
+	Results    map[string]int
+	Reingested int
+
+	// ResponseBytes is the projected size of the response, see
+	// ResultRecordList.projectedSize, once the invocation is done.
+	ResponseBytes int
+
+	// LastSeen is the latest log event timestamp seen per log stream, for
+	// up to config.MaxLastSeenStreams streams; UntrackedEvents counts the
+	// log events of streams beyond those.
+	LastSeen        map[logStreamKey]int
+	UntrackedEvents int
+
+	// LogGroups and LogStreams are the distinct log groups and log streams
+	// seen when config.CountUniqueSources is set, up to
+	// config.MaxUniqueSources of each. UniqueSourcesCapped is set once
+	// either is full, from when on their sizes are lower bounds.
+	LogGroups           map[string]bool
+	LogStreams          map[logStreamKey]bool
+	UniqueSourcesCapped bool
+
+	// TransformTime is how long transforming the event's records took.
+	TransformTime time.Duration
+
+	// RecordLatency is how long records took to transform, when
+	// config.EmitRecordLatency is set.
+	RecordLatency latencyHistogram
+}
+
+// logStreamKey identifies a log stream, whose name is only unique within its
+// log group.
+type logStreamKey struct {
+	LogGroup  string
+	LogStream string
+}
+
+// seen tracks the latest timestamp of the log events of m's log stream, if
+// config.MaxLastSeenStreams is set.
+func (s *Stats) seen(m *Message) {
+	if config.MaxLastSeenStreams == 0 || len(m.LogEvents) == 0 {
+		return
+	}
+
+	latest := m.LogEvents[0].Timestamp
+	for _, l := range m.LogEvents[1:] {
+		if l.Timestamp > latest {
+			latest = l.Timestamp
+		}
+	}
+
+	if s.LastSeen == nil {
+		s.LastSeen = map[logStreamKey]int{}
+	}
+	key := logStreamKey{LogGroup: m.LogGroup, LogStream: m.LogStream}
+	prev, ok := s.LastSeen[key]
+	if !ok && len(s.LastSeen) >= config.MaxLastSeenStreams {
+		s.UntrackedEvents += len(m.LogEvents)
+		return
+	}
+	if !ok || latest > prev {
+		s.LastSeen[key] = latest
+	}
+}
+
+// countSource adds m's log group and log stream to the distinct ones seen.
+func (s *Stats) countSource(m *Message) {
+	if !config.CountUniqueSources {
+		return
+	}
+
+	if s.LogGroups == nil {
+		s.LogGroups, s.LogStreams = map[string]bool{}, map[logStreamKey]bool{}
+	}
+
+	if !s.LogGroups[m.LogGroup] {
+		if len(s.LogGroups) < config.MaxUniqueSources {
+			s.LogGroups[m.LogGroup] = true
+		} else {
+			s.UniqueSourcesCapped = true
+		}
+	}
+
+	key := logStreamKey{LogGroup: m.LogGroup, LogStream: m.LogStream}
+	if !s.LogStreams[key] {
+		if len(s.LogStreams) < config.MaxUniqueSources {
+			s.LogStreams[key] = true
+		} else {
+			s.UniqueSourcesCapped = true
+		}
+	}
+}
+
+// drop counts a record Dropped for reason.
+func (s *Stats) drop(reason string) {
+	if s.Dropped == nil {
+		s.Dropped = map[string]int{}
+	}
+	s.Dropped[reason]++
+}
+
+// fail counts a record failed for reason and logs why, with err if there is
+// one.
+func (s *Stats) fail(recordId string, reason string, err error) {
+	if s.Failed == nil {
+		s.Failed = map[string]int{}
+	}
+	s.Failed[reason]++
+
+	if s.Failures == nil {
+		s.Failures = map[string]recordFailure{}
+	}
+	f := recordFailure{Reason: reason}
+	if err != nil {
+		f.Error = err.Error()
+	}
+	s.Failures[recordId] = f
+
+	if err != nil {
+		warnf("Failing record %s: %s. %s\n", recordId, reason, err)
+	} else {
+		warnf("Failing record %s: %s\n", recordId, reason)
+	}
+}
+
+// averageDecompressedSize returns the mean decompressed size in bytes of the
+// records that could be decompressed.
+func (s *Stats) averageDecompressedSize() float64 {
+	if s.DecompressedRecords == 0 {
+		return 0
+	}
+	return float64(s.DecompressedBytes) / float64(s.DecompressedRecords)
+}
+
+// emitMetrics logs the metrics derived from the invocation's stats, in the
+// configured format.
+func (s *Stats) emitMetrics() {
+	emit := emitMetric
+	if config.MetricsFormat == metricsFormatEmf {
+		doc := &emfDocument{}
+		defer doc.write()
+		emit = doc.add
+	}
+
+	emit("Records", float64(s.Records), "Count")
+	emit("OkRecords", float64(s.Results[resultStatusOk]), "Count")
+	emit("DroppedRecords", float64(s.Results[resultStatusDropped]), "Count")
+	emit("FailedRecords", float64(s.Results[resultStatusFailed]), "Count")
+	emit("ReingestedRecords", float64(s.Reingested), "Count")
+	emit("BytesIn", float64(s.InputBytes), "Bytes")
+	emit("BytesOut", float64(s.OutputBytes), "Bytes")
+	emit("TransformLatency", float64(s.TransformTime)/float64(time.Millisecond), "Milliseconds")
+	emit("AverageDecompressedRecordSize", s.averageDecompressedSize(), "Bytes")
+	emit("EstimatedCost", estimateCost(*s), "None")
+	for _, reason := range dropReasons {
+		emit("DroppedRecords."+reason, float64(s.Dropped[reason]), "Count")
+	}
+	for _, reason := range failReasons {
+		emit("FailedRecords."+reason, float64(s.Failed[reason]), "Count")
+	}
+
+	keys := make([]logStreamKey, 0, len(s.LastSeen))
+	for k := range s.LastSeen {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].LogGroup != keys[j].LogGroup {
+			return keys[i].LogGroup < keys[j].LogGroup
+		}
+		return keys[i].LogStream < keys[j].LogStream
+	})
+	for _, k := range keys {
+		outputf("last_seen log_group=%q log_stream=%q timestamp=%d\n", k.LogGroup, k.LogStream, s.LastSeen[k])
+	}
+	if s.UntrackedEvents > 0 {
+		emit("LastSeenUntrackedEvents", float64(s.UntrackedEvents), "Count")
+	}
+
+	if config.CountUniqueSources {
+		emit("UniqueLogGroups", float64(len(s.LogGroups)), "Count")
+		emit("UniqueLogStreams", float64(len(s.LogStreams)), "Count")
+		if s.UniqueSourcesCapped {
+			logf("Stopped counting unique log groups and streams at %d, the counts are lower bounds\n", config.MaxUniqueSources)
+		}
+	}
+
+	if config.EmitRecordLatency {
+		s.RecordLatency.emit(emit, "RecordLatency")
+	}
+
+	if config.EmitMemoryMetrics {
+		// ReadMemStats stops the world, hence the toggle.
+		ms := runtime.MemStats{}
+		runtime.ReadMemStats(&ms)
+		emit("HeapInUse", float64(ms.HeapInuse), "Bytes")
+	}
+
+	metrics.flush(emit)
+}
+
+// emitMetric logs a single metric value.
+func emitMetric(name string, value float64, unit string) {
+	outputf("metric %s=%g unit=%s\n", name, value, unit)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsAverageDecompressedSize(t *testing.T) {
+	require.Equal(t, 0.0, (&Stats{}).averageDecompressedSize())
+	require.Equal(t, 2.5, (&Stats{DecompressedRecords: 2, DecompressedBytes: 5}).averageDecompressedSize())
+}
+
+func TestTransformRecordsStats(t *testing.T) {
+	messages := []Message{
+		{MessageType: dataMessage, LogEvents: []LogEvent{{Id: "a", Message: "short"}}},
+		{MessageType: dataMessage, LogEvents: []LogEvent{{Id: "b", Message: "a somewhat longer message"}}},
+		{MessageType: controlMessage},
+	}
+
+	e := Event{}
+	expectedBytes := 0
+	for i, m := range messages {
+		e.Records = append(e.Records, EventRecord{RecordId: strconv.Itoa(i), Data: encodeMessage(t, m)})
+		expectedBytes += len(messageJson(t, m))
+	}
+	// Records that can't be decompressed don't count towards the average.
+	e.Records = append(e.Records, EventRecord{RecordId: "9", Data: "dGVzdAo="})
+
+	stats := &Stats{}
+	transformRecords(e, stats)
+
+	require.Equal(t, 4, stats.Records)
+	require.Equal(t, 3, stats.DecompressedRecords)
+	require.Equal(t, expectedBytes, stats.DecompressedBytes)
+	require.Equal(t, float64(expectedBytes)/3, stats.averageDecompressedSize())
+}
+
+func TestHandleRequestEmitsAverageDecompressedSize(t *testing.T) {
+	b := captureLogs(t)
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{MessageType: controlMessage})},
+		},
+	}
+
+	_, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "metric AverageDecompressedRecordSize=")
+}
+
+func TestHandleRequestEmitsHeapInUse(t *testing.T) {
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{MessageType: controlMessage})},
+		},
+	}
+
+	for _, enabled := range []bool{true, false} {
+		t.Run(strconv.FormatBool(enabled), func(t *testing.T) {
+			b := captureLogs(t)
+			withConfig(t, func(c *Config) {
+				c.EmitMemoryMetrics = enabled
+			})
+
+			_, err := HandleRequest(context.Background(), e)
+			require.NoError(t, err)
+			if enabled {
+				require.Regexp(t, `metric HeapInUse=[0-9.e+]+ unit=Bytes`, b.String())
+			} else {
+				require.NotContains(t, b.String(), "HeapInUse")
+			}
+		})
+	}
+}
+
+func TestHandleRequestDropReasons(t *testing.T) {
+	b := captureLogs(t)
+	withFakeAPIs(t)
+	withConfig(t, func(c *Config) {
+		c.StripAnsi = true
+	})
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: ""},
+			{RecordId: "2", Data: encodeMessage(t, Message{MessageType: controlMessage})},
+			{RecordId: "3", Data: encodeMessage(t, Message{MessageType: controlMessage})},
+			{RecordId: "4", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "a", Message: "\x1b[0m"}},
+			})},
+			{RecordId: "5", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "b", Message: "kept"}},
+			})},
+		},
+	}
+
+	r, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	for i, rr := range r.Records {
+		if i < 4 {
+			require.Equal(t, resultStatusDropped, rr.Result, rr.RecordId)
+		}
+	}
+	require.Equal(t, resultStatusOk, r.Records[4].Result)
+
+	require.Contains(t, b.String(), "metric DroppedRecords.empty_record=1 unit=Count")
+	require.Contains(t, b.String(), "metric DroppedRecords.control_message=2 unit=Count")
+	require.Contains(t, b.String(), "metric DroppedRecords.empty_transform=1 unit=Count")
+	require.Contains(t, b.String(), "metric DroppedRecords.size_limit=0 unit=Count")
+}
+
+func TestTransformRecordsDropReasonSizeLimit(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.MaxResultBytes = 1
+	})
+
+	m := Message{
+		MessageType: dataMessage,
+		LogEvents:   []LogEvent{{Id: "a", Message: "message"}},
+	}
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, m)},
+			{RecordId: "2", Data: encodeMessage(t, m)},
+			{RecordId: "3", Data: encodeMessage(t, m)},
+		},
+	}
+
+	stats := &Stats{}
+	transformRecords(e, stats)
+	require.Equal(t, map[string]int{dropReasonSizeLimit: 2}, stats.Dropped)
+}
+
+func TestTransformRecordsFailReasons(t *testing.T) {
+	b := captureLogs(t)
+	notJson := &bytes.Buffer{}
+	require.NoError(t, gzipCompress(notJson, []byte("not JSON")))
+
+	withConfig(t, func(c *Config) {
+		c.MissingData = missingDataFail
+		c.TransformPipeline = []string{transformStepJsonField}
+		c.JsonField = "msg"
+	})
+
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "missing", dataMissing: true},
+			{RecordId: "base64", Data: "not base64!"},
+			{RecordId: "decompress", Data: base64.StdEncoding.EncodeToString([]byte{0x1f, 0x8b, 0x08})},
+			{RecordId: "json", Data: base64.StdEncoding.EncodeToString(notJson.Bytes())},
+			{RecordId: "type", Data: encodeMessage(t, Message{MessageType: "SOMETHING_ELSE"})},
+			{RecordId: "transform", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "a", Message: "not JSON"}},
+			})},
+		},
+	}
+
+	stats := &Stats{}
+	resultRecords, _ := transformRecords(e, stats)
+	for _, r := range resultRecords {
+		require.Equal(t, resultStatusFailed, r.Result, r.RecordId)
+	}
+	require.Equal(t, map[string]int{
+		failReasonMissingData:        1,
+		failReasonBase64:             1,
+		failReasonDecompress:         1,
+		failReasonJsonUnmarshal:      1,
+		failReasonUnknownMessageType: 1,
+		failReasonTransform:          1,
+	}, stats.Failed)
+
+	require.Contains(t, b.String(), "WARN Failing record base64: base64_decode. illegal base64 data")
+	require.Contains(t, b.String(), "WARN Failing record json: json_unmarshal. ")
+	require.Contains(t, b.String(), `WARN Failing record type: unknown_message_type. Message type "SOMETHING_ELSE"`)
+
+	stats.emitMetrics()
+	require.Contains(t, b.String(), "metric FailedRecords.decompress=1 unit=Count\n")
+	require.Contains(t, b.String(), "metric FailedRecords.reingest=0 unit=Count\n")
+}
+
+func TestHandleRequestInvocationMetrics(t *testing.T) {
+	b := captureLogs(t)
+	withFakeAPIs(t)
+	withFakeClock(t).step = 3 * time.Millisecond
+
+	_, stats, err := HandleRequestWithStats(context.Background(), Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "a", Message: "hello"}},
+			})},
+			{RecordId: "2", Data: encodeMessage(t, Message{MessageType: controlMessage})},
+		},
+	})
+	require.NoError(t, err)
+
+	require.Greater(t, stats.InputBytes, 0)
+	require.Equal(t, len("hello\n"), stats.OutputBytes)
+	require.True(t, stats.TransformTime >= 3*time.Millisecond)
+
+	require.Contains(t, b.String(), "metric Records=2 unit=Count\n")
+	require.Contains(t, b.String(), "metric OkRecords=1 unit=Count\n")
+	require.Contains(t, b.String(), "metric DroppedRecords=1 unit=Count\n")
+	require.Contains(t, b.String(), "metric FailedRecords=0 unit=Count\n")
+	require.Contains(t, b.String(), "metric ReingestedRecords=0 unit=Count\n")
+	require.Contains(t, b.String(), "metric BytesOut=6 unit=Bytes\n")
+	require.Contains(t, b.String(), "metric TransformLatency=")
+}
+
+func TestHandleRequestWithStats(t *testing.T) {
+	captureLogs(t)
+	fh, _ := withFakeAPIs(t)
+	withConfig(t, func(c *Config) {
+		c.RecordPerLogEvent = true
+	})
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents: []LogEvent{
+					{Id: "a", Message: "first"},
+					{Id: "b", Message: "second"},
+					{Id: "c", Message: "third"},
+				},
+			})},
+			{RecordId: "2", Data: encodeMessage(t, Message{MessageType: controlMessage})},
+			{RecordId: "3", Data: "dGVzdAo="},
+		},
+	}
+
+	r, stats, err := HandleRequestWithStats(context.Background(), e)
+	require.NoError(t, err)
+	require.Len(t, r.Records, 3)
+	require.Len(t, fh.inputs, 1)
+
+	require.Equal(t, 3, stats.Records)
+	require.Equal(t, 2, stats.DecompressedRecords)
+	require.Equal(t, map[string]int{dropReasonControlMessage: 1}, stats.Dropped)
+	require.Equal(t, map[string]int{
+		resultStatusOk:      1,
+		resultStatusDropped: 1,
+		resultStatusFailed:  1,
+	}, stats.Results)
+	require.Equal(t, 2, stats.Reingested)
+
+	// The Firehose handler returns the very same response.
+	fh.inputs = nil
+	r2, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	require.Equal(t, r, r2)
+}
+
+func TestStatsSeen(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.MaxLastSeenStreams = 2
+	})
+
+	s := &Stats{}
+	s.seen(&Message{LogGroup: "g", LogStream: "a", LogEvents: []LogEvent{{Timestamp: 5}, {Timestamp: 9}, {Timestamp: 7}}})
+	s.seen(&Message{LogGroup: "g", LogStream: "a", LogEvents: []LogEvent{{Timestamp: 8}}})
+	s.seen(&Message{LogGroup: "g", LogStream: "b", LogEvents: []LogEvent{{Timestamp: 3}}})
+	s.seen(&Message{LogGroup: "g", LogStream: "b", LogEvents: []LogEvent{{Timestamp: 4}}})
+	s.seen(&Message{LogGroup: "g", LogStream: "c", LogEvents: []LogEvent{{Timestamp: 1}, {Timestamp: 2}}})
+	s.seen(&Message{LogGroup: "g", LogStream: "d"})
+
+	require.Equal(t, map[logStreamKey]int{
+		{LogGroup: "g", LogStream: "a"}: 9,
+		{LogGroup: "g", LogStream: "b"}: 4,
+	}, s.LastSeen)
+	require.Equal(t, 2, s.UntrackedEvents)
+}
+
+func TestStatsSeenOff(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.MaxLastSeenStreams = 0
+	})
+
+	s := &Stats{}
+	s.seen(&Message{LogGroup: "g", LogStream: "a", LogEvents: []LogEvent{{Timestamp: 5}}})
+
+	require.Empty(t, s.LastSeen)
+	require.Zero(t, s.UntrackedEvents)
+}
+
+func TestHandleRequestEmitsLastSeen(t *testing.T) {
+	b := captureLogs(t)
+	withFakeAPIs(t)
+	withConfig(t, func(c *Config) {
+		c.MaxLastSeenStreams = 100
+	})
+
+	message := func(group, stream string, timestamps ...int) string {
+		m := Message{MessageType: dataMessage, LogGroup: group, LogStream: stream}
+		for i, ts := range timestamps {
+			m.LogEvents = append(m.LogEvents, LogEvent{Id: strconv.Itoa(i), Timestamp: ts, Message: "m"})
+		}
+		return encodeMessage(t, m)
+	}
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: message("/aws/lambda/b", "s1", 1621224132233, 1621224132000)},
+			{RecordId: "2", Data: message("/aws/lambda/a", "s1", 1621224100000)},
+			{RecordId: "3", Data: message("/aws/lambda/b", "s1", 1621224132300)},
+		},
+	}
+
+	_, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	require.Contains(t, b.String(),
+		"last_seen log_group=\"/aws/lambda/a\" log_stream=\"s1\" timestamp=1621224100000\n"+
+			"last_seen log_group=\"/aws/lambda/b\" log_stream=\"s1\" timestamp=1621224132300\n")
+	require.NotContains(t, b.String(), "LastSeenUntrackedEvents")
+}
+
+func TestStatsCountSource(t *testing.T) {
+	messages := []*Message{
+		{LogGroup: "g1", LogStream: "a"},
+		{LogGroup: "g1", LogStream: "a"},
+		{LogGroup: "g1", LogStream: "b"},
+		{LogGroup: "g2", LogStream: "a"},
+		{LogGroup: "g3", LogStream: "c"},
+	}
+
+	for _, tc := range []struct {
+		name            string
+		enabled         bool
+		max             int
+		expectedGroups  int
+		expectedStreams int
+		expectedCapped  bool
+	}{
+		{name: "disabled", max: 1000},
+		{name: "enabled", enabled: true, max: 1000, expectedGroups: 3, expectedStreams: 4},
+		{name: "capped", enabled: true, max: 2, expectedGroups: 2, expectedStreams: 2, expectedCapped: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.CountUniqueSources = tc.enabled
+				c.MaxUniqueSources = tc.max
+			})
+
+			s := &Stats{}
+			for _, m := range messages {
+				s.countSource(m)
+			}
+
+			require.Len(t, s.LogGroups, tc.expectedGroups)
+			require.Len(t, s.LogStreams, tc.expectedStreams)
+			require.Equal(t, tc.expectedCapped, s.UniqueSourcesCapped)
+		})
+	}
+}
+
+func TestHandleRequestEmitsUniqueSources(t *testing.T) {
+	b := captureLogs(t)
+	withConfig(t, func(c *Config) {
+		c.CountUniqueSources = true
+	})
+	withFakeAPIs(t)
+
+	message := func(group, stream string) string {
+		return encodeMessage(t, Message{
+			MessageType: dataMessage,
+			LogGroup:    group,
+			LogStream:   stream,
+			LogEvents:   []LogEvent{{Id: "1", Message: "m"}},
+		})
+	}
+
+	e := Event{
+		DeliveryStreamArn: "arn:aws:firehose:us-east-1:1234567890:deliverystream/DataLog",
+		Records: []EventRecord{
+			{RecordId: "1", Data: message("/aws/lambda/a", "s1")},
+			{RecordId: "2", Data: message("/aws/lambda/a", "s2")},
+			{RecordId: "3", Data: message("/aws/lambda/b", "s1")},
+			{RecordId: "4", Data: message("/aws/lambda/a", "s1")},
+		},
+	}
+
+	_, err := HandleRequest(context.Background(), e)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "metric UniqueLogGroups=2 unit=Count\n")
+	require.Contains(t, b.String(), "metric UniqueLogStreams=3 unit=Count\n")
+	require.NotContains(t, b.String(), "lower bounds")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// formatStatsd renders a message matching config.MetricMessagePattern as a
+// statsd gauge line, in the extended format Splunk ingests in to metrics
+// indexes, with EnrichTags as dimensions:
+//
+//	name:value|g|#key:value,...
+//
+// It returns false for messages that don't match or whose value isn't a
+// number.
+func formatStatsd(message string) (string, bool) {
+	re := config.MetricMessagePattern
+	if re == nil {
+		return "", false
+	}
+
+	match := re.FindStringSubmatch(message)
+	if match == nil || match[0] != message {
+		return "", false
+	}
+
+	var name, value string
+	for i, g := range re.SubexpNames() {
+		switch g {
+		case "name":
+			name = match[i]
+		case "value":
+			value = match[i]
+		}
+	}
+	if name == "" {
+		return "", false
+	}
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return "", false
+	}
+
+	line := name + ":" + value + "|g"
+	if len(config.EnrichTags) > 0 {
+		keys := make([]string, 0, len(config.EnrichTags))
+		for k := range config.EnrichTags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		dims := make([]string, 0, len(keys))
+		for _, k := range keys {
+			dims = append(dims, k+":"+config.EnrichTags[k])
+		}
+		line += "|#" + strings.Join(dims, ",")
+	}
+
+	return line, true
+}
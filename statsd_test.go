@@ -0,0 +1,77 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatStatsd(t *testing.T) {
+	pattern := `\s*(?P<name>[\w.]+)\s*=\s*(?P<value>\S+)\s*`
+
+	for _, tc := range []struct {
+		name     string
+		pattern  string
+		tags     map[string]string
+		message  string
+		expected string
+	}{
+		{
+			name:     "integer",
+			pattern:  pattern,
+			message:  "cpu.usage=42",
+			expected: "cpu.usage:42|g",
+		},
+		{
+			name:     "float",
+			pattern:  pattern,
+			message:  " latency = -0.25 ",
+			expected: "latency:-0.25|g",
+		},
+		{
+			name:     "dimensions",
+			pattern:  pattern,
+			tags:     map[string]string{"env": "prod", "app": "api"},
+			message:  "cpu.usage=42",
+			expected: "cpu.usage:42|g|#app:api,env:prod",
+		},
+		{
+			name:    "not a number",
+			pattern: pattern,
+			message: "status=ok",
+		},
+		{
+			name:    "not a metric",
+			pattern: pattern,
+			message: "GET /index.html 200",
+		},
+		{
+			name:    "partial match",
+			pattern: pattern,
+			message: "request done, cpu.usage=42 after retry",
+		},
+		{
+			name:    "no name group",
+			pattern: `cpu=(?P<value>\d+)`,
+			message: "cpu=42",
+		},
+		{
+			name:    "not configured",
+			message: "cpu.usage=42",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				if tc.pattern != "" {
+					c.MetricMessagePattern = regexp.MustCompile(tc.pattern)
+				}
+				c.EnrichTags = tc.tags
+			})
+
+			line, ok := formatStatsd(tc.message)
+			require.Equal(t, tc.expected != "", ok)
+			require.Equal(t, tc.expected, line)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"text/template"
+	"time"
+)
+
+const outputFormatTemplate = "template"
+
+// messageTemplate is a parsed MESSAGE_TEMPLATE. It describes itself as its
+// source, for diagnostics.
+type messageTemplate struct {
+	*template.Template
+	source string
+}
+
+func (t *messageTemplate) String() string {
+	return t.source
+}
+
+// templateData is what a message template is executed with.
+type templateData struct {
+	// Message is the log event message, after the transform steps.
+	Message string
+
+	// Fields are the fields of Message if it is a JSON object, and nil
+	// otherwise.
+	Fields map[string]interface{}
+
+	Id          string
+	Timestamp   int
+	Time        time.Time
+	Owner       string
+	LogGroup    string
+	LogStream   string
+	RecordId    string
+	RecordIndex int
+	EventIndex  int
+}
+
+// envTemplate parses a message template, returning nil if there is none or
+// it is invalid.
+func envTemplate(key string) *messageTemplate {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return nil
+	}
+
+	t, err := template.New(key).Option("missingkey=error").Parse(v)
+	if err != nil {
+		warnf("Invalid value %q for %s, ignoring it. %s\n", v, key, err)
+		return nil
+	}
+
+	return &messageTemplate{Template: t, source: v}
+}
+
+// formatTemplate renders the message with the configured MessageTemplate.
+// The message is returned as is if there is no template or it fails to
+// render.
+func formatTemplate(m *Message, l LogEvent, meta eventMeta, message string) string {
+	if config.MessageTemplate == nil {
+		return message
+	}
+
+	data := templateData{
+		Message:     message,
+		Id:          l.Id,
+		Timestamp:   l.Timestamp,
+		Time:        l.time(),
+		Owner:       m.Owner,
+		LogGroup:    m.LogGroup,
+		LogStream:   m.LogStream,
+		RecordId:    meta.record.RecordId,
+		RecordIndex: meta.recordIndex,
+		EventIndex:  meta.eventIndex,
+	}
+	if err := json.Unmarshal([]byte(message), &data.Fields); err != nil {
+		data.Fields = nil
+	}
+
+	b := &bytes.Buffer{}
+	if err := config.MessageTemplate.Execute(b, data); err != nil {
+		return message
+	}
+	return b.String()
+}
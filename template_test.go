@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvTemplate(t *testing.T) {
+	captureLogs(t)
+
+	t.Setenv("TEST_ENV_TEMPLATE", "")
+	require.Nil(t, envTemplate("TEST_ENV_TEMPLATE"))
+
+	t.Setenv("TEST_ENV_TEMPLATE", "{{.Message")
+	require.Nil(t, envTemplate("TEST_ENV_TEMPLATE"))
+
+	t.Setenv("TEST_ENV_TEMPLATE", "{{.Message}}")
+	require.Equal(t, "{{.Message}}", envTemplate("TEST_ENV_TEMPLATE").String())
+}
+
+func TestFormatTemplate(t *testing.T) {
+	m := &Message{LogGroup: "/aws/lambda/app", LogStream: "stream", Owner: "1234567890"}
+	l := LogEvent{Id: "a", Timestamp: 1621224044000}
+	meta := eventMeta{record: EventRecord{RecordId: "1"}, recordIndex: 2, eventIndex: 3}
+
+	for _, tc := range []struct {
+		name     string
+		template string
+		message  string
+		expected string
+	}{
+		{
+			name:     "json message",
+			template: "{{.LogGroup}} level={{.Fields.level}} {{.Fields.msg}}",
+			message:  `{"level":"warn","msg":"disk almost full"}`,
+			expected: "/aws/lambda/app level=warn disk almost full",
+		},
+		{
+			name:     "non-json message",
+			template: "{{.Time.Format \"2006-01-02\"}} {{.LogStream}} {{.Message}}",
+			message:  "disk almost full",
+			expected: "2021-05-17 stream disk almost full",
+		},
+		{
+			name:     "metadata",
+			template: "{{.Owner}} {{.Id}} {{.Timestamp}} {{.RecordId}} {{.RecordIndex}} {{.EventIndex}}",
+			message:  "disk almost full",
+			expected: "1234567890 a 1621224044000 1 2 3",
+		},
+		{
+			name:     "missing field falls back to raw",
+			template: "{{.Fields.level}} {{.Fields.msg}}",
+			message:  `{"msg":"disk almost full"}`,
+			expected: `{"msg":"disk almost full"}`,
+		},
+		{
+			name:     "fields of non-json message fall back to raw",
+			template: "{{.Fields.msg}}",
+			message:  "disk almost full",
+			expected: "disk almost full",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("MESSAGE_TEMPLATE", tc.template)
+			withConfig(t, func(c *Config) {
+				c.MessageTemplate = envTemplate("MESSAGE_TEMPLATE")
+			})
+
+			require.Equal(t, tc.expected, formatTemplate(m, l, meta, tc.message))
+		})
+	}
+}
+
+func TestFormatLogEventTemplate(t *testing.T) {
+	t.Setenv("MESSAGE_TEMPLATE", "[{{.LogStream}}] {{.Message}}")
+	withConfig(t, func(c *Config) {
+		c.OutputFormat = outputFormatTemplate
+		c.MessageTemplate = envTemplate("MESSAGE_TEMPLATE")
+	})
+
+	out, err := formatLogEvent(&Message{LogStream: "stream"}, LogEvent{}, eventMeta{}, "hello")
+	require.NoError(t, err)
+	require.Equal(t, "[stream] hello", out)
+
+	withConfig(t, func(c *Config) {
+		c.MessageTemplate = nil
+	})
+	out, err = formatLogEvent(&Message{LogStream: "stream"}, LogEvent{}, eventMeta{}, "hello")
+	require.NoError(t, err)
+	require.Equal(t, "hello", out)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Timestamps in events, both the ApproximateArrivalTimestamp of records and
+// the Timestamp of log events, are milliseconds since the Unix epoch. They
+// are kept as such and only ever converted to time.Time with
+// millisecondsToTime, so they are never mistaken for seconds.
+
+// iso8601Milliseconds is the ISO-8601 layout, to the millisecond, that
+// timestamps are formatted with by default.
+const iso8601Milliseconds = "2006-01-02T15:04:05.000Z07:00"
+
+// millisecondsToTime converts milliseconds since the Unix epoch to a
+// time.Time in UTC.
+func millisecondsToTime(ms int) time.Time {
+	return time.Unix(0, int64(ms)*int64(time.Millisecond)).UTC()
+}
+
+// timeToMilliseconds converts t to milliseconds since the Unix epoch, the
+// other way round from millisecondsToTime.
+func timeToMilliseconds(t time.Time) int {
+	return int(t.UnixNano() / int64(time.Millisecond))
+}
+
+// time returns when the log event was logged.
+func (l *LogEvent) time() time.Time {
+	return millisecondsToTime(l.Timestamp)
+}
+
+// sortLogEvents returns a copy of logEvents sorted by Timestamp. Log events
+// logged at the same time keep their order.
+func sortLogEvents(logEvents []LogEvent) []LogEvent {
+	sorted := make([]LogEvent, len(logEvents))
+	copy(sorted, logEvents)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp < sorted[j].Timestamp
+	})
+	return sorted
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMillisecondsToTime(t *testing.T) {
+	require.Equal(t, time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), millisecondsToTime(0))
+	require.Equal(t, time.Date(2021, 5, 17, 4, 2, 12, 233000000, time.UTC), millisecondsToTime(1621224132233))
+	require.Equal(t, time.Date(1970, 1, 1, 0, 0, 1, 0, time.UTC), millisecondsToTime(1000))
+}
+
+func TestEventTimestampsAreMilliseconds(t *testing.T) {
+	e := Event{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"records": [{"recordId": "1", "approximateArrivalTimestamp": 1621224132233}]
+	}`), &e))
+	arrived := millisecondsToTime(e.Records[0].ApproximateArrivalTimestamp)
+	require.Equal(t, time.Date(2021, 5, 17, 4, 2, 12, 233000000, time.UTC), arrived)
+
+	m := Message{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"logEvents": [{"id": "a", "timestamp": 1621224044000, "message": "hello"}]
+	}`), &m))
+	require.Equal(t, time.Date(2021, 5, 17, 4, 0, 44, 0, time.UTC), m.LogEvents[0].time())
+
+	// Both arrive within a few minutes of each other, as they would if they
+	// were read in the same unit.
+	require.InDelta(t, 0, arrived.Sub(m.LogEvents[0].time()).Minutes(), 5)
+}
+
+func TestSortLogEvents(t *testing.T) {
+	logEvents := []LogEvent{
+		{Id: "c", Timestamp: 3},
+		{Id: "a", Timestamp: 1},
+		{Id: "b1", Timestamp: 2},
+		{Id: "b2", Timestamp: 2},
+	}
+
+	ids := func(logEvents []LogEvent) []string {
+		ids := []string{}
+		for _, l := range logEvents {
+			ids = append(ids, l.Id)
+		}
+		return ids
+	}
+
+	require.Equal(t, []string{"a", "b1", "b2", "c"}, ids(sortLogEvents(logEvents)))
+	require.Equal(t, []string{"c", "a", "b1", "b2"}, ids(logEvents))
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The steps a transform pipeline can be made of.
+const (
+	transformStepFilterPatterns     = "filter-patterns"
+	transformStepMinLevel           = "min-level"
+	transformStepDropSubstrings     = "drop-substrings"
+	transformStepMaskFields         = "mask-fields"
+	transformStepRedact             = "redact"
+	transformStepStripAnsi          = "strip-ansi"
+	transformStepCollapseWhitespace = "collapse-whitespace"
+	transformStepJsonField          = "json-field"
+	transformStepFlowLog            = "flow-log"
+)
+
+// Transformer is a step of a transform pipeline. It takes a log event
+// message and returns it transformed, or empty to drop it.
+type Transformer interface {
+	Transform(message string) (string, error)
+}
+
+// TransformerFunc makes a function a Transformer.
+type TransformerFunc func(message string) (string, error)
+
+// Transform calls f(message).
+func (f TransformerFunc) Transform(message string) (string, error) {
+	return f(message)
+}
+
+// transformSteps are the steps of transform pipelines by name. Steps of your
+// own can be added with registerTransformer from a package level variable
+// declaration of a separate file, and then used in TRANSFORM_PIPELINE. These
+// are initialized before any init function, so before config is loaded and
+// the pipeline is checked against the known steps.
+var transformSteps = map[string]Transformer{
+	transformStepFilterPatterns: TransformerFunc(func(message string) (string, error) {
+		if isFilteredOut(message) {
+			countMetric("FilteredLogEvents", 1, "Count")
+			return "", nil
+		}
+		return message, nil
+	}),
+	transformStepMinLevel: TransformerFunc(func(message string) (string, error) {
+		if isBelowMinLevel(message) {
+			countMetric("BelowMinLevelLogEvents", 1, "Count")
+			return "", nil
+		}
+		return message, nil
+	}),
+	transformStepDropSubstrings: TransformerFunc(func(message string) (string, error) {
+		if isSynthetic(message) {
+			return "", nil
+		}
+		return message, nil
+	}),
+	transformStepMaskFields: TransformerFunc(func(message string) (string, error) {
+		return maskFields(message), nil
+	}),
+	transformStepRedact: TransformerFunc(func(message string) (string, error) {
+		return redact(message), nil
+	}),
+	transformStepStripAnsi: TransformerFunc(func(message string) (string, error) {
+		return stripAnsi(message), nil
+	}),
+	transformStepCollapseWhitespace: TransformerFunc(func(message string) (string, error) {
+		return collapseWhitespace(message), nil
+	}),
+	transformStepJsonField: TransformerFunc(extractJsonField),
+	transformStepFlowLog:   TransformerFunc(formatFlowLog),
+}
+
+// registerTransformer adds t to the transform steps as name, and returns it
+// so that it can be called from a variable declaration. It panics if there
+// already is a step of that name, as that is a programming error.
+func registerTransformer(name string, t Transformer) Transformer {
+	if _, ok := transformSteps[name]; ok {
+		panic(fmt.Sprintf("Transform step %q is already registered", name))
+	}
+	transformSteps[name] = t
+
+	return t
+}
+
+// transformChain is a Transformer that runs a message through a list of
+// named steps in order, stopping as soon as one drops it.
+type transformChain struct {
+	names []string
+	steps []Transformer
+}
+
+// newTransformChain returns the chain of the steps with the given names.
+func newTransformChain(names []string) (*transformChain, error) {
+	c := &transformChain{names: names}
+	for _, name := range names {
+		step, ok := transformSteps[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown transform step %q", name)
+		}
+		c.steps = append(c.steps, step)
+	}
+
+	return c, nil
+}
+
+// Transform runs message through the steps of c.
+func (c *transformChain) Transform(message string) (string, error) {
+	for i, step := range c.steps {
+		var err error
+		if message, err = step.Transform(message); err != nil {
+			return "", fmt.Errorf("Transform step %s failed. %s", c.names[i], err)
+		}
+		if message == "" {
+			return "", nil
+		}
+	}
+
+	return message, nil
+}
+
+// String returns the names of the steps of c, for the config diagnostics.
+func (c *transformChain) String() string {
+	return strings.Join(c.names, ",")
+}
+
+// loadTransformChain returns the chain of the transform pipeline of c, see
+// pipelineFor. Unknown steps are left out with a warning, rather than failing
+// every record.
+func loadTransformChain(c *Config) *transformChain {
+	names := []string{}
+	for _, name := range pipelineFor(c) {
+		if _, ok := transformSteps[name]; !ok {
+			warnf("Unknown transform step %q in TRANSFORM_PIPELINE, ignoring it\n", name)
+			continue
+		}
+		names = append(names, name)
+	}
+
+	// Every step is known, so this can't fail.
+	chain, _ := newTransformChain(names)
+
+	return chain
+}
+
+// pipelineFor returns the steps log event messages are transformed with
+// under c: c.TransformPipeline if set, or else the ones enabled by the
+// individual settings.
+func pipelineFor(c *Config) []string {
+	redacts := len(c.RedactPatterns) > 0 || len(c.RedactRules) > 0
+
+	if len(c.TransformPipeline) > 0 {
+		if redacts && !hasStep(c.TransformPipeline, transformStepRedact) {
+			// Redaction is a compliance requirement, so a custom pipeline
+			// can't leave it out: it is run last, over whatever the other
+			// steps make of the message.
+			return append(append([]string{}, c.TransformPipeline...), transformStepRedact)
+		}
+		return c.TransformPipeline
+	}
+
+	pipeline := []string{}
+	if c.IncludePattern != nil || c.ExcludePattern != nil {
+		pipeline = append(pipeline, transformStepFilterPatterns)
+	}
+	if c.MinMessageLevel != "" {
+		pipeline = append(pipeline, transformStepMinLevel)
+	}
+	pipeline = append(pipeline, transformStepDropSubstrings, transformStepMaskFields)
+	if c.StripAnsi {
+		pipeline = append(pipeline, transformStepStripAnsi)
+	}
+	if c.CollapseWhitespace {
+		pipeline = append(pipeline, transformStepCollapseWhitespace)
+	}
+	if redacts {
+		// Last, so that nothing the other steps do to the message can bring
+		// back something redaction would have caught.
+		pipeline = append(pipeline, transformStepRedact)
+	}
+
+	return pipeline
+}
+
+// hasStep tells whether pipeline has the step name.
+func hasStep(pipeline []string, name string) bool {
+	for _, step := range pipeline {
+		if step == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extractJsonField returns the config.JsonField field of a JSON message. It
+// is an error for the message not to be JSON or not to have the field.
+func extractJsonField(message string) (string, error) {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(message), &fields); err != nil {
+		return "", err
+	}
+
+	v, ok := fields[config.JsonField]
+	if !ok {
+		return "", fmt.Errorf("Message has no %s field", config.JsonField)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// ansiPattern matches ANSI escape sequences, such as the ones used to
+// colorize terminal output.
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]`)
+
+// whitespaceRunPattern matches runs of whitespace other than line breaks.
+var whitespaceRunPattern = regexp.MustCompile(`[^\S\r\n]{2,}`)
+
+// collapseWhitespace replaces runs of spaces, tabs and the like with a single
+// space, leaving line breaks alone.
+func collapseWhitespace(message string) string {
+	return whitespaceRunPattern.ReplaceAllString(message, " ")
+}
+
+// isFilteredOut tells whether message doesn't match config.IncludePattern
+// or matches config.ExcludePattern.
+func isFilteredOut(message string) bool {
+	if config.IncludePattern != nil && !config.IncludePattern.MatchString(message) {
+		return true
+	}
+
+	return config.ExcludePattern != nil && config.ExcludePattern.MatchString(message)
+}
+
+// messageLevelRanks orders the levels of application log messages by
+// severity, including the common synonyms.
+var messageLevelRanks = map[string]int{
+	"trace":    0,
+	"debug":    1,
+	"info":     2,
+	"notice":   2,
+	"warn":     3,
+	"warning":  3,
+	"error":    4,
+	"err":      4,
+	"fatal":    5,
+	"critical": 5,
+	"crit":     5,
+}
+
+// isBelowMinLevel tells whether message is JSON whose config.MessageLevelField
+// is a level below config.MinMessageLevel.
+func isBelowMinLevel(message string) bool {
+	min, ok := messageLevelRanks[strings.ToLower(config.MinMessageLevel)]
+	if !ok || !strings.HasPrefix(strings.TrimSpace(message), "{") {
+		return false
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(message), &fields); err != nil {
+		return false
+	}
+	level, ok := fields[config.MessageLevelField].(string)
+	if !ok {
+		return false
+	}
+	rank, ok := messageLevelRanks[strings.ToLower(level)]
+
+	return ok && rank < min
+}
+
+// isSynthetic tells whether message is a synthetic log line, such as a
+// health check, that contains one of config.DropSubstrings.
+func isSynthetic(message string) bool {
+	for _, s := range config.DropSubstrings {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stripAnsi removes ANSI escape sequences from message.
+func stripAnsi(message string) string {
+	return ansiPattern.ReplaceAllString(message, "")
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mustTransformLogEvent transforms a log event that is expected to transform
+// without error.
+func mustTransformLogEvent(t *testing.T, l LogEvent) string {
+	message, err := transformLogEvent(l)
+	require.NoError(t, err)
+
+	return message
+}
+
+func TestStripAnsi(t *testing.T) {
+	for _, tc := range []struct {
+		message  string
+		expected string
+	}{
+		{
+			message:  "\x1b[31mERROR\x1b[0m something failed",
+			expected: "ERROR something failed",
+		},
+		{
+			message:  "\x1b[1;32mINFO\x1b[m started \x1b[38;5;208min 3s\x1b[39m",
+			expected: "INFO started in 3s",
+		},
+		{
+			message:  "\x1b[2K\x1b[1Gprogress",
+			expected: "progress",
+		},
+		{
+			message:  "plain [31m message",
+			expected: "plain [31m message",
+		},
+	} {
+		t.Run(tc.expected, func(t *testing.T) {
+			require.Equal(t, tc.expected, stripAnsi(tc.message))
+		})
+	}
+}
+
+func TestTransformLogEventStripAnsi(t *testing.T) {
+	l := LogEvent{Message: "\x1b[33mWARN\x1b[0m disk almost full"}
+
+	require.Equal(t, l.Message, mustTransformLogEvent(t, l))
+
+	withConfig(t, func(c *Config) {
+		c.StripAnsi = true
+	})
+	require.Equal(t, "WARN disk almost full", mustTransformLogEvent(t, l))
+	require.Equal(t, "no colors here", mustTransformLogEvent(t, LogEvent{Message: "no colors here"}))
+}
+
+func TestCollapseWhitespace(t *testing.T) {
+	for _, tc := range []struct {
+		message  string
+		expected string
+	}{
+		{
+			message:  "GET  /index.html\t\t200",
+			expected: "GET /index.html 200",
+		},
+		{
+			message:  "single spaces\tand\ttabs stay",
+			expected: "single spaces\tand\ttabs stay",
+		},
+		{
+			message:  "first line   \n    second line",
+			expected: "first line \n second line",
+		},
+		{
+			message:  "windows  \r\nline endings",
+			expected: "windows \r\nline endings",
+		},
+		{
+			message:  "blank\n\n\nlines",
+			expected: "blank\n\n\nlines",
+		},
+	} {
+		t.Run(tc.expected, func(t *testing.T) {
+			require.Equal(t, tc.expected, collapseWhitespace(tc.message))
+		})
+	}
+}
+
+func TestTransformLogEventCollapseWhitespace(t *testing.T) {
+	l := LogEvent{Message: "a  lot \t of\n  space"}
+
+	require.Equal(t, l.Message, mustTransformLogEvent(t, l))
+
+	withConfig(t, func(c *Config) {
+		c.CollapseWhitespace = true
+	})
+	require.Equal(t, "a lot of\n space", mustTransformLogEvent(t, l))
+}
+
+func TestTransformLogEventDropSubstrings(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.DropSubstrings = []string{"ELB-HealthChecker/2.0", "GET /healthz"}
+	})
+
+	for _, tc := range []struct {
+		message  string
+		expected string
+	}{
+		{
+			message:  `10.0.0.1 - - [17/May/2021:04:02:12 +0000] "GET / HTTP/1.1" 200 0 "-" "ELB-HealthChecker/2.0"`,
+			expected: "",
+		},
+		{
+			message:  `10.0.0.2 - - [17/May/2021:04:02:13 +0000] "GET /healthz HTTP/1.1" 200 2`,
+			expected: "",
+		},
+		{
+			message:  `10.0.0.3 - - [17/May/2021:04:02:14 +0000] "GET /orders HTTP/1.1" 200 512 "-" "Mozilla/5.0"`,
+			expected: `10.0.0.3 - - [17/May/2021:04:02:14 +0000] "GET /orders HTTP/1.1" 200 512 "-" "Mozilla/5.0"`,
+		},
+	} {
+		t.Run(tc.message, func(t *testing.T) {
+			require.Equal(t, tc.expected, mustTransformLogEvent(t, LogEvent{Message: tc.message}))
+		})
+	}
+}
+
+func TestTransformRecordsDropSubstrings(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.DropSubstrings = []string{"ELB-HealthChecker"}
+	})
+
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents: []LogEvent{
+					{Id: "a", Message: "GET / ELB-HealthChecker/2.0"},
+					{Id: "b", Message: "GET /orders"},
+				},
+			})},
+			{RecordId: "2", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents: []LogEvent{
+					{Id: "c", Message: "GET / ELB-HealthChecker/2.0"},
+				},
+			})},
+		},
+	}
+
+	resultRecords, _ := transformRecords(e, &Stats{})
+	require.Equal(t, ResultRecordList{
+		{RecordId: "1", Result: resultStatusOk, Data: base64.StdEncoding.EncodeToString([]byte("GET /orders\n"))},
+		{RecordId: "2", Result: resultStatusDropped},
+	}, resultRecords)
+}
+
+func TestTransformLogEventFilterPatterns(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		include  string
+		exclude  string
+		message  string
+		expected string
+	}{
+		{name: "included", include: `^\{`, message: `{"path":"/orders"}`, expected: `{"path":"/orders"}`},
+		{name: "not included", include: `^\{`, message: "plain text", expected: ""},
+		{name: "excluded", exclude: `ELB-HealthChecker`, message: "GET / ELB-HealthChecker/2.0", expected: ""},
+		{name: "not excluded", exclude: `ELB-HealthChecker`, message: "GET /orders", expected: "GET /orders"},
+		{name: "included but excluded", include: `^GET`, exclude: `/healthz`, message: "GET /healthz", expected: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				if tc.include != "" {
+					c.IncludePattern = regexp.MustCompile(tc.include)
+				}
+				if tc.exclude != "" {
+					c.ExcludePattern = regexp.MustCompile(tc.exclude)
+				}
+			})
+
+			require.Equal(t, tc.expected, mustTransformLogEvent(t, LogEvent{Message: tc.message}))
+		})
+	}
+}
+
+func TestTransformRecordsFilterPatterns(t *testing.T) {
+	b := captureLogs(t)
+	withConfig(t, func(c *Config) {
+		c.ExcludePattern = regexp.MustCompile(`ELB-HealthChecker`)
+	})
+
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents: []LogEvent{
+					{Id: "a", Message: "GET / ELB-HealthChecker/2.0"},
+					{Id: "b", Message: "GET /orders"},
+				},
+			})},
+		},
+	}
+
+	stats := &Stats{}
+	resultRecords, _ := transformRecords(e, stats)
+	require.Equal(t, ResultRecordList{
+		{RecordId: "1", Result: resultStatusOk, Data: base64.StdEncoding.EncodeToString([]byte("GET /orders\n"))},
+	}, resultRecords)
+
+	stats.emitMetrics()
+	require.Contains(t, b.String(), "metric FilteredLogEvents=1 unit=Count")
+}
+
+func TestTransformLogEventMinLevel(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.MinMessageLevel = "INFO"
+	})
+
+	for _, tc := range []struct {
+		message  string
+		expected string
+	}{
+		{message: `{"level":"debug","msg":"cache miss"}`, expected: ""},
+		{message: `{"level":"TRACE","msg":"enter"}`, expected: ""},
+		{message: `{"level":"info","msg":"started"}`, expected: `{"level":"info","msg":"started"}`},
+		{message: `{"level":"warning","msg":"slow"}`, expected: `{"level":"warning","msg":"slow"}`},
+		{message: `{"level":"verbose","msg":"unknown level"}`, expected: `{"level":"verbose","msg":"unknown level"}`},
+		{message: `{"level":30,"msg":"numeric level"}`, expected: `{"level":30,"msg":"numeric level"}`},
+		{message: `{"msg":"no level"}`, expected: `{"msg":"no level"}`},
+		{message: `debug: not JSON`, expected: `debug: not JSON`},
+	} {
+		t.Run(tc.message, func(t *testing.T) {
+			require.Equal(t, tc.expected, mustTransformLogEvent(t, LogEvent{Message: tc.message}))
+		})
+	}
+
+	t.Run("level field", func(t *testing.T) {
+		withConfig(t, func(c *Config) {
+			c.MessageLevelField = "severity"
+		})
+
+		require.Equal(t, "", mustTransformLogEvent(t, LogEvent{Message: `{"severity":"DEBUG"}`}))
+		require.Equal(t, `{"level":"debug"}`, mustTransformLogEvent(t, LogEvent{Message: `{"level":"debug"}`}))
+	})
+}
+
+func TestTransformPipeline(t *testing.T) {
+	require.Equal(t, []string{transformStepDropSubstrings, transformStepMaskFields}, pipelineFor(&config))
+
+	withConfig(t, func(c *Config) {
+		c.StripAnsi = true
+		c.CollapseWhitespace = true
+	})
+	require.Equal(t, []string{
+		transformStepDropSubstrings,
+		transformStepMaskFields,
+		transformStepStripAnsi,
+		transformStepCollapseWhitespace,
+	}, pipelineFor(&config))
+
+	withConfig(t, func(c *Config) {
+		c.TransformPipeline = []string{transformStepJsonField}
+	})
+	require.Equal(t, []string{transformStepJsonField}, pipelineFor(&config))
+
+	withConfig(t, func(c *Config) {
+		c.TransformPipeline = nil
+		c.StripAnsi = false
+		c.CollapseWhitespace = false
+		c.ExcludePattern = regexp.MustCompile(`ELB-HealthChecker`)
+		c.MinMessageLevel = "info"
+	})
+	require.Equal(t, []string{
+		transformStepFilterPatterns,
+		transformStepMinLevel,
+		transformStepDropSubstrings,
+		transformStepMaskFields,
+	}, pipelineFor(&config))
+}
+
+func TestTransformLogEventPipeline(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		pipeline  []string
+		message   string
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:     "steps in order",
+			pipeline: []string{"strip-ansi", "json-field", "collapse-whitespace"},
+			message:  "{\"msg\":\"\x1b[31mERROR\x1b[0m   disk full\"}",
+			expected: "ERROR disk full",
+		},
+		{
+			name:     "order matters",
+			pipeline: []string{"json-field", "mask-fields"},
+			message:  `{"msg":{"password":"hunter2","user":"bob"}}`,
+			expected: `{"password":"****","user":"bob"}`,
+		},
+		{
+			name:     "masked before extracted",
+			pipeline: []string{"mask-fields", "json-field"},
+			message:  `{"msg":{"password":"hunter2","user":"bob"}}`,
+			expected: `{"password":"hunter2","user":"bob"}`,
+		},
+		{
+			name:     "steps not in the pipeline don't run",
+			pipeline: []string{"strip-ansi"},
+			message:  "GET /healthz \x1b[0m",
+			expected: "GET /healthz ",
+		},
+		{
+			name:     "dropped",
+			pipeline: []string{"strip-ansi", "drop-substrings", "json-field"},
+			message:  "GET /healthz",
+			expected: "",
+		},
+		{
+			name:     "flow log",
+			pipeline: []string{"flow-log"},
+			message:  "2 1234567890 eni-0abcedf0987654321 10.11.1.231 10.11.2.128 30036 9954 6 5 503 1621224044 1623324097 ACCEPT OK",
+			expected: `{"account-id":"1234567890","action":"ACCEPT","bytes":"503","dstaddr":"10.11.2.128","dstport":"9954","end":"1623324097","interface-id":"eni-0abcedf0987654321","log-status":"OK","packets":"5","protocol":"6","srcaddr":"10.11.1.231","srcport":"30036","start":"1621224044","version":"2"}`,
+		},
+		{
+			name:      "failing step",
+			pipeline:  []string{"strip-ansi", "json-field"},
+			message:   "not JSON",
+			expectErr: true,
+		},
+		{
+			name:     "unknown step left out",
+			pipeline: []string{"strip-ansi", "upper-case"},
+			message:  "hello \x1b[0m",
+			expected: "hello ",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.TransformPipeline = tc.pipeline
+				c.JsonField = "msg"
+				c.MaskFields = []string{"password"}
+				c.MaskToken = "****"
+				c.DropSubstrings = []string{"/healthz"}
+			})
+
+			message, err := transformLogEvent(LogEvent{Message: tc.message})
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, message)
+		})
+	}
+}
+
+func TestRegisterTransformer(t *testing.T) {
+	t.Cleanup(func() {
+		delete(transformSteps, "upper-case")
+	})
+
+	upperCase := TransformerFunc(func(message string) (string, error) {
+		return strings.ToUpper(message), nil
+	})
+	registerTransformer("upper-case", upperCase)
+	require.Panics(t, func() {
+		registerTransformer("upper-case", upperCase)
+	})
+
+	withConfig(t, func(c *Config) {
+		c.TransformPipeline = []string{transformStepStripAnsi, "upper-case"}
+	})
+	require.Equal(t, "ERROR DISK FULL", mustTransformLogEvent(t, LogEvent{Message: "\x1b[31mERROR\x1b[0m disk full"}))
+}
+
+func TestTransformRecordsFailingPipelineStep(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.TransformPipeline = []string{transformStepJsonField}
+		c.JsonField = "msg"
+	})
+
+	e := Event{
+		Records: []EventRecord{
+			{RecordId: "1", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents:   []LogEvent{{Id: "a", Message: `{"msg":"ok"}`}},
+			})},
+			{RecordId: "2", Data: encodeMessage(t, Message{
+				MessageType: dataMessage,
+				LogEvents: []LogEvent{
+					{Id: "b", Message: `{"msg":"ok"}`},
+					{Id: "c", Message: "not JSON"},
+				},
+			})},
+		},
+	}
+
+	resultRecords, _ := transformRecords(e, &Stats{})
+	require.Equal(t, ResultRecordList{
+		{RecordId: "1", Result: resultStatusOk, Data: base64.StdEncoding.EncodeToString([]byte("ok\n"))},
+		{RecordId: "2", Result: resultStatusFailed},
+	}, resultRecords)
+}
+
+func TestLoadConfigIgnoresUnknownTransformSteps(t *testing.T) {
+	b := captureLogs(t)
+	t.Setenv("TRANSFORM_PIPELINE", "strip-ansi,upper-case")
+
+	c := loadConfig()
+	require.Equal(t, []string{transformStepStripAnsi, "upper-case"}, c.TransformPipeline)
+	require.Equal(t, "strip-ansi", c.TransformChain.String())
+	require.Contains(t, b.String(), `Unknown transform step "upper-case" in TRANSFORM_PIPELINE, ignoring it`)
+
+	withConfig(t, func(c *Config) {
+		c.TransformPipeline = []string{transformStepStripAnsi, "upper-case"}
+	})
+	require.Equal(t, "hello ", mustTransformLogEvent(t, LogEvent{Message: "hello \x1b[0m"}))
+}